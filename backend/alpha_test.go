@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// semiTransparentPNG encodes an 8x8 image whose pixels all store the color
+// 200,200,200 at alpha 128, decoded the way an upload would be
+func semiTransparentPNG(t *testing.T) image.Image {
+	t.Helper()
+
+	src := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(src.Pix); i += 4 {
+		copy(src.Pix[i:], []uint8{200, 200, 200, 128})
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, src); err != nil {
+		t.Fatal(err)
+	}
+	img, err := decodeImage(&buf, "fixture.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestFlattenAlpha(t *testing.T) {
+	img := semiTransparentPNG(t)
+	black := color.RGBA{0, 0, 0, 255}
+	white := color.RGBA{255, 255, 255, 255}
+
+	tests := []struct {
+		alpha      string
+		background color.RGBA
+		want       uint8
+	}{
+		// 200*128/255 + background*(127/255)
+		{alphaStraight, black, 100},
+		{alphaStraight, white, 227},
+		// 200 + background*(127/255), clipped to white
+		{alphaPremultiplied, black, 200},
+		{alphaPremultiplied, white, 255},
+	}
+	for _, tt := range tests {
+		flat := flattenAlpha(img, tt.background, tt.alpha)
+		got := color.RGBAModel.Convert(flat.At(3, 3)).(color.RGBA)
+		if diff := int(got.R) - int(tt.want); diff < -1 || diff > 1 || got.R != got.G || got.G != got.B || got.A != 255 {
+			t.Errorf("%s over %v: got %v, want gray %d", tt.alpha, tt.background, got, tt.want)
+		}
+	}
+}
+
+func TestFlattenAlphaOpaque(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []uint8{10, 20, 30, 255})
+	}
+	for _, alpha := range []string{alphaStraight, alphaPremultiplied} {
+		if flat := flattenAlpha(img, color.RGBA{255, 0, 0, 255}, alpha); flat != image.Image(img) {
+			t.Errorf("%s: opaque image was flattened into a %T", alpha, flat)
+		}
+	}
+}
+
+func TestThresholdAlphaModes(t *testing.T) {
+	// Over black the fixture straddles threshold 150 depending on the mode
+	img := semiTransparentPNG(t)
+	for alpha, wantForeground := range map[string]bool{alphaStraight: false, alphaPremultiplied: true} {
+		params := defaultSegmentParams()
+		params.Alpha = alpha
+		params.Background = color.RGBA{0, 0, 0, 255}
+		params.Threshold = 150
+
+		processed, err := preprocessImage(img, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mask, err := foregroundMask(context.Background(), processed, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, fg := range mask {
+			if fg != wantForeground {
+				t.Fatalf("%s: pixel %d foreground %v, want %v", alpha, i, fg, wantForeground)
+			}
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+)
+
+// Behaviors for images more elongated than MAX_ASPECT_RATIO
+const (
+	aspectWarn   = "warn"
+	aspectReject = "reject"
+)
+
+// errExtremeAspectRatio is returned for an image more elongated than the
+// configured maximum under aspectReject
+var errExtremeAspectRatio = errors.New("extreme aspect ratio")
+
+// aspectRatio returns the ratio of the longer side of bounds to the shorter
+func aspectRatio(bounds image.Rectangle) float64 {
+	long, short := max(bounds.Dx(), bounds.Dy()), min(bounds.Dx(), bounds.Dy())
+	if short == 0 {
+		return 0
+	}
+	return float64(long) / float64(short)
+}
+
+// checkAspectRatio reports an image more elongated than MAX_ASPECT_RATIO,
+// or returns nil when the ratio is within it or unlimited
+func checkAspectRatio(bounds image.Rectangle) error {
+	if config.MaxAspectRatio == 0 || aspectRatio(bounds) <= config.MaxAspectRatio {
+		return nil
+	}
+	return fmt.Errorf("%w: %dx%d is more elongated than %g:1",
+		errExtremeAspectRatio, bounds.Dx(), bounds.Dy(), config.MaxAspectRatio)
+}
+
+// fitWindow shrinks a square window of odd side to the largest odd side
+// that fits within the shorter side of bounds. A window spanning the whole
+// of one dimension would average along the other one only, which is not
+// what a local statistic is meant to measure.
+func fitWindow(window int, bounds image.Rectangle) int {
+	short := min(bounds.Dx(), bounds.Dy())
+	if window <= short {
+		return window
+	}
+	return max(1, short-(1-short%2))
+}
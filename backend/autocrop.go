@@ -0,0 +1,48 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// autoCropBounds returns the smallest rectangle, relative to the image
+// origin, holding every pixel of img that is not background. Background is
+// fully transparent when the top-left pixel is, and the exact color of the
+// top-left pixel otherwise. It returns false when the whole image is
+// background.
+func autoCropBounds(img image.Image) (image.Rectangle, bool) {
+	bounds := img.Bounds()
+	corner := color.RGBA64Model.Convert(img.At(bounds.Min.X, bounds.Min.Y)).(color.RGBA64)
+	background := func(c color.RGBA64) bool {
+		if corner.A == 0 {
+			return c.A == 0
+		}
+		return c == corner
+	}
+
+	found := image.Rectangle{}
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			c := color.RGBA64Model.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.RGBA64)
+			if !background(c) {
+				found = found.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return found, !found.Empty()
+}
+
+// autoCropImage trims the background borders of a segmented image for
+// autocrop, recording the kept rectangle in result
+func autoCropImage(img image.Image, result *Result) (image.Image, error) {
+	rect, ok := autoCropBounds(img)
+	if !ok {
+		result.warn("autocrop found only background; the output was not cropped")
+		return img, nil
+	}
+	result.AutoCrop = &BoundingBox{X: rect.Min.X, Y: rect.Min.Y, Width: rect.Dx(), Height: rect.Dy()}
+	if rect == image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()) {
+		return img, nil
+	}
+	return cropImage(img, rect)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+)
+
+// backendCPU is the pure-Go backend, used unless PIXEL_BACKEND picks another
+const backendCPU = "cpu"
+
+// Backend runs the binary threshold and the rendering of masks, so that an
+// accelerated implementation (SIMD, an external service) can replace the
+// pure-Go one without changes to the modes or the handlers. Only these two
+// loops go through it: hysteresis, Sauvola and the other modes always run
+// in pure Go, and render their masks with RenderMask. Masks are row-major
+// over the bounds of the image they were computed from.
+type Backend interface {
+	// Threshold marks the pixels whose channel intensity is above the
+	// 8-bit level as foreground
+	Threshold(ctx context.Context, img image.Image, channel string, level uint8) ([]bool, error)
+
+	// RenderMask draws a mask as white foreground on a black background
+	RenderMask(bounds image.Rectangle, mask []bool) *image.RGBA
+}
+
+// backends maps PIXEL_BACKEND names to their implementations
+var backends = map[string]Backend{}
+
+// registerBackend makes a pixel-processing backend available under name
+func registerBackend(name string, b Backend) {
+	if _, ok := backends[name]; ok {
+		panic(fmt.Sprintf("backend %q registered twice", name))
+	}
+	backends[name] = b
+}
+
+// backendNames returns the registered backend names in alphabetical order
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pixelBackend returns the backend selected by the configuration
+func pixelBackend() Backend {
+	return backends[config.Backend]
+}
+
+func init() {
+	registerBackend(backendCPU, cpuBackend{})
+}
+
+// cpuBackend processes pixels one at a time through the image.Image interface
+type cpuBackend struct{}
+
+func (cpuBackend) Threshold(ctx context.Context, img image.Image, channel string, level uint8) ([]bool, error) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	mask := make([]bool, width*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// Scaled to the 16-bit gray range (128 -> 32768)
+			mask[(y-bounds.Min.Y)*width+(x-bounds.Min.X)] = intensity(img.At(x, y), channel) > uint32(level)<<8
+		}
+	}
+
+	return mask, nil
+}
+
+func (cpuBackend) RenderMask(bounds image.Rectangle, mask []bool) *image.RGBA {
+	width := bounds.Dx()
+	out := image.NewRGBA(bounds)
+
+	for i, fg := range mask {
+		c := color.RGBA{0, 0, 0, 255} // Black
+		if fg {
+			c = color.RGBA{255, 255, 255, 255} // White
+		}
+		out.SetRGBA(bounds.Min.X+i%width, bounds.Min.Y+i/width, c)
+	}
+
+	return out
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// gradientRGBA is a 4x2 image offset from the origin whose red channel
+// rises along x and whose blue channel is the opposite
+func gradientRGBA() *image.RGBA {
+	img := image.NewRGBA(image.Rect(10, 20, 14, 22))
+	for y := 20; y < 22; y++ {
+		for x := 10; x < 14; x++ {
+			v := uint8((x - 10) * 85)
+			img.SetRGBA(x, y, color.RGBA{v, 0, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+func TestCPUBackendThreshold(t *testing.T) {
+	img := gradientRGBA()
+	for _, tc := range []struct {
+		channel string
+		level   uint8
+		want    []bool
+	}{
+		{channelRed, 100, []bool{false, false, true, true}},
+		{channelBlue, 100, []bool{true, true, false, false}},
+		// 8-bit pixels equal to the level are above it on the 16-bit scale
+		{channelRed, 170, []bool{false, false, true, true}},
+		{channelRed, 171, []bool{false, false, false, true}},
+		// Luma is (r + 0 + 255 - r) / 3 = 85 everywhere
+		{channelLuma, 85, []bool{true, true, true, true}},
+		{channelLuma, 86, []bool{false, false, false, false}},
+	} {
+		mask, err := cpuBackend{}.Threshold(context.Background(), img, tc.channel, tc.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mask) != 8 {
+			t.Fatalf("%s > %d: mask has %d pixels, want 8", tc.channel, tc.level, len(mask))
+		}
+		for i, fg := range mask {
+			if fg != tc.want[i%4] {
+				t.Errorf("%s > %d: pixel %d is %v, want %v", tc.channel, tc.level, i, fg, tc.want[i%4])
+			}
+		}
+	}
+}
+
+func TestCPUBackendThresholdGray16(t *testing.T) {
+	// 16-bit levels are compared without rounding to 8 bits
+	img := image.NewGray16(image.Rect(0, 0, 2, 1))
+	img.SetGray16(0, 0, color.Gray16{128 << 8})
+	img.SetGray16(1, 0, color.Gray16{128<<8 + 1})
+
+	mask, err := cpuBackend{}.Threshold(context.Background(), img, channelLuma, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mask[0] || !mask[1] {
+		t.Errorf("mask = %v, want [false true]", mask)
+	}
+}
+
+func TestCPUBackendThresholdCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (cpuBackend{}).Threshold(ctx, gradientRGBA(), channelLuma, 128); !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestCPUBackendRenderMask(t *testing.T) {
+	bounds := image.Rect(10, 20, 12, 21)
+	out := cpuBackend{}.RenderMask(bounds, []bool{true, false})
+	if out.Bounds() != bounds {
+		t.Fatalf("bounds = %v, want %v", out.Bounds(), bounds)
+	}
+	if c := out.RGBAAt(10, 20); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("foreground = %v, want white", c)
+	}
+	if c := out.RGBAAt(11, 20); c != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("background = %v, want black", c)
+	}
+}
+
+// TestBackendsMatchCPU checks every registered backend against the CPU one,
+// which alternative backends must reproduce exactly
+func TestBackendsMatchCPU(t *testing.T) {
+	img := benchmarkImage(64)
+	want, err := cpuBackend{}.Threshold(context.Background(), img, channelLuma, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantImage := cpuBackend{}.RenderMask(img.Bounds(), want)
+
+	for _, name := range backendNames() {
+		b := backends[name]
+		mask, err := b.Threshold(context.Background(), img, channelLuma, 128)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		for i := range want {
+			if mask[i] != want[i] {
+				t.Errorf("%s: pixel %d is %v, want %v", name, i, mask[i], want[i])
+				break
+			}
+		}
+		if got := b.RenderMask(img.Bounds(), want); string(got.Pix) != string(wantImage.Pix) {
+			t.Errorf("%s: rendered mask differs from the CPU backend's", name)
+		}
+	}
+}
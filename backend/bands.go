@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+func init() {
+	registerMode(modeBands, "Each intensity band between cutoffs painted in its own color", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		return bandSegment(ctx, img, params.Channel, params.Cutoffs)
+	}))
+}
+
+// bandSegment maps each intensity band delimited by the ascending cutoffs to
+// its own color. Band i holds intensities in [cutoffs[i-1], cutoffs[i]),
+// and is palette index i of the output when there are at most 256 bands.
+func bandSegment(ctx context.Context, img image.Image, channel string, cutoffs []uint8) (image.Image, error) {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	bands := make([]int, width*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			level := uint8(intensity(img.At(x, y), channel) >> 8)
+			band := sort.Search(len(cutoffs), func(i int) bool { return cutoffs[i] > level })
+			bands[(y-bounds.Min.Y)*width+(x-bounds.Min.X)] = band
+		}
+	}
+
+	return labelImage(bounds, bands, bandPalette(len(cutoffs)+1)), nil
+}
+
+// bandPalette returns n distinct colors with hues spread evenly from blue
+// (lowest band) to red (highest band)
+func bandPalette(n int) []color.RGBA {
+	palette := make([]color.RGBA, n)
+	for i := range palette {
+		hue := 240.0
+		if n > 1 {
+			hue = 240 * (1 - float64(i)/float64(n-1))
+		}
+		palette[i] = hsvToRGB(hue, 1, 1)
+	}
+	return palette
+}
+
+// hsvToRGB converts a hue in degrees and saturation and value in [0, 1]
+func hsvToRGB(h float64, s float64, v float64) color.RGBA {
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+
+	return color.RGBA{
+		uint8(math.Round((r + m) * 255)),
+		uint8(math.Round((g + m) * 255)),
+		uint8(math.Round((b + m) * 255)),
+		255,
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/rand"
+	"testing"
+)
+
+// benchmarkImage returns a size x size test image with a diagonal gradient
+func benchmarkImage(size int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			v := uint8((x + y) * 255 / (2 * size))
+			img.SetRGBA(x, y, color.RGBA{v, uint8(x), uint8(y), 255})
+		}
+	}
+	return img
+}
+
+func encodedImage(b *testing.B, img image.Image, path string) []byte {
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, path, encodeOptions{}); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func benchmarkDecode(b *testing.B, path string) {
+	data := encodedImage(b, benchmarkImage(1024), path)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeImage(bytes.NewReader(data), path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePNG(b *testing.B)  { benchmarkDecode(b, "bench.png") }
+func BenchmarkDecodeJPEG(b *testing.B) { benchmarkDecode(b, "bench.jpg") }
+func BenchmarkDecodeGIF(b *testing.B)  { benchmarkDecode(b, "bench.gif") }
+
+func BenchmarkPreprocess(b *testing.B) {
+	img := benchmarkImage(1024)
+	params := defaultSegmentParams()
+	params.Rotate = 90
+	params.Crop = &image.Rectangle{Max: image.Pt(512, 512)}
+
+	for i := 0; i < b.N; i++ {
+		if _, err := preprocessImage(img, params); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkSegment(b *testing.B, img image.Image, params SegmentParams) {
+	for i := 0; i < b.N; i++ {
+		thresholdImage(context.Background(), img, params)
+	}
+}
+
+func BenchmarkSegmentRGBA(b *testing.B) {
+	benchmarkSegment(b, benchmarkImage(1024), defaultSegmentParams())
+}
+
+func BenchmarkSegmentYCbCr(b *testing.B) {
+	// JPEG inputs decode to YCbCr, which takes a slower conversion path
+	data := encodedImage(b, benchmarkImage(1024), "bench.jpg")
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	benchmarkSegment(b, img, defaultSegmentParams())
+}
+
+func BenchmarkSegmentHysteresis(b *testing.B) {
+	params := defaultSegmentParams()
+	params.Hysteresis, params.Low, params.High = true, 100, 160
+	benchmarkSegment(b, benchmarkImage(1024), params)
+}
+
+func BenchmarkTraceContours(b *testing.B) {
+	img := benchmarkImage(1024)
+	mask, _ := foregroundMask(context.Background(), img, defaultSegmentParams())
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		traceContours(context.Background(), mask, img.Bounds(), 1, 8)
+	}
+}
+
+// BenchmarkKMeans compares k-means with increasing worker counts on a
+// large image with K=8
+func BenchmarkKMeans(b *testing.B) {
+	pixels := imagePixels(benchmarkImage(2048))
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				kmeansCluster(context.Background(), pixels, 8, workers, rand.New(rand.NewSource(1)))
+			}
+		})
+	}
+}
+
+func benchmarkEncode(b *testing.B, path string) {
+	mask, _ := thresholdImage(context.Background(), benchmarkImage(1024), defaultSegmentParams())
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, mask, path, encodeOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncodePNG(b *testing.B)  { benchmarkEncode(b, "bench.png") }
+func BenchmarkEncodeJPEG(b *testing.B) { benchmarkEncode(b, "bench.jpg") }
+func BenchmarkEncodeGIF(b *testing.B)  { benchmarkEncode(b, "bench.gif") }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// errSizeMismatch is returned when two images that must line up pixel for
+// pixel have different dimensions
+var errSizeMismatch = errors.New("image dimensions do not match")
+
+// The reference goes through the same preprocessing as the image so that
+// the two line up
+func init() {
+	registerMode(modeBgSubtract, "Black and white mask of the pixels differing from a background image", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		reference, err := preprocessImage(params.Reference, params)
+		if err != nil {
+			return nil, err
+		}
+		if params.ROI != nil {
+			if reference, err = cropROI(reference, *params.ROI); err != nil {
+				return nil, fmt.Errorf("background %w", err)
+			}
+		}
+		mask, err := differenceMask(ctx, img, reference, params.Channel, params.DiffThreshold)
+		if err != nil {
+			return nil, err
+		}
+		despeckle(mask, img.Bounds().Dx(), img.Bounds().Dy(), params.Despeckle, params.Connectivity)
+		return maskImage(img.Bounds(), mask), nil
+	}))
+}
+
+// differenceMask marks as foreground the pixels whose selected channel
+// differs from the reference background by more than threshold
+func differenceMask(ctx context.Context, img image.Image, reference image.Image, channel string, threshold uint8) ([]bool, error) {
+	bounds, refBounds := img.Bounds(), reference.Bounds()
+	if bounds.Size() != refBounds.Size() {
+		return nil, fmt.Errorf("%w: image is %dx%d, background is %dx%d",
+			errSizeMismatch, bounds.Dx(), bounds.Dy(), refBounds.Dx(), refBounds.Dy())
+	}
+
+	width := bounds.Dx()
+	offset := refBounds.Min.Sub(bounds.Min)
+	mask := make([]bool, width*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			a := int(intensity(img.At(x, y), channel) >> 8)
+			b := int(intensity(reference.At(x+offset.X, y+offset.Y), channel) >> 8)
+			diff := a - b
+			if diff < 0 {
+				diff = -diff
+			}
+			mask[(y-bounds.Min.Y)*width+(x-bounds.Min.X)] = diff > int(threshold)
+		}
+	}
+
+	return mask, nil
+}
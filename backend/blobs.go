@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+// blobMarker is the color blob outlines are drawn in
+var blobMarker = color.RGBA{255, 0, 0, 255}
+
+// Blob is a bright blob found by Laplacian-of-Gaussian detection
+type Blob struct {
+	X      int     `json:"x"`
+	Y      int     `json:"y"`
+	Radius float64 `json:"radius"`
+}
+
+// gaussianKernels returns the sampled 1-D Gaussian of the given sigma and
+// its second derivative, both covering three standard deviations
+func gaussianKernels(sigma float64) ([]float64, []float64) {
+	radius := int(math.Ceil(3 * sigma))
+	g := make([]float64, 2*radius+1)
+	g2 := make([]float64, 2*radius+1)
+
+	sum := 0.0
+	for i := range g {
+		x := float64(i - radius)
+		g[i] = math.Exp(-x * x / (2 * sigma * sigma))
+		sum += g[i]
+	}
+	for i := range g {
+		x := float64(i - radius)
+		g[i] /= sum
+		g2[i] = g[i] * (x*x - sigma*sigma) / (sigma * sigma * sigma * sigma)
+	}
+
+	// The second derivative must not respond to a constant image
+	mean := 0.0
+	for _, v := range g2 {
+		mean += v
+	}
+	mean /= float64(len(g2))
+	for i := range g2 {
+		g2[i] -= mean
+	}
+
+	return g, g2
+}
+
+// convolve1D convolves a row-major grid with kernel along x (horizontal) or
+// y, repeating the edge values past the border
+func convolve1D(src []float64, width int, height int, kernel []float64, horizontal bool) []float64 {
+	radius := len(kernel) / 2
+	dst := make([]float64, len(src))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			sum := 0.0
+			for k, w := range kernel {
+				if horizontal {
+					sum += w * src[y*width+clampInt(x+k-radius, 0, width-1)]
+				} else {
+					sum += w * src[clampInt(y+k-radius, 0, height-1)*width+x]
+				}
+			}
+			dst[y*width+x] = sum
+		}
+	}
+
+	return dst
+}
+
+// laplacianOfGaussian returns the scale-normalized response sigma^2 * LoG
+// of the selected channel, computed as the sum of the separable second
+// derivatives along x and y
+func laplacianOfGaussian(ctx context.Context, img image.Image, channel string, sigma float64) ([]float64, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	levels := grayLevels(img, channel)
+	values := make([]float64, len(levels))
+	for i, v := range levels {
+		values[i] = float64(v)
+	}
+
+	g, g2 := gaussianKernels(sigma)
+	xx := convolve1D(convolve1D(values, width, height, g2, true), width, height, g, false)
+	if err := canceled(ctx); err != nil {
+		return nil, err
+	}
+	yy := convolve1D(convolve1D(values, width, height, g, true), width, height, g2, false)
+	if err := canceled(ctx); err != nil {
+		return nil, err
+	}
+
+	response := make([]float64, len(values))
+	for i := range response {
+		response[i] = sigma * sigma * (xx[i] + yy[i])
+	}
+	return response, nil
+}
+
+func init() {
+	registerMode(modeBlobs, "The image with a circle around each bright blob found by Laplacian-of-Gaussian detection", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		blobs, err := detectBlobs(ctx, img, params.Channel, params.Sigma, params.BlobThreshold)
+		if err != nil {
+			return nil, err
+		}
+		count := len(blobs)
+		result.BlobCount, result.Blobs = &count, blobs
+		return markBlobs(img, blobs), nil
+	}))
+}
+
+// detectBlobs finds bright blobs of radius about sigma*sqrt(2) as the local
+// minima of the LoG response below -threshold
+func detectBlobs(ctx context.Context, img image.Image, channel string, sigma float64, threshold float64) ([]Blob, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	response, err := laplacianOfGaussian(ctx, img, channel, sigma)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []Blob
+	for y := 0; y < height; y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		for x := 0; x < width; x++ {
+			v := response[y*width+x]
+			if v >= -threshold {
+				continue
+			}
+
+			// Plateaus keep only their first pixel in raster order
+			extremum := true
+			for i, d := range mooreNeighbors {
+				nx, ny := x+d.X, y+d.Y
+				if nx < 0 || ny < 0 || nx >= width || ny >= height {
+					continue
+				}
+				n := response[ny*width+nx]
+				earlier := i < 4 // west, north-west, north and north-east
+				if n < v || (earlier && n == v) {
+					extremum = false
+					break
+				}
+			}
+			if extremum {
+				blobs = append(blobs, Blob{X: bounds.Min.X + x, Y: bounds.Min.Y + y, Radius: sigma * math.Sqrt2})
+			}
+		}
+	}
+
+	return blobs, nil
+}
+
+// markBlobs draws a circle around every blob on a copy of img
+func markBlobs(img image.Image, blobs []Blob) *image.RGBA {
+	bounds := img.Bounds()
+	marked := image.NewRGBA(bounds)
+	draw.Draw(marked, bounds, img, bounds.Min, draw.Src)
+
+	for _, b := range blobs {
+		marked.SetRGBA(b.X, b.Y, blobMarker)
+		steps := int(math.Ceil(2 * math.Pi * b.Radius * 2))
+		for i := 0; i < steps; i++ {
+			angle := 2 * math.Pi * float64(i) / float64(steps)
+			x := b.X + int(math.Round(b.Radius*math.Cos(angle)))
+			y := b.Y + int(math.Round(b.Radius*math.Sin(angle)))
+			if image.Pt(x, y).In(bounds) {
+				marked.SetRGBA(x, y, blobMarker)
+			}
+		}
+	}
+
+	return marked
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errTooManyCallbackJobs is returned when CALLBACK_MAX_PENDING callback
+// jobs are already waiting to be delivered
+var errTooManyCallbackJobs = errors.New("too many pending callback jobs")
+
+// pendingCallbackJobs counts the callback jobs accepted and not yet
+// delivered or abandoned
+var pendingCallbackJobs atomic.Int64
+
+// Job states reported in the Segmentation-Status header of a callback
+const (
+	callbackDone   = "done"
+	callbackFailed = "failed"
+)
+
+// callbackTimeout bounds one delivery attempt of a callback
+const callbackTimeout = 10 * time.Second
+
+// callbackBackoff is the wait before the second attempt of a callback,
+// doubled for every attempt after it
+var callbackBackoff = time.Second
+
+// callbackClient sends callbacks. It never follows redirects, which could
+// lead a callback away from the allowed hosts.
+var callbackClient = &http.Client{
+	Timeout: callbackTimeout,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// callbackJob is the response to a segmentation submitted with a
+// callback_url
+type callbackJob struct {
+	JobID       string `json:"job_id"`
+	CallbackURL string `json:"callback_url"`
+	Message     string `json:"message"`
+}
+
+// checkCallbackURL makes sure a callback_url is an http or https URL whose
+// host is in CALLBACK_ALLOWED_HOSTS, so that clients cannot make the server
+// send requests into its own network
+func checkCallbackURL(v string) error {
+	if len(config.CallbackAllowedHosts) == 0 || config.CallbackSecret == "" {
+		return fieldError("callback_url", v, "callbacks are not enabled on this server")
+	}
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return fieldError("callback_url", v, "expected an http or https URL without credentials")
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range config.CallbackAllowedHosts {
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+	return fieldError("callback_url", v, "host not allowed")
+}
+
+// signCallback returns the Segmentation-Signature of a callback body sent
+// at timestamp: the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with
+// CALLBACK_SECRET
+func signCallback(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.CallbackSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// submitCallbackJob answers a segmentation with a callback_url with 202
+// Accepted and runs it in the background, the upload being read into
+// memory first since the request's files go away with it. It returns the
+// accepted job, or false after answering with an error.
+func submitCallbackJob(w http.ResponseWriter, r *http.Request, file io.Reader, filename string, params SegmentParams, opts uploadOptions) (callbackJob, bool) {
+	if pendingCallbackJobs.Add(1) > int64(config.CallbackMaxPending) {
+		pendingCallbackJobs.Add(-1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(callbackTimeout/time.Second)))
+		writeError(w, r, codeTooManyJobs, fmt.Sprintf("Server busy: %v (max %d)", errTooManyCallbackJobs, config.CallbackMaxPending))
+		return callbackJob{}, false
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		pendingCallbackJobs.Add(-1)
+		writeError(w, r, codeInternal, "Error reading upload: "+err.Error())
+		return callbackJob{}, false
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		pendingCallbackJobs.Add(-1)
+		writeError(w, r, codeInternal, "Error creating job: "+err.Error())
+		return callbackJob{}, false
+	}
+	job := callbackJob{
+		JobID:       hex.EncodeToString(id[:]),
+		CallbackURL: opts.CallbackURL,
+		Message:     "Image accepted; the result will be sent to the callback URL",
+	}
+
+	// The job outlives the request, so it is not canceled with it
+	jobRequest := r.Clone(context.WithoutCancel(r.Context()))
+	opts.CallbackURL = ""
+	go func() {
+		defer pendingCallbackJobs.Add(-1)
+		runCallbackJob(jobRequest, job, data, filename, params, opts)
+	}()
+
+	writeAcceptedJob(w, r, job)
+	return job, true
+}
+
+// writeAcceptedJob answers a request with the job it was accepted as
+func writeAcceptedJob(w http.ResponseWriter, r *http.Request, job callbackJob) {
+	writeJSONStatus(w, r, http.StatusAccepted, job)
+}
+
+// runCallbackJob segments an upload once a worker is free and sends the
+// result, or the error response the request would have got, to the
+// callback URL
+func runCallbackJob(r *http.Request, job callbackJob, data []byte, filename string, params SegmentParams, opts uploadOptions) {
+	rec := newErrorRecorder()
+	status, body := callbackFailed, []byte(nil)
+
+	release, err := segmentQueue.acquire(r.Context(), config.QueueTimeout)
+	if err != nil {
+		writeError(rec, r, errorCodeOf(err, codeInternal), "Server busy: "+err.Error())
+	} else {
+		result, ok := storeAndSegment(rec, r, bytes.NewReader(data), int64(len(data)), filename, params, opts)
+		release()
+		if ok {
+			status = callbackDone
+			if body, err = marshalJSON(result, responseCase(r)); err != nil {
+				writeError(rec, r, codeInternal, "Error encoding response")
+				status = callbackFailed
+			}
+		}
+	}
+	if status == callbackFailed {
+		body = bytes.TrimSpace(rec.body.Bytes())
+	}
+
+	if err := deliverCallback(job, status, body); err != nil {
+		fmt.Printf("Error sending callback of job %s to %s: %s\n", job.JobID, job.CallbackURL, err)
+	}
+}
+
+// deliverCallback POSTs a job's outcome to its callback URL, retrying with
+// exponential backoff after network errors, 429 and 5xx answers up to
+// CALLBACK_ATTEMPTS times. Other answers are final.
+func deliverCallback(job callbackJob, status string, body []byte) error {
+	wait := callbackBackoff
+	var err error
+	for attempt := 1; attempt <= config.CallbackAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+
+		var retry bool
+		if retry, err = sendCallback(job, status, body); err == nil || !retry {
+			return err
+		}
+		debugf("callback of job %s, attempt %d: %s", job.JobID, attempt, err)
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", config.CallbackAttempts, err)
+}
+
+// sendCallback makes one attempt at delivering a callback and reports
+// whether a failure is worth retrying
+func sendCallback(job callbackJob, status string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, job.CallbackURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Remote-Image-Segmentation")
+	req.Header.Set("Segmentation-Job", job.JobID)
+	req.Header.Set("Segmentation-Status", status)
+	req.Header.Set("Segmentation-Timestamp", timestamp)
+	req.Header.Set("Segmentation-Signature", signCallback(timestamp, body))
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("callback answered %s", resp.Status)
+	}
+	return false, fmt.Errorf("callback answered %s", resp.Status)
+}
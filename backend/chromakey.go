@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+)
+
+func init() {
+	registerMode(modeChromaKey, "The image with the pixels close to a key color made transparent, for green screen removal", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		return chromaKey(ctx, img, params.KeyColor, params.KeyTolerance, params.SpillSuppression)
+	}))
+}
+
+// chromaKey makes the pixels within tolerance of key, in 8-bit RGB
+// distance, fully transparent and keeps the others opaque. With
+// suppressSpill, kept pixels within twice the tolerance, typically the edges
+// of the subject lit by the screen, have the dominant channel of the key
+// clamped to the larger of their other two channels to remove the color
+// fringe.
+func chromaKey(ctx context.Context, img image.Image, key color.RGBA, tolerance float64, suppressSpill bool) (*image.NRGBA, error) {
+	bounds := img.Bounds()
+	target := [3]float64{float64(key.R), float64(key.G), float64(key.B)}
+	keyed, spill := tolerance*tolerance, 4*tolerance*tolerance
+	dominant := dominantChannel(key)
+
+	out := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			pixel := [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+			d := colorDistSq(pixel, target)
+			if d <= keyed {
+				out.SetNRGBA(x, y, color.NRGBA{})
+				continue
+			}
+			if suppressSpill && dominant >= 0 && d <= spill {
+				channels := [3]*uint8{&c.R, &c.G, &c.B}
+				limit := uint8(0)
+				for i, v := range channels {
+					if i != dominant && *v > limit {
+						limit = *v
+					}
+				}
+				*channels[dominant] = min(*channels[dominant], limit)
+			}
+			c.A = 255
+			out.SetNRGBA(x, y, c)
+		}
+	}
+	return out, nil
+}
+
+// dominantChannel returns the index of the red, green or blue component
+// of c that is strictly larger than the other two, or -1 when there is
+// none, as for a gray key that has no spill to suppress
+func dominantChannel(c color.RGBA) int {
+	v := [3]uint8{c.R, c.G, c.B}
+	for i := range v {
+		if v[i] > v[(i+1)%3] && v[i] > v[(i+2)%3] {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server-wide settings read from the environment
+type Config struct {
+	// KeepOriginals is the default for the keep_original upload option
+	KeepOriginals bool
+
+	// OutputPolicy is the default policy for outputs whose name is taken
+	OutputPolicy string
+
+	// OutputTemplate names segmented outputs, see outputName
+	OutputTemplate string
+
+	// UnsupportedOutputPolicy is what happens to an output name without a
+	// supported image extension, "png" or "error"
+	UnsupportedOutputPolicy string
+
+	// ForceOutputFormat is the format every segmented image is encoded in,
+	// whatever the request and the output name ask for, or empty to let
+	// them choose
+	ForceOutputFormat string
+
+	// UploadsMaxBytes caps the bytes stored in the uploads directory, or 0
+	// for no cap
+	UploadsMaxBytes int64
+
+	// UploadsFullPolicy is what happens to an upload that would exceed the
+	// cap, "reject" or "evict"
+	UploadsFullPolicy string
+
+	// MinFreeBytes is the free disk space an upload must leave in the
+	// uploads directory, or 0 to skip the check
+	MinFreeBytes int64
+
+	// MaxFormParts is the most parts a multipart upload may have
+	MaxFormParts int
+
+	// MaxFieldBytes is the largest accepted non-file multipart field
+	MaxFieldBytes int64
+
+	// IdempotencyTTL is how long results are kept for Idempotency-Key replays
+	IdempotencyTTL time.Duration
+
+	// MaxTrackedUploads caps the uploads whose progress is tracked at once
+	// through Upload-ID, or 0 for no cap
+	MaxTrackedUploads int
+
+	// ProgressRetention is how long a finished upload stays queryable on
+	// the progress endpoint
+	ProgressRetention time.Duration
+
+	// MinImageDimension is the smallest accepted width and height in pixels
+	MinImageDimension int
+
+	// MaxAspectRatio is the most elongated image, as the ratio of its long
+	// side to its short side, segmented without AspectRatioPolicy applying,
+	// or 0 for no limit
+	MaxAspectRatio float64
+
+	// AspectRatioPolicy is what happens to a more elongated image,
+	// "warn" or "reject"
+	AspectRatioPolicy string
+
+	// KMeansWorkers is the number of goroutines sharing the k-means
+	// assignment step
+	KMeansWorkers int
+
+	// KMeansMinClusterPixels is the fewest pixels per cluster the k of a
+	// kmeans request may leave, or 0 for no limit
+	KMeansMinClusterPixels int
+
+	// SegmentWorkers is the number of requests the segmentation endpoints
+	// process at once, and QueueTimeout how long the others wait for one
+	// of them before they are rejected
+	SegmentWorkers int
+	QueueTimeout   time.Duration
+
+	// SegmentTimeout is the hard deadline after which the watchdog aborts a
+	// segmentation
+	SegmentTimeout time.Duration
+
+	// JSONCase is the default field casing of JSON responses, "snake" or "camel"
+	JSONCase string
+
+	// LogLevel is either "info" or "debug"
+	LogLevel string
+
+	// CORSOrigins are the origins allowed to call the API from a browser,
+	// "*" allowing any
+	CORSOrigins []string
+
+	// CORSCredentials lets browsers send cookies and HTTP authentication
+	// to the API, which requires concrete CORSOrigins
+	CORSCredentials bool
+
+	// CompressResponses gzips JSON and SVG responses for clients accepting it
+	CompressResponses bool
+
+	// AdminToken is the bearer token admin endpoints require, or empty to
+	// disable them
+	AdminToken string
+
+	// DefaultMode is the segmentation mode of requests that do not set one
+	DefaultMode string
+
+	// Backend names the implementation of the binary threshold and of mask
+	// rendering, see Backend
+	Backend string
+
+	// ReprocessInterval is the pause between two images of a reprocessing
+	// batch
+	ReprocessInterval time.Duration
+
+	// CallbackAllowedHosts are the hosts a callback_url may point to, a
+	// leading "*." matching any subdomain. Callbacks are disabled when empty.
+	CallbackAllowedHosts []string
+
+	// CallbackSecret is the key callbacks are signed with. Callbacks are
+	// disabled when empty.
+	CallbackSecret string
+
+	// CallbackAttempts is the most times a callback is sent before giving up
+	CallbackAttempts int
+
+	// CallbackMaxPending bounds the callback jobs accepted but not yet
+	// delivered, each holding its upload in memory
+	CallbackMaxPending int
+
+	// ResumableMaxUploads bounds the unfinished resumable uploads, each
+	// holding a temporary file and its declared length of the quota
+	ResumableMaxUploads int
+
+	// ResumableMaxPerClient bounds the unfinished resumable uploads of a
+	// single client IP address
+	ResumableMaxPerClient int
+
+	// ReadOnlyUploads is what happens when the uploads or results
+	// directory cannot be written at startup, "fail" or "transform"
+	ReadOnlyUploads string
+}
+
+var config = Config{
+	KeepOriginals:           true,
+	OutputPolicy:            policyOverwrite,
+	OutputTemplate:          defaultOutputTemplate,
+	UnsupportedOutputPolicy: unsupportedToPNG,
+	UploadsFullPolicy:       quotaReject,
+	MinFreeBytes:            64 << 20,
+	MaxFormParts:            32,
+	MaxFieldBytes:           4 << 10,
+	IdempotencyTTL:          24 * time.Hour,
+	MaxTrackedUploads:       10000,
+	ProgressRetention:       time.Minute,
+	MinImageDimension:       8,
+	MaxAspectRatio:          20,
+	AspectRatioPolicy:       aspectWarn,
+	KMeansWorkers:           runtime.NumCPU(),
+	KMeansMinClusterPixels:  16,
+	SegmentWorkers:          runtime.NumCPU(),
+	QueueTimeout:            30 * time.Second,
+	SegmentTimeout:          time.Minute,
+	JSONCase:                caseSnake,
+	LogLevel:                logLevelInfo,
+	CORSOrigins:             []string{"*"},
+	CompressResponses:       true,
+	ReprocessInterval:       500 * time.Millisecond,
+	CallbackAttempts:        5,
+	CallbackMaxPending:      32,
+	ResumableMaxUploads:     64,
+	ResumableMaxPerClient:   8,
+	ReadOnlyUploads:         readOnlyFail,
+	DefaultMode:             modeBinary,
+	Backend:                 backendCPU,
+}
+
+// loadConfig reads the server configuration from environment variables,
+// completed by those of the .env file
+func loadConfig() error {
+	if err := loadEnvFile(); err != nil {
+		return fmt.Errorf("reading env file: %v", err)
+	}
+
+	if v := os.Getenv("KEEP_ORIGINALS"); v != "" {
+		keep, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid KEEP_ORIGINALS value %q", v)
+		}
+		config.KeepOriginals = keep
+	}
+
+	if v := os.Getenv("OUTPUT_POLICY"); v != "" {
+		if !validOutputPolicy(v) {
+			return fmt.Errorf("invalid OUTPUT_POLICY value %q", v)
+		}
+		config.OutputPolicy = v
+	}
+
+	if v := os.Getenv("OUTPUT_NAME_TEMPLATE"); v != "" {
+		if err := validOutputTemplate(v); err != nil {
+			return fmt.Errorf("invalid OUTPUT_NAME_TEMPLATE: %v", err)
+		}
+		config.OutputTemplate = v
+	}
+
+	switch v := os.Getenv("UNSUPPORTED_OUTPUT_POLICY"); v {
+	case "":
+	case unsupportedToPNG, unsupportedReject:
+		config.UnsupportedOutputPolicy = v
+	default:
+		return fmt.Errorf("invalid UNSUPPORTED_OUTPUT_POLICY value %q", v)
+	}
+
+	if v := strings.ToLower(os.Getenv("FORCE_OUTPUT_FORMAT")); v != "" {
+		if v == "jpeg" {
+			v = "jpg"
+		}
+		if _, ok := forcedOutputFormats[v]; !ok {
+			return fmt.Errorf("invalid FORCE_OUTPUT_FORMAT value %q (expected png, jpg, gif, pbm, pgm or ppm)", v)
+		}
+		config.ForceOutputFormat = v
+	}
+
+	if v := os.Getenv("UPLOADS_MAX_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid UPLOADS_MAX_BYTES value %q", v)
+		}
+		config.UploadsMaxBytes = n
+	}
+
+	switch v := os.Getenv("UPLOADS_FULL_POLICY"); v {
+	case "":
+	case quotaReject, quotaEvict:
+		config.UploadsFullPolicy = v
+	default:
+		return fmt.Errorf("invalid UPLOADS_FULL_POLICY value %q", v)
+	}
+
+	if v := os.Getenv("MIN_FREE_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid MIN_FREE_BYTES value %q", v)
+		}
+		config.MinFreeBytes = n
+	}
+
+	if v := os.Getenv("MAX_FORM_PARTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid MAX_FORM_PARTS value %q", v)
+		}
+		config.MaxFormParts = n
+	}
+
+	if v := os.Getenv("MAX_FIELD_BYTES"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid MAX_FIELD_BYTES value %q", v)
+		}
+		config.MaxFieldBytes = n
+	}
+
+	if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid IDEMPOTENCY_TTL value %q", v)
+		}
+		config.IdempotencyTTL = ttl
+	}
+
+	if v := os.Getenv("MAX_TRACKED_UPLOADS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid MAX_TRACKED_UPLOADS value %q", v)
+		}
+		config.MaxTrackedUploads = n
+	}
+
+	if v := os.Getenv("PROGRESS_RETENTION"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid PROGRESS_RETENTION value %q", v)
+		}
+		config.ProgressRetention = d
+	}
+
+	if v := os.Getenv("MIN_IMAGE_DIMENSION"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid MIN_IMAGE_DIMENSION value %q", v)
+		}
+		config.MinImageDimension = n
+	}
+
+	if v := os.Getenv("MAX_ASPECT_RATIO"); v != "" {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(ratio == 0 || ratio >= 1) || math.IsInf(ratio, 0) {
+			return fmt.Errorf("invalid MAX_ASPECT_RATIO value %q", v)
+		}
+		config.MaxAspectRatio = ratio
+	}
+
+	switch v := os.Getenv("ASPECT_RATIO_POLICY"); v {
+	case "":
+	case aspectWarn, aspectReject:
+		config.AspectRatioPolicy = v
+	default:
+		return fmt.Errorf("invalid ASPECT_RATIO_POLICY value %q", v)
+	}
+
+	if v := os.Getenv("KMEANS_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid KMEANS_WORKERS value %q", v)
+		}
+		config.KMeansWorkers = n
+	}
+
+	if v := os.Getenv("KMEANS_MIN_CLUSTER_PIXELS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid KMEANS_MIN_CLUSTER_PIXELS value %q", v)
+		}
+		config.KMeansMinClusterPixels = n
+	}
+
+	if v := os.Getenv("SEGMENT_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid SEGMENT_WORKERS value %q", v)
+		}
+		config.SegmentWorkers = n
+	}
+
+	if v := os.Getenv("QUEUE_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid QUEUE_TIMEOUT value %q", v)
+		}
+		config.QueueTimeout = timeout
+	}
+
+	if v := os.Getenv("SEGMENT_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid SEGMENT_TIMEOUT value %q", v)
+		}
+		config.SegmentTimeout = timeout
+	}
+
+	if v := strings.ToLower(os.Getenv("DEFAULT_MODE")); v != "" {
+		if _, ok := lookupMode(v); !ok {
+			return fmt.Errorf("invalid DEFAULT_MODE value %q (expected %s)", v, strings.Join(modeNames(), ", "))
+		}
+		config.DefaultMode = v
+	}
+
+	if v := strings.ToLower(os.Getenv("PIXEL_BACKEND")); v != "" {
+		if _, ok := backends[v]; !ok {
+			return fmt.Errorf("invalid PIXEL_BACKEND value %q (expected %s)", v, strings.Join(backendNames(), ", "))
+		}
+		config.Backend = v
+	}
+
+	switch v := os.Getenv("JSON_CASE"); v {
+	case "":
+	case caseSnake, caseCamel:
+		config.JSONCase = v
+	default:
+		return fmt.Errorf("invalid JSON_CASE value %q", v)
+	}
+
+	switch v := os.Getenv("LOG_LEVEL"); v {
+	case "":
+	case logLevelInfo, logLevelDebug:
+		config.LogLevel = v
+	default:
+		return fmt.Errorf("invalid LOG_LEVEL value %q", v)
+	}
+
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" {
+		config.CORSOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+			if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+				return fmt.Errorf("invalid CORS_ALLOWED_ORIGINS origin %q (expected * or scheme://host[:port])", origin)
+			}
+			config.CORSOrigins = append(config.CORSOrigins, origin)
+		}
+	}
+
+	if v := os.Getenv("CORS_ALLOW_CREDENTIALS"); v != "" {
+		allow, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid CORS_ALLOW_CREDENTIALS value %q", v)
+		}
+		config.CORSCredentials = allow
+	}
+	if config.CORSCredentials {
+		for _, origin := range config.CORSOrigins {
+			if origin == "*" {
+				return fmt.Errorf("CORS_ALLOW_CREDENTIALS requires CORS_ALLOWED_ORIGINS to list concrete origins, not *")
+			}
+		}
+	}
+
+	if v := os.Getenv("COMPRESS_RESPONSES"); v != "" {
+		compress, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid COMPRESS_RESPONSES value %q", v)
+		}
+		config.CompressResponses = compress
+	}
+
+	config.AdminToken = os.Getenv("ADMIN_TOKEN")
+
+	if v := os.Getenv("REPROCESS_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval < 0 {
+			return fmt.Errorf("invalid REPROCESS_INTERVAL value %q", v)
+		}
+		config.ReprocessInterval = interval
+	}
+
+	if v := os.Getenv("CALLBACK_ALLOWED_HOSTS"); v != "" {
+		config.CallbackAllowedHosts = nil
+		for _, host := range strings.Split(v, ",") {
+			host = strings.ToLower(strings.TrimSpace(host))
+			if host == "" || strings.ContainsAny(strings.TrimPrefix(host, "*."), "*/:@") {
+				return fmt.Errorf("invalid CALLBACK_ALLOWED_HOSTS entry %q", host)
+			}
+			config.CallbackAllowedHosts = append(config.CallbackAllowedHosts, host)
+		}
+	}
+
+	config.CallbackSecret = os.Getenv("CALLBACK_SECRET")
+
+	if v := os.Getenv("CALLBACK_ATTEMPTS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid CALLBACK_ATTEMPTS value %q", v)
+		}
+		config.CallbackAttempts = n
+	}
+
+	if v := os.Getenv("CALLBACK_MAX_PENDING"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid CALLBACK_MAX_PENDING value %q", v)
+		}
+		config.CallbackMaxPending = n
+	}
+
+	if v := os.Getenv("RESUMABLE_MAX_UPLOADS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid RESUMABLE_MAX_UPLOADS value %q", v)
+		}
+		config.ResumableMaxUploads = n
+	}
+
+	if v := os.Getenv("RESUMABLE_MAX_PER_CLIENT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid RESUMABLE_MAX_PER_CLIENT value %q", v)
+		}
+		config.ResumableMaxPerClient = n
+	}
+
+	switch v := os.Getenv("READ_ONLY_UPLOADS"); v {
+	case "":
+	case readOnlyFail, readOnlyTransform:
+		config.ReadOnlyUploads = v
+	default:
+		return fmt.Errorf("invalid READ_ONLY_UPLOADS value %q", v)
+	}
+
+	return nil
+}
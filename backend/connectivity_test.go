@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// diagonalBridge is two 3x3 squares whose only contact is the corner
+// between (3, 3) and (4, 4), with the levels given to each square
+func diagonalBridge(first uint8, second uint8) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			switch {
+			case x >= 1 && x <= 3 && y >= 1 && y <= 3:
+				img.SetGray(x, y, color.Gray{first})
+			case x >= 4 && x <= 6 && y >= 4 && y <= 6:
+				img.SetGray(x, y, color.Gray{second})
+			}
+		}
+	}
+	return img
+}
+
+func TestConnectivityComponents(t *testing.T) {
+	img := diagonalBridge(255, 255)
+	for _, tc := range []struct {
+		connectivity int
+		components   int
+		largest      int
+	}{
+		{8, 1, 18},
+		{4, 2, 9},
+	} {
+		stats := maskStats(img, tc.connectivity)
+		if stats.Components != tc.components || stats.LargestComponent != tc.largest {
+			t.Errorf("connectivity %d: %d components, largest %d, want %d and %d",
+				tc.connectivity, stats.Components, stats.LargestComponent, tc.components, tc.largest)
+		}
+		if stats.ForegroundPixels != 18 {
+			t.Errorf("connectivity %d: %d foreground pixels, want 18", tc.connectivity, stats.ForegroundPixels)
+		}
+	}
+}
+
+func TestConnectivityContours(t *testing.T) {
+	img := diagonalBridge(255, 255)
+	mask := maskBits(img)
+
+	for connectivity, want := range map[int]int{8: 1, 4: 2} {
+		contours, err := traceContours(context.Background(), mask, img.Bounds(), 0, connectivity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(contours) != want {
+			t.Errorf("connectivity %d: %d contours, want %d", connectivity, len(contours), want)
+		}
+	}
+
+	// Under 4-connectivity each square is traced on its own
+	contours, _ := traceContours(context.Background(), mask, img.Bounds(), 0, 4)
+	for i, contour := range contours {
+		if len(contour) != 8 {
+			t.Errorf("contour %d has %d points, want the 8 border pixels of a 3x3 square: %v", i, len(contour), contour)
+		}
+	}
+}
+
+func TestConnectivityHysteresis(t *testing.T) {
+	// A strong square touching a weak square at a corner only grows into it
+	// when diagonal neighbours are connected
+	img := diagonalBridge(200, 100)
+
+	for connectivity, want := range map[int]int{8: 18, 4: 9} {
+		mask, err := hysteresisMask(context.Background(), img, channelLuma, 50, 150, connectivity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, fg := range mask {
+			if fg {
+				n++
+			}
+		}
+		if n != want {
+			t.Errorf("connectivity %d: %d foreground pixels, want %d", connectivity, n, want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"math"
+)
+
+// Point is a pixel coordinate in a contour
+type Point struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// mooreNeighbors lists the 8 neighbour offsets in clockwise order starting west
+var mooreNeighbors = [8]image.Point{
+	{-1, 0}, {-1, -1}, {0, -1}, {1, -1}, {1, 0}, {1, 1}, {0, 1}, {-1, 1},
+}
+
+// edgeNeighbors lists the 4 neighbours sharing an edge with a pixel
+var edgeNeighbors = [4]image.Point{{-1, 0}, {0, -1}, {1, 0}, {0, 1}}
+
+// neighborOffsets returns the neighbours of a pixel under 4- or
+// 8-connectivity
+func neighborOffsets(connectivity int) []image.Point {
+	if connectivity == 4 {
+		return edgeNeighbors[:]
+	}
+	return mooreNeighbors[:]
+}
+
+// neighborIndex returns the index in mooreNeighbors of the offset d
+func neighborIndex(d image.Point) int {
+	for i, n := range mooreNeighbors {
+		if n == d {
+			return i
+		}
+	}
+	return 0
+}
+
+// Contour mode returns vector boundaries instead of a raster, optionally
+// rendered as an SVG document
+func init() {
+	registerMode(modeContours, "Outer boundaries of the foreground regions as point lists, without an image", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		mask, err := foregroundMask(ctx, img, params)
+		if err != nil {
+			return nil, err
+		}
+		result.Contours, err = traceContours(ctx, mask, img.Bounds(), params.Simplify, params.Connectivity)
+		if err != nil || params.OutputFormat != outputSVG {
+			return nil, err
+		}
+
+		var buf bytes.Buffer
+		if err := writeContoursSVG(&buf, result.Contours, img.Bounds()); err != nil {
+			return nil, err
+		}
+		result.svg = buf.Bytes()
+		return nil, nil
+	}))
+}
+
+// traceContours returns the outer boundary of every foreground region in
+// mask, with regions 4- or 8-connected, using Moore neighbour tracing.
+// Boundaries are simplified with Douglas-Peucker when tolerance is
+// positive. Holes are not traced.
+func traceContours(ctx context.Context, mask []bool, bounds image.Rectangle, tolerance float64, connectivity int) ([][]Point, error) {
+	width, height := bounds.Dx(), bounds.Dy()
+	labels := make([]int, len(mask))
+	var contours [][]Point
+
+	inside := func(p image.Point) bool {
+		return p.X >= 0 && p.Y >= 0 && p.X < width && p.Y < height
+	}
+
+	label := 0
+	for i, fg := range mask {
+		if !fg || labels[i] != 0 {
+			continue
+		}
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+
+		// The first pixel of a region in raster order is always on its
+		// outer boundary, with a background pixel to its west
+		label++
+		size := fillRegion(mask, labels, width, height, i, label, connectivity)
+		start := image.Point{i % width, i / width}
+		inRegion := func(p image.Point) bool {
+			return inside(p) && labels[p.Y*width+p.X] == label
+		}
+
+		contour := []Point{{start.X + bounds.Min.X, start.Y + bounds.Min.Y}}
+		current, backtrack := start, 0
+		for steps := 0; steps < 4*size+8; steps++ {
+			found := false
+			for k := 1; k <= 8; k++ {
+				idx := (backtrack + k) % 8
+				next := current.Add(mooreNeighbors[idx])
+				if inRegion(next) {
+					// The neighbour checked just before next becomes the new backtrack
+					prev := current.Add(mooreNeighbors[(idx+7)%8])
+					backtrack = neighborIndex(prev.Sub(next))
+					current = next
+					found = true
+					break
+				}
+			}
+
+			// Stop on an isolated pixel or on re-entering the start pixel
+			// from the same direction (Jacob's stopping criterion)
+			if !found || (current == start && backtrack == 0) {
+				break
+			}
+			contour = append(contour, Point{current.X + bounds.Min.X, current.Y + bounds.Min.Y})
+		}
+
+		// The trace ends on the start pixel, which is already the first point
+		if len(contour) > 1 && contour[len(contour)-1] == contour[0] {
+			contour = contour[:len(contour)-1]
+		}
+		if tolerance > 0 {
+			contour = simplifyClosed(contour, tolerance)
+		}
+		contours = append(contours, contour)
+	}
+
+	return contours, nil
+}
+
+// fillRegion labels the 4- or 8-connected foreground region containing
+// start and returns its size in pixels
+func fillRegion(mask []bool, labels []int, width int, height int, start int, label int, connectivity int) int {
+	size := 0
+	labels[start] = label
+	stack := []int{start}
+
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		size++
+		x, y := i%width, i/width
+
+		for _, d := range neighborOffsets(connectivity) {
+			nx, ny := x+d.X, y+d.Y
+			if nx < 0 || ny < 0 || nx >= width || ny >= height {
+				continue
+			}
+			n := ny*width + nx
+			if mask[n] && labels[n] == 0 {
+				labels[n] = label
+				stack = append(stack, n)
+			}
+		}
+	}
+
+	return size
+}
+
+// simplifyClosed simplifies a closed contour with Douglas-Peucker
+func simplifyClosed(points []Point, tolerance float64) []Point {
+	if len(points) < 3 {
+		return points
+	}
+
+	// Close the ring so the last segment is simplified too, then reopen it
+	ring := append(append([]Point{}, points...), points[0])
+	simplified := douglasPeucker(ring, tolerance)
+	return simplified[:len(simplified)-1]
+}
+
+// douglasPeucker removes points that lie within tolerance of the line
+// through their neighbours, always keeping the end points
+func douglasPeucker(points []Point, tolerance float64) []Point {
+	if len(points) < 3 {
+		return points
+	}
+
+	first, last := points[0], points[len(points)-1]
+	maxDist, index := 0.0, 0
+	for i := 1; i < len(points)-1; i++ {
+		if d := segmentDistance(points[i], first, last); d > maxDist {
+			maxDist, index = d, i
+		}
+	}
+
+	if maxDist <= tolerance {
+		return []Point{first, last}
+	}
+
+	left := douglasPeucker(points[:index+1], tolerance)
+	right := douglasPeucker(points[index:], tolerance)
+	return append(left[:len(left)-1], right...)
+}
+
+// segmentDistance returns the distance from p to the segment a-b
+func segmentDistance(p Point, a Point, b Point) float64 {
+	dx, dy := float64(b.X-a.X), float64(b.Y-a.Y)
+	px, py := float64(p.X-a.X), float64(p.Y-a.Y)
+
+	lengthSq := dx*dx + dy*dy
+	if lengthSq == 0 {
+		return math.Hypot(px, py)
+	}
+
+	t := math.Max(0, math.Min(1, (px*dx+py*dy)/lengthSq))
+	return math.Hypot(px-t*dx, py-t*dy)
+}
@@ -0,0 +1,40 @@
+package main
+
+// despeckle removes the foreground components and fills the background
+// holes of fewer than minSize pixels in a row-major mask. Holes are found
+// with the complementary connectivity, so that with 8-connected regions a
+// hole only joins the background through an edge, as it would appear.
+func despeckle(mask []bool, width int, height int, minSize int, connectivity int) {
+	if minSize <= 1 {
+		return
+	}
+	holeConnectivity := 8
+	if connectivity == 8 {
+		holeConnectivity = 4
+	}
+	removeSmallComponents(mask, width, height, minSize, connectivity, true)
+	removeSmallComponents(mask, width, height, minSize, holeConnectivity, false)
+}
+
+// removeSmallComponents flips the components of pixels equal to value that
+// have fewer than minSize pixels
+func removeSmallComponents(mask []bool, width int, height int, minSize int, connectivity int, value bool) {
+	selected := make([]bool, len(mask))
+	for i, v := range mask {
+		selected[i] = v == value
+	}
+
+	labels := make([]int, len(mask))
+	sizes := []int{0}
+	for i, sel := range selected {
+		if sel && labels[i] == 0 {
+			sizes = append(sizes, fillRegion(selected, labels, width, height, i, len(sizes), connectivity))
+		}
+	}
+
+	for i, label := range labels {
+		if label != 0 && sizes[label] < minSize {
+			mask[i] = !value
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Colors of the diff image
+var (
+	diffBoth    = color.RGBA{255, 255, 255, 255} // foreground in both masks
+	diffNeither = color.RGBA{0, 0, 0, 255}       // background in both masks
+	diffOnlyA   = color.RGBA{255, 0, 0, 255}     // foreground only in a
+	diffOnlyB   = color.RGBA{0, 128, 255, 255}   // foreground only in b
+)
+
+// diffResponse is the JSON body of the diff endpoint
+type diffResponse struct {
+	DiffImage       string  `json:"diff_image"`
+	IoU             float64 `json:"iou"`
+	DisagreementPct float64 `json:"disagreement_percent"`
+	ForegroundPctA  float64 `json:"foreground_percent_a"`
+	ForegroundPctB  float64 `json:"foreground_percent_b"`
+	DifferingPixels int     `json:"differing_pixels"`
+	TotalPixels     int     `json:"total_pixels"`
+}
+
+// maskBits binarizes a mask image, treating pixels brighter than mid-gray
+// as foreground
+func maskBits(img image.Image) []bool {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	bits := make([]bool, width*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			bits[(y-bounds.Min.Y)*width+(x-bounds.Min.X)] = intensity(img.At(x, y), channelLuma) > 0x8000
+		}
+	}
+	return bits
+}
+
+// diffMasks compares two masks of the same size and returns the diff image
+// and the agreement metrics
+func diffMasks(a image.Image, b image.Image) (*image.RGBA, diffResponse, error) {
+	ab, bb := a.Bounds(), b.Bounds()
+	if ab.Size() != bb.Size() {
+		return nil, diffResponse{}, fmt.Errorf("%w: a is %dx%d, b is %dx%d",
+			errSizeMismatch, ab.Dx(), ab.Dy(), bb.Dx(), bb.Dy())
+	}
+
+	width := ab.Dx()
+	maskA, maskB := maskBits(a), maskBits(b)
+	diff := image.NewRGBA(image.Rect(0, 0, width, ab.Dy()))
+
+	var both, onlyA, onlyB int
+	for i := range maskA {
+		c := diffNeither
+		switch {
+		case maskA[i] && maskB[i]:
+			c = diffBoth
+			both++
+		case maskA[i]:
+			c = diffOnlyA
+			onlyA++
+		case maskB[i]:
+			c = diffOnlyB
+			onlyB++
+		}
+		diff.SetRGBA(i%width, i/width, c)
+	}
+
+	total := len(maskA)
+	percent := func(n int) float64 {
+		return math.Round(10000*float64(n)/float64(total)) / 100
+	}
+
+	// Two empty masks agree completely
+	iou := 1.0
+	if union := both + onlyA + onlyB; union > 0 {
+		iou = math.Round(10000*float64(both)/float64(union)) / 10000
+	}
+
+	return diff, diffResponse{
+		IoU:             iou,
+		DisagreementPct: percent(onlyA + onlyB),
+		ForegroundPctA:  percent(both + onlyA),
+		ForegroundPctB:  percent(both + onlyB),
+		DifferingPixels: onlyA + onlyB,
+		TotalPixels:     total,
+	}, nil
+}
+
+// loadMaskInput reads the mask field name of a request, such as side "a" or
+// "b" of a diff, either as an uploaded file or as the name or URL of a
+// stored result
+func loadMaskInput(r *http.Request, name string) (image.Image, error) {
+	if file, header, err := r.FormFile(name); err == nil {
+		defer file.Close()
+		img, err := decodeImage(file, header.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %v", errDecodeFailed, name, err)
+		}
+		return img, nil
+	}
+
+	result := r.FormValue(name + "_result")
+	if result == "" {
+		return nil, fmt.Errorf("either %s or %s_result is required", name, name)
+	}
+
+	// Accept both segmented_x.png and /uploads/segmented_x.png
+	base := path.Base(strings.TrimPrefix(result, "/uploads/"))
+	if base != strings.TrimPrefix(result, "/uploads/") || strings.HasPrefix(base, ".") {
+		return nil, fmt.Errorf("invalid %s_result %q", name, result)
+	}
+	file, err := os.Open(filepath.Join(uploadsDir, base))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", errResultNotFound, result)
+	}
+	defer file.Close()
+
+	img, err := decodeImage(file, base)
+	if err != nil {
+		return nil, fmt.Errorf("%w %s_result: %v", errDecodeFailed, name, err)
+	}
+	return img, nil
+}
+
+// diffHandler compares two masks, given as uploaded files a and b or as
+// stored results a_result and b_result, and stores a diff image
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse multipart form with 10MB max memory
+	err := parseLimitedMultipartForm(r, 10<<20)
+	if errors.Is(err, errFormLimit) {
+		writeError(w, r, codeFormLimit, "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Unable to parse form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// The body has been read: only the processing holds a worker
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	a, err := loadMaskInput(r, "a")
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+	b, err := loadMaskInput(r, "b")
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+
+	diff, resp, err := diffMasks(a, b)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+
+	diffPath, err := storeGeneratedPNG("diff_", diff)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInternal), "Error storing diff image: "+err.Error())
+		return
+	}
+
+	resp.DiffImage = uploadURL(diffPath)
+	writeJSON(w, r, resp)
+}
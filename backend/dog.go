@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"image"
+	"math"
+)
+
+func init() {
+	registerMode(modeDoG, "Edges and texture enhanced by the difference of two Gaussian blurs", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		return differenceOfGaussians(ctx, img, params.Channel, params.DoGSigma1, params.DoGSigma2)
+	}))
+}
+
+// gaussianBlur blurs a row-major grid with the separable Gaussian of the
+// given sigma
+func gaussianBlur(values []float64, width int, height int, sigma float64) []float64 {
+	g, _ := gaussianKernels(sigma)
+	return convolve1D(convolve1D(values, width, height, g, true), width, height, g, false)
+}
+
+// differenceOfGaussians blurs the selected channel at sigma1 and at sigma2
+// and returns the first blur minus the second, stretched so that the most
+// negative difference is black and the most positive white. A flat image
+// has no difference and comes out black.
+func differenceOfGaussians(ctx context.Context, img image.Image, channel string, sigma1 float64, sigma2 float64) (*image.Gray, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	levels := grayLevels(img, channel)
+	values := make([]float64, len(levels))
+	for i, v := range levels {
+		values[i] = float64(v)
+	}
+
+	fine := gaussianBlur(values, width, height, sigma1)
+	if err := canceled(ctx); err != nil {
+		return nil, err
+	}
+	coarse := gaussianBlur(values, width, height, sigma2)
+	if err := canceled(ctx); err != nil {
+		return nil, err
+	}
+
+	low, high := math.Inf(1), math.Inf(-1)
+	for i := range fine {
+		fine[i] -= coarse[i]
+		low, high = math.Min(low, fine[i]), math.Max(high, fine[i])
+	}
+
+	out := image.NewGray(bounds)
+	if high-low < 1e-9 {
+		return out, nil
+	}
+	for i, d := range fine {
+		out.Pix[i] = uint8(math.Round((d - low) / (high - low) * 255))
+	}
+	return out, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultEnvFile is read at startup when ENV_FILE is not set. Unlike a file
+// named by ENV_FILE, it may be missing.
+const defaultEnvFile = ".env"
+
+// loadEnvFile sets the variables of the .env file at ENV_FILE, or of
+// defaultEnvFile, that are not already in the environment, so that real
+// environment variables always win
+func loadEnvFile() error {
+	path, explicit := os.LookupEnv("ENV_FILE")
+	if !explicit {
+		path = defaultEnvFile
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		name, value, ok, err := parseEnvLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if !ok {
+			continue
+		}
+		if _, set := os.LookupEnv(name); !set {
+			os.Setenv(name, value)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseEnvLine parses one NAME=value line of a .env file, optionally
+// preceded by export. Values may be single-quoted, taken literally, or
+// double-quoted, with Go escapes such as \n. Unquoted values end at a #
+// preceded by a space and are trimmed. It reports false for blank and
+// comment lines.
+func parseEnvLine(line string) (string, string, bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false, nil
+	}
+	line = strings.TrimPrefix(line, "export ")
+
+	name, value, found := strings.Cut(line, "=")
+	name = strings.TrimSpace(name)
+	if !found || name == "" || strings.ContainsAny(name, " \t") {
+		return "", "", false, fmt.Errorf("expected NAME=value")
+	}
+	value = strings.TrimSpace(value)
+
+	switch {
+	case strings.HasPrefix(value, "'"):
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", "", false, fmt.Errorf("unterminated quote in %s", name)
+		}
+		return name, value[1 : end+1], true, nil
+	case strings.HasPrefix(value, `"`):
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return "", "", false, fmt.Errorf("invalid quoted value of %s", name)
+		}
+		unquoted, _ := strconv.Unquote(quoted)
+		return name, unquoted, true, nil
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return name, value, true, nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// errorCode identifies a kind of failure in JSON error bodies, together
+// with the HTTP status it is reported with. Codes are part of the API:
+// clients branch on them, so existing ones must never change.
+type errorCode struct {
+	name   string
+	status int
+}
+
+// Error codes, see the README for when each is returned
+var (
+	codeMethodNotAllowed  = errorCode{"method_not_allowed", http.StatusMethodNotAllowed}
+	codeMalformedRequest  = errorCode{"malformed_request", http.StatusBadRequest}
+	codeFormLimit         = errorCode{"form_limit_exceeded", http.StatusBadRequest}
+	codeMissingImage      = errorCode{"missing_image", http.StatusBadRequest}
+	codeInvalidParameters = errorCode{"invalid_parameters", http.StatusBadRequest}
+	codeDecodeFailed      = errorCode{"decode_failed", http.StatusBadRequest}
+	codeUnsupportedFormat = errorCode{"unsupported_format", http.StatusUnsupportedMediaType}
+	codeUnsupportedOutput = errorCode{"unsupported_output_format", http.StatusBadRequest}
+	codeInvalidOutputName = errorCode{"invalid_output_name", http.StatusBadRequest}
+	codeImageTooSmall     = errorCode{"image_too_small", http.StatusBadRequest}
+	codeImageTooLarge     = errorCode{"image_too_large", http.StatusBadRequest}
+	codeExtremeAspect     = errorCode{"extreme_aspect_ratio", http.StatusBadRequest}
+	codeInvalidCrop       = errorCode{"invalid_crop", http.StatusBadRequest}
+	codeTooManyClusters   = errorCode{"too_many_clusters", http.StatusBadRequest}
+	codeSizeMismatch      = errorCode{"size_mismatch", http.StatusBadRequest}
+	codeUnauthorized      = errorCode{"unauthorized", http.StatusUnauthorized}
+	codeForbidden         = errorCode{"forbidden", http.StatusForbidden}
+	codeNotFound          = errorCode{"not_found", http.StatusNotFound}
+	codeNotAcceptable     = errorCode{"not_acceptable", http.StatusNotAcceptable}
+	codeConflict          = errorCode{"conflict", http.StatusConflict}
+	codeOutputExists      = errorCode{"output_exists", http.StatusConflict}
+	codePayloadTooLarge   = errorCode{"payload_too_large", http.StatusRequestEntityTooLarge}
+	codeTooManyTracked    = errorCode{"too_many_tracked_uploads", http.StatusServiceUnavailable}
+	codeInternal          = errorCode{"internal_error", http.StatusInternalServerError}
+	codeSegmentTimeout    = errorCode{"segmentation_timeout", http.StatusServiceUnavailable}
+	codeQueueTimeout      = errorCode{"queue_timeout", http.StatusServiceUnavailable}
+	codeQuotaExceeded     = errorCode{"quota_exceeded", http.StatusInsufficientStorage}
+	codeDiskFull          = errorCode{"disk_full", http.StatusInsufficientStorage}
+	codeReadOnlyStorage   = errorCode{"read_only_storage", http.StatusServiceUnavailable}
+	codeTooManyJobs       = errorCode{"too_many_callback_jobs", http.StatusServiceUnavailable}
+	codeTooManyResumable  = errorCode{"too_many_resumable_uploads", http.StatusServiceUnavailable}
+)
+
+// errDecodeFailed wraps decoder errors that are returned through code
+// paths shared with other failures
+var errDecodeFailed = errors.New("error decoding")
+
+// errResultNotFound is returned for a stored result that does not exist
+var errResultNotFound = errors.New("result not found")
+
+// errorCodes maps the sentinel errors of the pipeline to their codes. The
+// first one an error wraps decides.
+var errorCodes = []struct {
+	err  error
+	code errorCode
+}{
+	{errFormLimit, codeFormLimit},
+	{errUnsupportedInput, codeUnsupportedFormat},
+	{errDecodeFailed, codeDecodeFailed},
+	{errUnsupportedOutput, codeUnsupportedOutput},
+	{errImageTooSmall, codeImageTooSmall},
+	{errImageTooLarge, codeImageTooLarge},
+	{errExtremeAspectRatio, codeExtremeAspect},
+	{errInvalidCrop, codeInvalidCrop},
+	{errTooManyClusters, codeTooManyClusters},
+	{errSizeMismatch, codeSizeMismatch},
+	{errResultNotFound, codeNotFound},
+	{errOutputExists, codeOutputExists},
+	{errUploadIDInUse, codeConflict},
+	{errTooManyTracked, codeTooManyTracked},
+	{errSegmentTimeout, codeSegmentTimeout},
+	{errQueueTimeout, codeQueueTimeout},
+	{errQuotaExceeded, codeQuotaExceeded},
+	{errDiskFull, codeDiskFull},
+	{errReadOnlyStorage, codeReadOnlyStorage},
+	{errTooManyCallbackJobs, codeTooManyJobs},
+	{errTooManyResumable, codeTooManyResumable},
+}
+
+// errorCodeOf returns the code of the sentinel error err wraps, or
+// fallback when it wraps none
+func errorCodeOf(err error, fallback errorCode) errorCode {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	var params paramErrors
+	if errors.As(err, &params) {
+		return codeInvalidParameters
+	}
+	return fallback
+}
+
+// errorResponse is the JSON body of every error response
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// writeError sends an error response with the status of code. The body is
+// JSON with the message and the stable code.
+func writeError(w http.ResponseWriter, r *http.Request, code errorCode, message string) {
+	data, err := marshalJSON(errorResponse{Error: message, Code: code.name}, responseCase(r))
+	if err != nil {
+		http.Error(w, message, code.status)
+		return
+	}
+
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code.status)
+	w.Write(append(data, '\n'))
+}
+
+// errorRecorder stands in for the response writer of a handler run on
+// behalf of background work or another API, keeping the error response it
+// writes so that it can be reported another way
+type errorRecorder struct {
+	header http.Header
+	body   bytes.Buffer
+}
+
+func newErrorRecorder() *errorRecorder {
+	return &errorRecorder{header: http.Header{}}
+}
+
+func (rec *errorRecorder) Header() http.Header         { return rec.header }
+func (rec *errorRecorder) Write(p []byte) (int, error) { return rec.body.Write(p) }
+func (rec *errorRecorder) WriteHeader(int)             {}
+
+// response returns the recorded error response
+func (rec *errorRecorder) response() errorResponse {
+	var resp errorResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil || resp.Code == "" {
+		return errorResponse{Error: strings.TrimSpace(rec.body.String()), Code: codeInternal.name}
+	}
+	return resp
+}
+
+// writeSegmentError reports a failed segmentation, blaming the request when
+// the input was invalid and the server otherwise
+func writeSegmentError(w http.ResponseWriter, r *http.Request, err error) {
+	if isInvalidInput(err) {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+	writeError(w, r, errorCodeOf(err, codeInternal), "Error performing segmentation: "+err.Error())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Data the float export endpoint can return
+const (
+	exportChannel   = "channel"
+	exportThreshMap = "threshmap"
+)
+
+// floatExportMagic starts every float export. Its last byte is the version
+// of the layout.
+var floatExportMagic = [4]byte{'R', 'S', 'F', '1'}
+
+// floatExportHeaderSize is the size in bytes of the magic, width and height
+const floatExportHeaderSize = 12
+
+// channelFloats returns the selected channel of every pixel in row-major
+// order, normalized to [0, 1] from its full 16-bit precision
+func channelFloats(img image.Image, channel string) []float32 {
+	bounds := img.Bounds()
+	values := make([]float32, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			values = append(values, float32(intensity(img.At(x, y), channel))/0xffff)
+		}
+	}
+	return values
+}
+
+// writeFloatArray writes values as a float export: the magic, the width and
+// height as little-endian uint32, then the values as little-endian IEEE 754
+// float32 in row-major order
+func writeFloatArray(w io.Writer, width int, height int, values []float32) error {
+	bw := bufio.NewWriter(w)
+	var header [floatExportHeaderSize]byte
+	copy(header[:4], floatExportMagic[:])
+	binary.LittleEndian.PutUint32(header[4:], uint32(width))
+	binary.LittleEndian.PutUint32(header[8:], uint32(height))
+	bw.Write(header[:])
+
+	var buf [4]byte
+	for _, v := range values {
+		binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+		bw.Write(buf[:])
+	}
+	return bw.Flush()
+}
+
+// exportHandler returns intermediate data of the pipeline as raw float32
+// values instead of an 8-bit image, so that no precision is lost. The
+// segmentation and preprocessing fields of /api/upload apply.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse multipart form with 10MB max memory
+	err := parseLimitedMultipartForm(r, 10<<20)
+	if errors.Is(err, errFormLimit) {
+		writeError(w, r, codeFormLimit, "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Unable to parse form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// The body has been read: only the processing holds a worker
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	file, handler, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, r, codeMissingImage, "Error retrieving file")
+		return
+	}
+	defer file.Close()
+
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+
+	data := strings.ToLower(formValue(r, "data"))
+	switch data {
+	case "":
+		data = exportChannel
+	case exportChannel, exportThreshMap:
+	default:
+		writeError(w, r, codeInvalidParameters, "Invalid parameters: "+fieldError("data", data, "expected channel or threshmap").Error())
+		return
+	}
+
+	var result Result
+	img, err := decodeInput(file, handler.Filename, params.decodeOptions(), &result)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeDecodeFailed), "Error decoding image: "+err.Error())
+		return
+	}
+	img, err = preprocessImage(img, params)
+	if isInvalidInput(err) {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeInternal, "Error processing image: "+err.Error())
+		return
+	}
+
+	var values []float32
+	err = runWithWatchdog(r.Context(), data+" export", config.SegmentTimeout, func(ctx context.Context) error {
+		if data == exportChannel {
+			values = channelFloats(img, params.Channel)
+			return nil
+		}
+		// Thresholds are gray levels, normalized like the channel
+		window := fitSauvolaWindow(params.Window, img.Bounds(), &result)
+		_, thresholds, err := sauvolaThresholds(ctx, img, params.Channel, window, params.SauvolaK, params.SauvolaR)
+		if err != nil {
+			return err
+		}
+		values = make([]float32, len(thresholds))
+		for i, t := range thresholds {
+			values[i] = float32(t / 255)
+		}
+		return nil
+	})
+	if errors.Is(err, errSegmentTimeout) {
+		writeError(w, r, codeSegmentTimeout, "Error exporting data: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeInternal, "Error exporting data: "+err.Error())
+		return
+	}
+
+	bounds := img.Bounds()
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.Itoa(floatExportHeaderSize+4*len(values)))
+	for _, warning := range result.Warnings {
+		h.Add("Warning", `199 - "`+strings.ReplaceAll(warning, `"`, `'`)+`"`)
+	}
+	if err := writeFloatArray(w, bounds.Dx(), bounds.Dy(), values); err != nil {
+		fmt.Printf("Error writing export of %s: %s\n", handler.Filename, err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxXMPBytes caps the size of a compressed XMP packet once inflated
+const maxXMPBytes = 4 << 20
+
+// FaceRegion is a face tagged in the metadata of an image, in pixels of
+// the image as stored
+type FaceRegion struct {
+	Name   string `json:"name,omitempty"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+func (f FaceRegion) rect() image.Rectangle {
+	return image.Rect(f.X, f.Y, f.X+f.Width, f.Y+f.Height)
+}
+
+// readXMP returns the XMP packet embedded in a PNG (iTXt chunk) or JPEG
+// (APP1 segment) file, or nil when there is none
+func readXMP(data []byte, path string) []byte {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return readPNGXMP(data)
+	case ".jpg", ".jpeg":
+		return readJPEGXMP(data)
+	default:
+		return nil
+	}
+}
+
+func readPNGXMP(data []byte) []byte {
+	const keyword = "XML:com.adobe.xmp\x00"
+	if len(data) < 8 || string(data[1:4]) != "PNG" {
+		return nil
+	}
+	for p := 8; p+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[p:]))
+		typ := string(data[p+4 : p+8])
+		if n < 0 || p+12+n > len(data) || typ == "IEND" {
+			return nil
+		}
+		chunk := data[p+8 : p+8+n]
+		if typ == "iTXt" && bytes.HasPrefix(chunk, []byte(keyword)) {
+			// Compression flag and method, then language and translated
+			// keyword, each NUL-terminated, then the text
+			rest := chunk[len(keyword):]
+			if len(rest) < 2 {
+				return nil
+			}
+			compressed := rest[0] == 1
+			rest = rest[2:]
+			for i := 0; i < 2; i++ {
+				end := bytes.IndexByte(rest, 0)
+				if end < 0 {
+					return nil
+				}
+				rest = rest[end+1:]
+			}
+			if !compressed {
+				return rest
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(rest))
+			if err != nil {
+				return nil
+			}
+			text, err := io.ReadAll(io.LimitReader(zr, maxXMPBytes))
+			if err != nil {
+				return nil
+			}
+			return text
+		}
+		p += 12 + n
+	}
+	return nil
+}
+
+func readJPEGXMP(data []byte) []byte {
+	const signature = "http://ns.adobe.com/xap/1.0/\x00"
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for p := 2; p+4 <= len(data) && data[p] == 0xff; {
+		marker := data[p+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[p+2:]))
+		if n < 2 || p+2+n > len(data) {
+			break
+		}
+		segment := data[p+4 : p+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte(signature)) {
+			return segment[len(signature):]
+		}
+		p += 2 + n
+	}
+	return nil
+}
+
+// parseFaceRegions returns the face regions of an XMP packet that follow
+// the Metadata Working Group region schema, which phones and photo
+// managers use for detected faces, clipped to bounds. Regions are read
+// from rdf:Description elements with a Type of Face and an Area in
+// normalized units centred on x, y.
+func parseFaceRegions(xmp []byte, bounds image.Rectangle) []FaceRegion {
+	type region struct {
+		typ, name string
+		area      map[string]string
+		text      *string
+	}
+
+	var faces []FaceRegion
+	var stack []*region
+	d := xml.NewDecoder(bytes.NewReader(xmp))
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			var top *region
+			if len(stack) > 0 {
+				top = stack[len(stack)-1]
+			}
+			switch t.Name.Local {
+			case "Description":
+				r := &region{}
+				for _, a := range t.Attr {
+					switch a.Name.Local {
+					case "Type":
+						r.typ = a.Value
+					case "Name":
+						r.name = a.Value
+					}
+				}
+				stack = append(stack, r)
+			case "Type":
+				if top != nil {
+					top.text = &top.typ
+				}
+			case "Name":
+				if top != nil {
+					top.text = &top.name
+				}
+			case "Area":
+				if top != nil {
+					top.area = map[string]string{"unit": "normalized"}
+					for _, a := range t.Attr {
+						top.area[a.Name.Local] = a.Value
+					}
+				}
+			}
+		case xml.CharData:
+			if len(stack) > 0 && stack[len(stack)-1].text != nil {
+				*stack[len(stack)-1].text += strings.TrimSpace(string(t))
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			top := stack[len(stack)-1]
+			switch t.Name.Local {
+			case "Type", "Name":
+				top.text = nil
+			case "Description":
+				stack = stack[:len(stack)-1]
+				if top.typ != "Face" || top.area == nil {
+					continue
+				}
+				if face, ok := faceFromArea(top.area, bounds); ok {
+					face.Name = top.name
+					faces = append(faces, face)
+				}
+			}
+		}
+	}
+	return faces
+}
+
+// faceFromArea converts a normalized MWG area to pixels of bounds
+func faceFromArea(area map[string]string, bounds image.Rectangle) (FaceRegion, bool) {
+	if area["unit"] != "normalized" {
+		return FaceRegion{}, false
+	}
+	var v [4]float64
+	for i, key := range []string{"x", "y", "w", "h"} {
+		f, err := strconv.ParseFloat(area[key], 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return FaceRegion{}, false
+		}
+		v[i] = f
+	}
+
+	width, height := float64(bounds.Dx()), float64(bounds.Dy())
+	r := image.Rect(
+		int(math.Floor((v[0]-v[2]/2)*width)), int(math.Floor((v[1]-v[3]/2)*height)),
+		int(math.Ceil((v[0]+v[2]/2)*width)), int(math.Ceil((v[1]+v[3]/2)*height)),
+	).Add(bounds.Min).Intersect(bounds)
+	if r.Empty() {
+		return FaceRegion{}, false
+	}
+	r = r.Sub(bounds.Min)
+	return FaceRegion{X: r.Min.X, Y: r.Min.Y, Width: r.Dx(), Height: r.Dy()}, true
+}
+
+// segmentFaces runs the mode on each face region tagged in the image and
+// draws the results into a copy of the image, or segments the whole image
+// when no face is tagged. The regions used are reported in result.
+func segmentFaces(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+	result.FaceRegions = result.taggedFaces
+	if len(result.taggedFaces) == 0 {
+		result.warn("no face regions are tagged in the image; the whole image was segmented")
+		return runMode(ctx, img, params, result)
+	}
+
+	var out *image.RGBA
+	for _, face := range result.taggedFaces {
+		roi := face.rect()
+		cropped, err := cropROI(img, roi)
+		if err != nil {
+			return nil, err
+		}
+		// Modes reading a second image, such as bgsubtract, cut it to the
+		// same region
+		faceParams := params
+		faceParams.ROI = &roi
+		segmented, err := runMode(ctx, cropped, faceParams, result)
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			out = pasteROI(img, segmented, roi, params.ROIFill)
+		} else {
+			draw.Draw(out, roi, segmented, segmented.Bounds().Min, draw.Src)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+)
+
+// errFormLimit is returned when a multipart form exceeds MAX_FORM_PARTS or
+// MAX_FIELD_BYTES
+var errFormLimit = errors.New("form exceeds limits")
+
+// checkFormLimits reads a multipart stream and fails on the first part
+// beyond the configured count or text field beyond the configured size.
+// File parts are skipped without a size limit of their own.
+func checkFormLimits(mr *multipart.Reader) error {
+	for parts := 1; ; parts++ {
+		part, err := mr.NextPart()
+		if err != nil {
+			// Malformed input is reported by the real parser
+			return nil
+		}
+		if parts > config.MaxFormParts {
+			return fmt.Errorf("%w: more than %d parts", errFormLimit, config.MaxFormParts)
+		}
+
+		if part.FileName() != "" {
+			io.Copy(io.Discard, part)
+			continue
+		}
+		n, _ := io.Copy(io.Discard, io.LimitReader(part, config.MaxFieldBytes+1))
+		if n > config.MaxFieldBytes {
+			return fmt.Errorf("%w: field %q is longer than %d bytes", errFormLimit, part.FormName(), config.MaxFieldBytes)
+		}
+	}
+}
+
+// parseLimitedMultipartForm parses a multipart request body like
+// ParseMultipartForm while enforcing the part count and text field size
+// limits. The body is checked as it streams into the parser, so an
+// oversized form is abandoned as soon as it crosses a limit instead of
+// being read in full. The whole form is parsed before it returns, file
+// parts being buffered in memory up to maxMemory and in temporary files
+// beyond, so fields sent after the image are seen before it is processed.
+func parseLimitedMultipartForm(r *http.Request, maxMemory int64) error {
+	_, mediaParams, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaParams["boundary"] == "" {
+		return r.ParseMultipartForm(maxMemory)
+	}
+
+	pr, pw := io.Pipe()
+	checked := make(chan error, 1)
+	go func() {
+		err := checkFormLimits(multipart.NewReader(pr, mediaParams["boundary"]))
+		if err != nil {
+			// Fails the next write of the tee, which aborts the parser
+			pr.CloseWithError(err)
+		} else {
+			io.Copy(io.Discard, pr)
+		}
+		checked <- err
+	}()
+
+	body := r.Body
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.TeeReader(body, pw), body}
+	err = r.ParseMultipartForm(maxMemory)
+	pw.Close()
+
+	if limitErr := <-checked; limitErr != nil {
+		if r.MultipartForm != nil {
+			r.MultipartForm.RemoveAll()
+		}
+		return limitErr
+	}
+	return err
+}
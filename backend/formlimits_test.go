@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// redRamp is a 16x8 image whose red channel rises by 17 levels per column
+func redRamp() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 17), 0, 0, 255})
+		}
+	}
+	return img
+}
+
+// fieldsAfterImage is a multipart body whose image part comes before the
+// segmentation fields
+func fieldsAfterImage(t *testing.T, fields map[string]string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("image", "gradient.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(part, redRamp()); err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range fields {
+		if err := mw.WriteField(name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, mw.FormDataContentType()
+}
+
+func TestParseLimitedMultipartFormFieldsAfterFile(t *testing.T) {
+	// A tiny memory limit spills the image to a temporary file
+	for _, maxMemory := range []int64{10 << 20, 1} {
+		body, contentType := fieldsAfterImage(t, map[string]string{"mode": modeSauvola, "window": "9"})
+		r := httptest.NewRequest(http.MethodPost, "/api/upload", body)
+		r.Header.Set("Content-Type", contentType)
+		if err := parseLimitedMultipartForm(r, maxMemory); err != nil {
+			t.Fatalf("maxMemory %d: %v", maxMemory, err)
+		}
+
+		params, err := parseSegmentParams(r)
+		if err != nil {
+			t.Fatalf("maxMemory %d: %v", maxMemory, err)
+		}
+		if params.Mode != modeSauvola || params.Window != 9 {
+			t.Errorf("maxMemory %d: got mode %q window %d, want sauvola 9", maxMemory, params.Mode, params.Window)
+		}
+
+		file, _, err := r.FormFile("image")
+		if err != nil {
+			t.Fatalf("maxMemory %d: %v", maxMemory, err)
+		}
+		if _, err := png.Decode(file); err != nil {
+			t.Errorf("maxMemory %d: image after the fields: %v", maxMemory, err)
+		}
+		file.Close()
+		r.MultipartForm.RemoveAll()
+	}
+}
+
+func TestTransformHandlerFieldsAfterFile(t *testing.T) {
+	// The four right columns, red 204 and above, pass threshold 200
+	body, contentType := fieldsAfterImage(t, map[string]string{"stats_only": "true", "channel": channelRed, "threshold": "200"})
+	r := httptest.NewRequest(http.MethodPost, "/api/segment", body)
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	transformHandler(w, r)
+
+	resp := w.Result()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, data)
+	}
+	var result Result
+	if err := json.Unmarshal(data, &result); err != nil || result.Stats == nil {
+		t.Fatalf("expected the stats_only JSON, got %q: %v", data, err)
+	}
+	if result.Stats.ForegroundPixels != 32 {
+		t.Errorf("got %d foreground pixels, want 32", result.Stats.ForegroundPixels)
+	}
+}
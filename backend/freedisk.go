@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errDiskFull is returned when storing an upload would leave less than
+// MIN_FREE_BYTES free on the disk of the uploads directory
+var errDiskFull = errors.New("not enough free disk space")
+
+// errFreeSpaceUnsupported is returned by freeSpace on platforms where the
+// free space cannot be queried
+var errFreeSpaceUnsupported = errors.New("free disk space cannot be queried on this platform")
+
+// checkFreeSpace makes sure that writing size bytes in dir leaves at least
+// MIN_FREE_BYTES available to the server. The check is skipped where the
+// free space cannot be queried.
+func checkFreeSpace(dir string, size int64) error {
+	if config.MinFreeBytes == 0 {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if errors.Is(err, errFreeSpaceUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading free disk space: %v", err)
+	}
+	// The chunks still to come of resumable uploads are spoken for
+	outstanding := resumables.outstanding()
+	if free < uint64(size)+uint64(outstanding)+uint64(config.MinFreeBytes) {
+		return fmt.Errorf("%w: %d bytes available, %d of them expected by resumable uploads, an upload of %d bytes would leave less than %d",
+			errDiskFull, free, outstanding, size, config.MinFreeBytes)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// fuzzFormats are the input formats exercised by FuzzSegment
+var fuzzFormats = []string{".png", ".jpg", ".gif", ".pgm", ".ppm", ".pbm"}
+
+// fuzzModes are the segmentation modes exercised by FuzzSegment
+var fuzzModes = []string{modeBinary, modeContours, modeBands, modeMeanShift, modeSauvola, modeBlobs, modeSideBySide, modeDoG, modeSoftMask, modeChromaKey, modeGradientHeatmap}
+
+// maxFuzzPixels skips inputs whose header declares a huge image, which
+// would only exhaust memory rather than exercise the pixel loops
+const maxFuzzPixels = 1 << 16
+
+// fuzzSeedImage returns a small image with a gradient and a transparent corner
+func fuzzSeedImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 16; x++ {
+			a := uint8(255)
+			if x < 4 && y < 4 {
+				a = 0
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 16), uint8(y * 16), 128, a})
+		}
+	}
+	return img
+}
+
+// FuzzSegment feeds arbitrary bytes through the decode and segmentation
+// pipeline. Malformed inputs must be rejected with an error, never a panic.
+func FuzzSegment(f *testing.F) {
+	seed := fuzzSeedImage()
+	for i, ext := range fuzzFormats {
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, seed, "seed"+ext, encodeOptions{}); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes(), uint8(i), uint8(i))
+	}
+	f.Add([]byte("P2 8 8 255 0 0 0"), uint8(3), uint8(0))
+	f.Add([]byte("P1\n8 8\n0101010"), uint8(5), uint8(1))
+
+	f.Fuzz(func(t *testing.T, data []byte, format uint8, mode uint8) {
+		path := "fuzz" + fuzzFormats[int(format)%len(fuzzFormats)]
+
+		cfg, err := decodeImageConfig(bytes.NewReader(data), path)
+		if err != nil || cfg.Width*cfg.Height > maxFuzzPixels {
+			return
+		}
+
+		params := defaultSegmentParams()
+		params.Mode = fuzzModes[int(mode)%len(fuzzModes)]
+		params.Cutoffs = []uint8{64, 128, 192}
+		params.SpatialRadius = 2
+		params.Simplify = 1
+
+		var result Result
+		img, err := decodeInput(bytes.NewReader(data), path, decodeOptions{}, &result)
+		if err != nil {
+			return
+		}
+
+		segmented, err := segmentDecodedImage(context.Background(), img, params, &result, newStageTimer())
+		if err != nil {
+			return
+		}
+		if segmented != nil {
+			if err := encodeImage(&bytes.Buffer{}, segmented, path, encodeOptions{}); err != nil {
+				t.Fatalf("encoding %s output: %v", params.Mode, err)
+			}
+		}
+	})
+}
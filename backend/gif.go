@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxGIFFrames caps the number of frames segmented in an animated GIF
+const maxGIFFrames = 200
+
+// maxGIFPixels caps the pixels of all frames of an animated GIF together,
+// since every frame is decoded into memory before any is segmented
+const maxGIFPixels = 1 << 26
+
+// maskPalette is the black and white palette used for segmented GIF frames
+var maskPalette = color.Palette{
+	color.RGBA{0, 0, 0, 255},
+	color.RGBA{255, 255, 255, 255},
+}
+
+func isGIF(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".gif"
+}
+
+// performAnimatedSegmentation segments every frame of an animated GIF and
+// writes the masks as an animated GIF, preserving the frame delays. The
+// whole animation runs under a single watchdog deadline.
+func performAnimatedSegmentation(ctx context.Context, inputPath string, outputPath string, params SegmentParams) error {
+	file, err := os.Open(inputPath)
+	if err != nil {
+		return fmt.Errorf("error opening image: %v", err)
+	}
+	defer file.Close()
+
+	frames, pixels, err := scanGIFFrames(file)
+	if err != nil {
+		return fmt.Errorf("%w image: %w", errDecodeFailed, err)
+	}
+	if frames > maxGIFFrames {
+		return fmt.Errorf("%w: too many frames: %d (max %d)", errImageTooLarge, frames, maxGIFFrames)
+	}
+	if pixels > maxGIFPixels {
+		return fmt.Errorf("%w: the frames hold %d pixels together (max %d)", errImageTooLarge, pixels, maxGIFPixels)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error opening image: %v", err)
+	}
+
+	anim, err := gif.DecodeAll(file)
+	if err != nil {
+		return fmt.Errorf("%w image: %w", errDecodeFailed, err)
+	}
+
+	// Frames may only cover part of the canvas, so composite them in order
+	// before segmenting to get the image the viewer would actually see
+	canvasBounds := image.Rect(0, 0, anim.Config.Width, anim.Config.Height)
+	if canvasBounds.Empty() && len(anim.Image) > 0 {
+		canvasBounds = anim.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(canvasBounds)
+
+	out := &gif.GIF{
+		LoopCount: anim.LoopCount,
+		Config: image.Config{
+			ColorModel: maskPalette,
+		},
+	}
+
+	err = runWithWatchdog(ctx, "animated segmentation", config.SegmentTimeout, func(ctx context.Context) error {
+		for i, frame := range anim.Image {
+			var previous *image.RGBA
+			disposal := byte(gif.DisposalNone)
+			if i < len(anim.Disposal) {
+				disposal = anim.Disposal[i]
+			}
+			if disposal == gif.DisposalPrevious {
+				previous = image.NewRGBA(canvasBounds)
+				draw.Draw(previous, canvasBounds, canvas, canvasBounds.Min, draw.Src)
+			}
+
+			draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+			processed, err := preprocessImage(canvas, params)
+			if err != nil {
+				return err
+			}
+			denoised, err := denoiseImage(ctx, processed, params)
+			if err != nil {
+				return err
+			}
+			thresholded, err := thresholdImage(ctx, denoised, params)
+			if err != nil {
+				return err
+			}
+			mask := resizeImage(thresholded, params)
+			paletted := image.NewPaletted(mask.Bounds(), maskPalette)
+			draw.Draw(paletted, mask.Bounds(), mask, mask.Bounds().Min, draw.Src)
+
+			out.Image = append(out.Image, paletted)
+			delay := 0
+			if i < len(anim.Delay) {
+				delay = anim.Delay[i]
+			}
+			out.Delay = append(out.Delay, delay)
+			out.Disposal = append(out.Disposal, gif.DisposalNone)
+
+			switch disposal {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Rotation, cropping and resizing change the size of the output frames
+	if len(out.Image) > 0 {
+		out.Config.Width = out.Image[0].Bounds().Dx()
+		out.Config.Height = out.Image[0].Bounds().Dy()
+	}
+
+	dst, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %v", err)
+	}
+	defer dst.Close()
+
+	if err := gif.EncodeAll(dst, out); err != nil {
+		return fmt.Errorf("error encoding output image: %v", err)
+	}
+
+	return nil
+}
+
+// scanGIFFrames walks the block structure of a GIF, skipping the image
+// data, and returns the number of frames and the pixels they cover
+func scanGIFFrames(r io.Reader) (frames int, pixels int64, err error) {
+	br := bufio.NewReader(r)
+	skip := func(n int64) error {
+		_, err := io.CopyN(io.Discard, br, n)
+		return err
+	}
+	skipSubBlocks := func() error {
+		for {
+			size, err := br.ReadByte()
+			if err != nil || size == 0 {
+				return err
+			}
+			if err := skip(int64(size)); err != nil {
+				return err
+			}
+		}
+	}
+	colorTable := func(flags byte) int64 {
+		if flags&0x80 == 0 {
+			return 0
+		}
+		return 3 << (flags&0x07 + 1)
+	}
+
+	// Header and logical screen descriptor
+	var header [13]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, 0, fmt.Errorf("gif: reading header: %v", err)
+	}
+	if string(header[:3]) != "GIF" {
+		return 0, 0, fmt.Errorf("gif: not a GIF file")
+	}
+	if err := skip(colorTable(header[10])); err != nil {
+		return 0, 0, fmt.Errorf("gif: reading color table: %v", err)
+	}
+
+	for {
+		block, err := br.ReadByte()
+		if err != nil {
+			return frames, pixels, fmt.Errorf("gif: reading frames: %v", err)
+		}
+		switch block {
+		case 0x21: // extension: label and sub-blocks
+			if _, err := br.ReadByte(); err != nil {
+				return frames, pixels, fmt.Errorf("gif: reading extension: %v", err)
+			}
+			if err := skipSubBlocks(); err != nil {
+				return frames, pixels, fmt.Errorf("gif: reading extension: %v", err)
+			}
+		case 0x2c: // image descriptor, color table, LZW code size and data
+			var desc [9]byte
+			if _, err := io.ReadFull(br, desc[:]); err != nil {
+				return frames, pixels, fmt.Errorf("gif: reading image descriptor: %v", err)
+			}
+			width := int64(desc[4]) | int64(desc[5])<<8
+			height := int64(desc[6]) | int64(desc[7])<<8
+			frames++
+			pixels += width * height
+			if err := skip(colorTable(desc[8]) + 1); err != nil {
+				return frames, pixels, fmt.Errorf("gif: reading image data: %v", err)
+			}
+			if err := skipSubBlocks(); err != nil {
+				return frames, pixels, fmt.Errorf("gif: reading image data: %v", err)
+			}
+		case 0x3b: // trailer
+			return frames, pixels, nil
+		default:
+			return frames, pixels, fmt.Errorf("gif: unknown block type: 0x%.2x", block)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Color ramps of gradientheatmap mode, from the weakest to the strongest
+// gradient
+const (
+	heatmapRampRainbow = "rainbow"
+	heatmapRampHot     = "hot"
+	heatmapRampGray    = "gray"
+)
+
+func init() {
+	registerMode(modeGradientHeatmap, "Gradient magnitude painted through a color ramp, showing edge strength", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		return gradientHeatmap(ctx, img, params.Channel, params.HeatmapRamp)
+	}))
+}
+
+// heatmapColors returns the 256 colors of a ramp
+func heatmapColors(ramp string) [256]color.RGBA {
+	var colors [256]color.RGBA
+	for i := range colors {
+		t := float64(i) / 255
+		switch ramp {
+		case heatmapRampHot:
+			// Black to red, red to yellow, then yellow to white
+			colors[i] = color.RGBA{
+				uint8(math.Round(math.Min(1, 3*t) * 255)),
+				uint8(math.Round(math.Min(1, math.Max(0, 3*t-1)) * 255)),
+				uint8(math.Round(math.Max(0, 3*t-2) * 255)),
+				255,
+			}
+		case heatmapRampGray:
+			colors[i] = color.RGBA{uint8(i), uint8(i), uint8(i), 255}
+		default:
+			colors[i] = hsvToRGB(240*(1-t), 1, 1)
+		}
+	}
+	return colors
+}
+
+// gradientHeatmap computes the Sobel gradient magnitude of the selected
+// channel, replicating the border pixels, and paints it through ramp
+// stretched so that the strongest gradient of the image gets the last
+// color. A flat image comes out in the first color.
+func gradientHeatmap(ctx context.Context, img image.Image, channel string, ramp string) (*image.RGBA, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	levels := grayLevels(img, channel)
+	at := func(x, y int) float64 {
+		x = min(max(x, 0), width-1)
+		y = min(max(y, 0), height-1)
+		return float64(levels[y*width+x])
+	}
+
+	magnitude := make([]float64, width*height)
+	strongest := 0.0
+	for y := 0; y < height; y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		for x := 0; x < width; x++ {
+			gx := at(x+1, y-1) + 2*at(x+1, y) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x-1, y) - at(x-1, y+1)
+			gy := at(x-1, y+1) + 2*at(x, y+1) + at(x+1, y+1) - at(x-1, y-1) - 2*at(x, y-1) - at(x+1, y-1)
+			m := math.Hypot(gx, gy)
+			magnitude[y*width+x] = m
+			strongest = math.Max(strongest, m)
+		}
+	}
+
+	colors := heatmapColors(ramp)
+	out := image.NewRGBA(bounds)
+	for i, m := range magnitude {
+		level := 0
+		if strongest > 0 {
+			level = int(math.Round(m / strongest * 255))
+		}
+		out.SetRGBA(bounds.Min.X+i%width, bounds.Min.Y+i/width, colors[level])
+	}
+	return out, nil
+}
@@ -0,0 +1,967 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The GraphQL endpoint implements the subset of the language clients need
+// for its small schema: queries and mutations with variables, aliases and
+// nested selections. Fragments, directives, subscriptions and introspection
+// other than __typename are rejected.
+
+// graphQLField is a field of a GraphQL object type: the object type it
+// returns, "" for a scalar, and the arguments it accepts
+type graphQLField struct {
+	Type string
+	Args []string
+}
+
+// graphQLTypes is the schema, by object type. Nested result data such as
+// blobs or stats is returned whole as JSON scalars.
+var graphQLTypes = map[string]map[string]graphQLField{
+	"Query": {
+		"result": {Type: "Result", Args: []string{"id"}},
+	},
+	"Mutation": {
+		"segment": {Type: "Result", Args: []string{"image", "filename", "options"}},
+	},
+	"Result": {
+		"id":             {},
+		"originalImage":  {},
+		"segmentedImage": {},
+		"message":        {},
+		"warnings":       {},
+		"seed":           {},
+		"blobCount":      {},
+		"blobs":          {},
+		"contours":       {},
+		"stats":          {},
+		"regions":        {},
+		"rle":            {},
+		"faceRegions":    {},
+		"parameters":     {},
+		"createdAt":      {},
+		"original":       {Type: "StoredImage"},
+		"segmented":      {Type: "StoredImage"},
+	},
+	"StoredImage": {
+		"url":        {},
+		"format":     {},
+		"width":      {},
+		"height":     {},
+		"bytes":      {},
+		"modifiedAt": {},
+	},
+}
+
+// graphQLRootTypes are the object types of the operations
+var graphQLRootTypes = map[string]string{"query": "Query", "mutation": "Mutation"}
+
+// graphQLRequest is the JSON body of a GraphQL request
+type graphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLError is an entry of the errors list of a GraphQL response. The
+// code extension holds the stable error code of the REST API.
+type graphQLError struct {
+	Message    string            `json:"message"`
+	Path       []interface{}     `json:"path,omitempty"`
+	Extensions map[string]string `json:"extensions,omitempty"`
+}
+
+// graphQLResponse is the JSON body of a GraphQL response
+type graphQLResponse struct {
+	Data   *graphQLObject `json:"data,omitempty"`
+	Errors []graphQLError `json:"errors,omitempty"`
+}
+
+// graphQLObject is an object of a response, keeping its fields in the
+// order they were selected
+type graphQLObject struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (o *graphQLObject) set(key string, value interface{}) {
+	if o.values == nil {
+		o.values = map[string]interface{}{}
+	}
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *graphQLObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlToken is a lexical token of a GraphQL document: a name ('n'), a
+// number ('0'), a string ('s'), a spread ('.') or a punctuator, which is
+// its own kind. Kind 0 marks the end of the document.
+type gqlToken struct {
+	kind byte
+	text string
+	pos  int
+}
+
+// lexGraphQL splits a GraphQL document into tokens, dropping whitespace,
+// commas and comments
+func lexGraphQL(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case strings.HasPrefix(src[i:], "\ufeff"):
+			i += len("\ufeff")
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.ContainsRune("!$():=@[]{}|", rune(c)):
+			tokens = append(tokens, gqlToken{c, string(c), i})
+			i++
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{'.', "...", i})
+			i += 3
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, gqlToken{'n', src[start:i], start})
+		case c == '-' || c >= '0' && c <= '9':
+			start := i
+			digits := func() {
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+			}
+			if c == '-' {
+				i++
+			}
+			digits()
+			if i < len(src) && src[i] == '.' {
+				i++
+				digits()
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				digits()
+			}
+			text := src[start:i]
+			if !json.Valid([]byte(text)) {
+				return nil, fmt.Errorf("invalid number %q at offset %d", text, start)
+			}
+			tokens = append(tokens, gqlToken{'0', text, start})
+		case strings.HasPrefix(src[i:], `"""`):
+			return nil, fmt.Errorf("block strings are not supported (offset %d)", i)
+		case c == '"':
+			start := i
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+				if i < len(src) && (src[i] == '\n' || src[i] == '\r') {
+					break
+				}
+			}
+			if i >= len(src) || src[i] != '"' {
+				return nil, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+			// GraphQL string escapes are those of JSON
+			var s string
+			if err := json.Unmarshal([]byte(src[start:i]), &s); err != nil {
+				return nil, fmt.Errorf("invalid string at offset %d: %v", start, err)
+			}
+			tokens = append(tokens, gqlToken{'s', s, start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+		}
+	}
+	return append(tokens, gqlToken{pos: len(src)}), nil
+}
+
+// gqlVariable is a reference to a variable in an argument value
+type gqlVariable string
+
+// gqlSelection is a selected field, with its arguments still holding
+// variable references
+type gqlSelection struct {
+	Alias      string
+	Name       string
+	Args       map[string]interface{}
+	Selections []gqlSelection
+	pos        int
+}
+
+// key returns the name of the field in the response
+func (s gqlSelection) key() string {
+	if s.Alias != "" {
+		return s.Alias
+	}
+	return s.Name
+}
+
+// gqlVariableDef declares a variable of an operation
+type gqlVariableDef struct {
+	Name       string
+	NonNull    bool
+	Default    interface{}
+	HasDefault bool
+}
+
+// gqlOperation is a query or a mutation of a document
+type gqlOperation struct {
+	Kind       string
+	Name       string
+	Variables  []gqlVariableDef
+	Selections []gqlSelection
+}
+
+// maxGraphQLQueryBytes caps the text of a GraphQL document, separately
+// from the body limit that leaves room for a base64 image in variables
+const maxGraphQLQueryBytes = 64 << 10
+
+// maxGraphQLDepth bounds the nesting of selection sets, list and object
+// values and list types, the parser recursing once per level
+const maxGraphQLDepth = 32
+
+// gqlParser parses the tokens of a GraphQL document
+type gqlParser struct {
+	tokens []gqlToken
+	i      int
+	depth  int
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.i]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+// expect consumes the next token, which must be of the given kind
+func (p *gqlParser) expect(kind byte) (gqlToken, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, p.unexpected(t)
+	}
+	return t, nil
+}
+
+// enter descends one nesting level at token t, failing past maxGraphQLDepth.
+// Every successful call is paired with leave.
+func (p *gqlParser) enter(t gqlToken) error {
+	if p.depth >= maxGraphQLDepth {
+		return fmt.Errorf("document nested deeper than %d levels (offset %d)", maxGraphQLDepth, t.pos)
+	}
+	p.depth++
+	return nil
+}
+
+func (p *gqlParser) leave() {
+	p.depth--
+}
+
+func (p *gqlParser) unexpected(t gqlToken) error {
+	switch t.kind {
+	case 0:
+		return fmt.Errorf("unexpected end of document")
+	case '.':
+		return fmt.Errorf("fragments are not supported (offset %d)", t.pos)
+	case '@':
+		return fmt.Errorf("directives are not supported (offset %d)", t.pos)
+	}
+	return fmt.Errorf("unexpected %q at offset %d", t.text, t.pos)
+}
+
+// parseGraphQL parses a document into its operations
+func parseGraphQL(src string) ([]gqlOperation, error) {
+	tokens, err := lexGraphQL(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+
+	var ops []gqlOperation
+	for p.peek().kind != 0 {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, errors.New("document holds no operation")
+	}
+	return ops, nil
+}
+
+func (p *gqlParser) operation() (gqlOperation, error) {
+	op := gqlOperation{Kind: "query"}
+	if t := p.peek(); t.kind != '{' {
+		switch t.text {
+		case "query", "mutation":
+			op.Kind = p.next().text
+		case "subscription", "fragment":
+			return op, fmt.Errorf("%ss are not supported (offset %d)", t.text, t.pos)
+		default:
+			return op, p.unexpected(t)
+		}
+		if p.peek().kind == 'n' {
+			op.Name = p.next().text
+		}
+		if p.peek().kind == '(' {
+			vars, err := p.variableDefs()
+			if err != nil {
+				return op, err
+			}
+			op.Variables = vars
+		}
+	}
+
+	selections, err := p.selectionSet()
+	op.Selections = selections
+	return op, err
+}
+
+func (p *gqlParser) variableDefs() ([]gqlVariableDef, error) {
+	p.next()
+	var defs []gqlVariableDef
+	for p.peek().kind != ')' {
+		if _, err := p.expect('$'); err != nil {
+			return nil, err
+		}
+		name, err := p.expect('n')
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		def := gqlVariableDef{Name: name.text}
+		if def.NonNull, err = p.typeRef(); err != nil {
+			return nil, err
+		}
+		if p.peek().kind == '=' {
+			p.next()
+			if def.Default, err = p.value(true); err != nil {
+				return nil, err
+			}
+			def.HasDefault = true
+		}
+		defs = append(defs, def)
+	}
+	p.next()
+	return defs, nil
+}
+
+// typeRef parses a type such as [String!]! and reports whether it is non-null
+func (p *gqlParser) typeRef() (bool, error) {
+	if t := p.peek(); t.kind == '[' {
+		p.next()
+		if err := p.enter(t); err != nil {
+			return false, err
+		}
+		defer p.leave()
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if _, err := p.expect(']'); err != nil {
+			return false, err
+		}
+	} else if _, err := p.expect('n'); err != nil {
+		return false, err
+	}
+	if p.peek().kind == '!' {
+		p.next()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	t, err := p.expect('{')
+	if err != nil {
+		return nil, err
+	}
+	if err := p.enter(t); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+
+	var selections []gqlSelection
+	for p.peek().kind != '}' {
+		name, err := p.expect('n')
+		if err != nil {
+			return nil, err
+		}
+		sel := gqlSelection{Name: name.text, pos: name.pos}
+		if p.peek().kind == ':' {
+			p.next()
+			field, err := p.expect('n')
+			if err != nil {
+				return nil, err
+			}
+			sel.Alias, sel.Name = sel.Name, field.text
+		}
+		if p.peek().kind == '(' {
+			if sel.Args, err = p.arguments(); err != nil {
+				return nil, err
+			}
+		}
+		if p.peek().kind == '{' {
+			if sel.Selections, err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		selections = append(selections, sel)
+	}
+	p.next()
+	if len(selections) == 0 {
+		return nil, errors.New("empty selection set")
+	}
+	return selections, nil
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	p.next()
+	args := map[string]interface{}{}
+	for p.peek().kind != ')' {
+		name, err := p.expect('n')
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(':'); err != nil {
+			return nil, err
+		}
+		if args[name.text], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	p.next()
+	return args, nil
+}
+
+// value parses an argument value. Numbers keep their text as json.Number
+// and enum values become strings, so that both pass through
+// jsonFormValues like their JSON equivalents.
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case '$':
+		if constant {
+			return nil, fmt.Errorf("variable not allowed in a default value (offset %d)", t.pos)
+		}
+		name, err := p.expect('n')
+		return gqlVariable(name.text), err
+	case '0':
+		return json.Number(t.text), nil
+	case 's':
+		return t.text, nil
+	case 'n':
+		switch t.text {
+		case "true", "false":
+			return t.text == "true", nil
+		case "null":
+			return nil, nil
+		}
+		return t.text, nil
+	case '[':
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		list := []interface{}{}
+		for p.peek().kind != ']' {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		p.next()
+		return list, nil
+	case '{':
+		if err := p.enter(t); err != nil {
+			return nil, err
+		}
+		defer p.leave()
+		object := map[string]interface{}{}
+		for p.peek().kind != '}' {
+			name, err := p.expect('n')
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(':'); err != nil {
+				return nil, err
+			}
+			if object[name.text], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+		return object, nil
+	}
+	return nil, p.unexpected(t)
+}
+
+// validateSelections checks selections against the fields of an object
+// type before anything runs, so that a mistyped field does not leave a
+// mutation half done
+func validateSelections(typeName string, selections []gqlSelection, vars map[string]bool) error {
+	for _, sel := range selections {
+		if sel.Name == "__typename" {
+			if sel.Args != nil || sel.Selections != nil {
+				return fmt.Errorf("__typename takes no arguments or selections (offset %d)", sel.pos)
+			}
+			continue
+		}
+		field, ok := graphQLTypes[typeName][sel.Name]
+		if !ok {
+			return fmt.Errorf("cannot query field %q on type %s (offset %d)", sel.Name, typeName, sel.pos)
+		}
+		for name, v := range sel.Args {
+			if !containsString(field.Args, name) {
+				return fmt.Errorf("unknown argument %q on field %s.%s (offset %d)", name, typeName, sel.Name, sel.pos)
+			}
+			if err := checkVariables(v, vars); err != nil {
+				return err
+			}
+		}
+		switch {
+		case field.Type == "" && sel.Selections != nil:
+			return fmt.Errorf("field %s.%s is a scalar and takes no selections (offset %d)", typeName, sel.Name, sel.pos)
+		case field.Type != "" && sel.Selections == nil:
+			return fmt.Errorf("field %s.%s of type %s needs a selection of subfields (offset %d)", typeName, sel.Name, field.Type, sel.pos)
+		case field.Type != "":
+			if err := validateSelections(field.Type, sel.Selections, vars); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkVariables checks that the variables an argument refers to are
+// declared by the operation
+func checkVariables(v interface{}, vars map[string]bool) error {
+	switch v := v.(type) {
+	case gqlVariable:
+		if !vars[string(v)] {
+			return fmt.Errorf("variable $%s is not defined", v)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := checkVariables(item, vars); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if err := checkVariables(item, vars); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// substituteVariables replaces the variable references of an argument with
+// their values
+func substituteVariables(v interface{}, values map[string]interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlVariable:
+		return values[string(v)]
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = substituteVariables(item, values)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for name, item := range v {
+			out[name] = substituteVariables(item, values)
+		}
+		return out
+	}
+	return v
+}
+
+// graphQLResolver computes a root field from its arguments, returning the
+// object of its type or nil for null
+type graphQLResolver func(r *http.Request, args map[string]interface{}) (map[string]interface{}, error)
+
+// graphQLResolvers are the root fields, by operation type and name
+var graphQLResolvers = map[string]map[string]graphQLResolver{
+	"query":    {"result": resolveResult},
+	"mutation": {"segment": resolveSegment},
+}
+
+// stringArg returns a string argument, which must be given if required
+func stringArg(args map[string]interface{}, name string, required bool) (string, error) {
+	switch v := args[name].(type) {
+	case string:
+		return v, nil
+	case nil:
+		if required {
+			return "", argumentError("argument %q is required", name)
+		}
+		return "", nil
+	}
+	return "", argumentError("argument %q must be a string", name)
+}
+
+// resolveResult loads a stored result by ID
+func resolveResult(r *http.Request, args map[string]interface{}) (map[string]interface{}, error) {
+	id, err := stringArg(args, "id", true)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := loadResult(id)
+	if err != nil {
+		return nil, err
+	}
+	return storedResultObject(stored)
+}
+
+// resolveSegment runs a JSON upload of image, a base64 data URI, with the
+// /api/upload options given as an object, once a segmentation worker is
+// free, and returns the stored result
+func resolveSegment(r *http.Request, args map[string]interface{}) (map[string]interface{}, error) {
+	fields := map[string]json.RawMessage{}
+	if options, ok := args["options"].(map[string]interface{}); ok {
+		for name, v := range options {
+			// The mutation answers with the result, so it cannot be a callback job
+			if name == "callback_url" {
+				return nil, argumentError("option %q is not supported by the segment mutation", name)
+			}
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = raw
+		}
+	} else if args["options"] != nil {
+		return nil, argumentError("argument %q must be an object", "options")
+	}
+	for _, name := range []string{"image", "filename"} {
+		v, err := stringArg(args, name, name == "image")
+		if err != nil {
+			return nil, err
+		}
+		if v != "" {
+			fields[name], _ = json.Marshal(v)
+		}
+	}
+
+	if transformOnly {
+		return nil, errReadOnlyStorage
+	}
+	release, err := segmentQueue.acquire(r.Context(), config.QueueTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	rec := newErrorRecorder()
+	result, ok := segmentJSONUpload(rec, r.Clone(r.Context()), fields)
+	if !ok {
+		resp := rec.response()
+		return nil, graphQLCodedError{resp.Error, resp.Code}
+	}
+	stored, err := loadResult(result.ID)
+	if err != nil {
+		return nil, err
+	}
+	return storedResultObject(stored)
+}
+
+// graphQLCodedError is an error carrying the code of an error response
+type graphQLCodedError struct {
+	message string
+	code    string
+}
+
+func (e graphQLCodedError) Error() string { return e.message }
+
+// argumentError reports an invalid argument of a root field
+func argumentError(format string, args ...interface{}) error {
+	return graphQLCodedError{fmt.Sprintf(format, args...), codeInvalidParameters.name}
+}
+
+// storedResultObject returns a stored result as an object of the Result
+// type, with the metadata of its stored images. Only the field names are
+// camelCased: JSON scalars such as parameters keep the keys of the REST
+// API, which options also takes.
+func storedResultObject(stored *storedResult) (map[string]interface{}, error) {
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var fields map[string]interface{}
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	object := make(map[string]interface{}, len(fields)+2)
+	for name, v := range fields {
+		object[snakeToCamel(name)] = v
+	}
+	object["original"] = storedImageObject(stored.OriginalImage)
+	object["segmented"] = storedImageObject(stored.SegmentedImage)
+	return object, nil
+}
+
+// storedImageObject returns the metadata of an image in the uploads
+// directory by its URL, or nil when there is none or it was removed
+func storedImageObject(url string) map[string]interface{} {
+	name := strings.TrimPrefix(url, "/uploads/")
+	if name == "" || path.Base(name) != name || strings.HasPrefix(name, ".") {
+		return nil
+	}
+	file, err := os.Open(filepath.Join(uploadsDir, name))
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+
+	object := map[string]interface{}{
+		"url":        url,
+		"format":     strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), "."),
+		"bytes":      info.Size(),
+		"modifiedAt": info.ModTime().UTC().Format(time.RFC3339),
+	}
+	head := make([]byte, sniffLen)
+	n, _ := file.ReadAt(head, 0)
+	if format := sniffFormat(head[:n]); format != "" {
+		object["format"] = format
+	}
+	if cfg, err := decodeImageConfig(file, name); err == nil {
+		object["width"], object["height"] = cfg.Width, cfg.Height
+	}
+	return object
+}
+
+// completeValue applies the selections of a field of object type to its
+// value, an object or a list of them
+func completeValue(typeName string, value interface{}, selections []gqlSelection) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		object := &graphQLObject{}
+		for _, sel := range selections {
+			if sel.Name == "__typename" {
+				object.set(sel.key(), typeName)
+				continue
+			}
+			field := graphQLTypes[typeName][sel.Name]
+			if field.Type == "" {
+				object.set(sel.key(), v[sel.Name])
+				continue
+			}
+			object.set(sel.key(), completeValue(field.Type, v[sel.Name], sel.Selections))
+		}
+		return object
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = completeValue(typeName, item, selections)
+		}
+		return list
+	}
+	return nil
+}
+
+// executeGraphQL runs an operation with the request's variables. Root
+// fields run one after another, so mutations never race each other.
+func executeGraphQL(r *http.Request, op gqlOperation, variables map[string]interface{}) graphQLResponse {
+	values := map[string]interface{}{}
+	for _, def := range op.Variables {
+		v, given := variables[def.Name]
+		switch {
+		case given:
+			values[def.Name] = v
+		case def.HasDefault:
+			values[def.Name] = def.Default
+		case def.NonNull:
+			return graphQLResponse{Errors: []graphQLError{{Message: fmt.Sprintf("variable $%s of non-null type was not provided", def.Name)}}}
+		}
+	}
+
+	typeName := graphQLRootTypes[op.Kind]
+	data := &graphQLObject{}
+	var errs []graphQLError
+	for _, sel := range op.Selections {
+		if sel.Name == "__typename" {
+			data.set(sel.key(), typeName)
+			continue
+		}
+		args, _ := substituteVariables(sel.Args, values).(map[string]interface{})
+		object, err := graphQLResolvers[op.Kind][sel.Name](r, args)
+		if err != nil {
+			errs = append(errs, resolverError(err, sel.key()))
+			data.set(sel.key(), nil)
+			continue
+		}
+		data.set(sel.key(), completeValue(graphQLTypes[typeName][sel.Name].Type, object, sel.Selections))
+	}
+	return graphQLResponse{Data: data, Errors: errs}
+}
+
+// resolverError reports the failure of a root field with the error code of
+// the equivalent REST request
+func resolverError(err error, key string) graphQLError {
+	code := errorCodeOf(err, codeInternal).name
+	var coded graphQLCodedError
+	if errors.As(err, &coded) {
+		code = coded.code
+	}
+	return graphQLError{Message: err.Error(), Path: []interface{}{key}, Extensions: map[string]string{"code": code}}
+}
+
+// writeGraphQL sends a GraphQL response. Its field names are the ones
+// selected, so the JSON case preference does not apply.
+func writeGraphQL(w http.ResponseWriter, status int, resp graphQLResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(graphQLResponse{Errors: []graphQLError{{Message: "Error encoding response: " + err.Error()}}})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// graphQLRequestError answers a request that cannot be executed
+func graphQLRequestError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeGraphQL(w, status, graphQLResponse{Errors: []graphQLError{{Message: fmt.Sprintf(format, args...)}}})
+}
+
+// graphQLHandler serves GraphQL requests, sent as a JSON body to POST or
+// as query, operationName and variables parameters to GET, which only runs
+// queries
+func graphQLHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			dec := json.NewDecoder(strings.NewReader(v))
+			dec.UseNumber()
+			if err := dec.Decode(&req.Variables); err != nil {
+				graphQLRequestError(w, http.StatusBadRequest, "Invalid variables: %v", err)
+				return
+			}
+		}
+	case http.MethodPost:
+		// Leave room for a base64 image like /api/upload/json
+		r.Body = http.MaxBytesReader(w, r.Body, maxJSONImageBytes*4/3+64<<10)
+		dec := json.NewDecoder(r.Body)
+		dec.UseNumber()
+		if err := dec.Decode(&req); err != nil {
+			graphQLRequestError(w, http.StatusBadRequest, "Invalid JSON body: %v", err)
+			return
+		}
+	default:
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	if len(req.Query) > maxGraphQLQueryBytes {
+		graphQLRequestError(w, http.StatusRequestEntityTooLarge, "Query of %d bytes exceeds the limit of %d bytes", len(req.Query), maxGraphQLQueryBytes)
+		return
+	}
+	ops, err := parseGraphQL(req.Query)
+	if err != nil {
+		graphQLRequestError(w, http.StatusBadRequest, "Syntax error: %v", err)
+		return
+	}
+	var op *gqlOperation
+	for i := range ops {
+		if req.OperationName == "" && len(ops) == 1 || ops[i].Name == req.OperationName {
+			op = &ops[i]
+			break
+		}
+	}
+	if op == nil {
+		if req.OperationName == "" {
+			graphQLRequestError(w, http.StatusBadRequest, "operationName is required for a document with several operations")
+		} else {
+			graphQLRequestError(w, http.StatusBadRequest, "Unknown operation %q", req.OperationName)
+		}
+		return
+	}
+	if op.Kind == "mutation" && r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		graphQLRequestError(w, http.StatusMethodNotAllowed, "Mutations must be sent with POST")
+		return
+	}
+
+	declared := map[string]bool{}
+	for _, def := range op.Variables {
+		declared[def.Name] = true
+	}
+	if err := validateSelections(graphQLRootTypes[op.Kind], op.Selections, declared); err != nil {
+		graphQLRequestError(w, http.StatusBadRequest, "Validation error: %v", err)
+		return
+	}
+
+	writeGraphQL(w, http.StatusOK, executeGraphQL(r, *op, req.Variables))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLexGraphQL(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []gqlToken
+	}{
+		{`{ id }`, []gqlToken{{'{', "{", 0}, {'n', "id", 2}, {'}', "}", 5}, {pos: 6}}},
+		{`"a\"b\\cé\n"`, []gqlToken{{'s', "a\"b\\cé\n", 0}, {pos: 13}}},
+		{`-12 3.5 1e3 0.25E-2`, []gqlToken{{'0', "-12", 0}, {'0', "3.5", 4}, {'0', "1e3", 8}, {'0', "0.25E-2", 12}, {pos: 19}}},
+		{"# comment, { ignored }\nx, # trailing\r\ny", []gqlToken{{'n', "x", 23}, {'n', "y", 38}, {pos: 39}}},
+		{"\ufeff...", []gqlToken{{'.', "...", 3}, {pos: 6}}},
+	}
+	for _, tt := range tests {
+		got, err := lexGraphQL(tt.src)
+		if err != nil {
+			t.Errorf("lexGraphQL(%q): %v", tt.src, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lexGraphQL(%q) = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseGraphQLErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`{ id `, "unexpected end of document"},
+		{`{ id ) }`, `unexpected ")" at offset 5`},
+		{`{ "x" }`, `unexpected "x" at offset 2`},
+		{`query { a(x: 01) }`, `invalid number "01" at offset 13`},
+		{`{ a(x: "abc`, "unterminated string at offset 7"},
+		{`{ a(x: "\q") }`, "invalid string at offset 7"},
+		{`{ a(x: """b""") }`, "block strings are not supported (offset 7)"},
+		{`{ ...frag }`, "fragments are not supported (offset 2)"},
+		{`{ a @skip }`, "directives are not supported (offset 4)"},
+		{`subscription { a }`, "subscriptions are not supported (offset 0)"},
+		{`query ($v: Int = $w) { a }`, "variable not allowed in a default value (offset 17)"},
+		{`{ a ? }`, "unexpected character '?' at offset 4"},
+		{`{ }`, "empty selection set"},
+		{``, "document holds no operation"},
+	}
+	for _, tt := range tests {
+		_, err := parseGraphQL(tt.src)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseGraphQL(%q) error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestParseGraphQLDepth(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"list value", "mutation { segment(image: " + strings.Repeat("[", 1<<16) + ") { id } }"},
+		{"object value", "mutation { segment(options: " + strings.Repeat("{a: ", 1000) + "1" + strings.Repeat("}", 1000) + ") { id } }"},
+		{"selection set", strings.Repeat("{ a ", 1000) + strings.Repeat("}", 1000)},
+		{"list type", "query ($v: " + strings.Repeat("[", 1000) + "Int" + strings.Repeat("]", 1000) + ") { a }"},
+	}
+	for _, tt := range tests {
+		_, err := parseGraphQL(tt.src)
+		if err == nil || !strings.Contains(err.Error(), "nested deeper than") {
+			t.Errorf("%s: error = %v, want the nesting limit", tt.name, err)
+		}
+	}
+
+	// Nesting up to the limit is still accepted
+	src := "mutation { segment(options: {a: " + strings.Repeat("[", maxGraphQLDepth-3) + strings.Repeat("]", maxGraphQLDepth-3) + "}) { id } }"
+	if _, err := parseGraphQL(src); err != nil {
+		t.Errorf("nesting at the limit: %v", err)
+	}
+}
+
+func TestParseGraphQLOperation(t *testing.T) {
+	ops, err := parseGraphQL(`
+		query Lookup($id: String!, $ids: [String!] = ["a", "b"], $n: Int = 3) {
+			first: result(id: $id) { id stored: segmented { url } }
+			result(id: "x", extra: {k: [1, true, null, ENUM]}) { __typename }
+		}
+		mutation { segment(image: "data:") { id } }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 2 || ops[0].Kind != "query" || ops[0].Name != "Lookup" || ops[1].Kind != "mutation" {
+		t.Fatalf("operations = %+v", ops)
+	}
+
+	wantVars := []gqlVariableDef{
+		{Name: "id", NonNull: true},
+		{Name: "ids", Default: []interface{}{"a", "b"}, HasDefault: true},
+		{Name: "n", Default: json.Number("3"), HasDefault: true},
+	}
+	if !reflect.DeepEqual(ops[0].Variables, wantVars) {
+		t.Errorf("variables = %+v, want %+v", ops[0].Variables, wantVars)
+	}
+
+	first := ops[0].Selections[0]
+	if first.key() != "first" || first.Name != "result" || first.Args["id"] != gqlVariable("id") {
+		t.Errorf("aliased field = %+v", first)
+	}
+	if nested := first.Selections[1]; nested.key() != "stored" || nested.Name != "segmented" {
+		t.Errorf("aliased subfield = %+v", nested)
+	}
+	wantExtra := map[string]interface{}{"k": []interface{}{json.Number("1"), true, nil, "ENUM"}}
+	if second := ops[0].Selections[1]; second.key() != "result" || !reflect.DeepEqual(second.Args["extra"], wantExtra) {
+		t.Errorf("unaliased field = %+v", second)
+	}
+}
+
+func TestValidateSelections(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`query ($id: String) { result(id: $id) { id original { url } } }`, ""},
+		{`{ nope }`, `cannot query field "nope" on type Query (offset 2)`},
+		{`{ result(id: "x") { id bogus } }`, `cannot query field "bogus" on type Result (offset 23)`},
+		{`{ result(key: "x") { id } }`, `unknown argument "key" on field Query.result`},
+		{`{ result(id: $missing) { id } }`, "variable $missing is not defined"},
+		{`{ result(id: "x") }`, "needs a selection of subfields"},
+		{`{ result(id: "x") { id { url } } }`, "is a scalar and takes no selections"},
+		{`{ __typename(x: 1) }`, "__typename takes no arguments or selections"},
+	}
+	for _, tt := range tests {
+		ops, err := parseGraphQL(tt.src)
+		if err != nil {
+			t.Fatalf("parseGraphQL(%q): %v", tt.src, err)
+		}
+		declared := map[string]bool{}
+		for _, def := range ops[0].Variables {
+			declared[def.Name] = true
+		}
+		err = validateSelections(graphQLRootTypes[ops[0].Kind], ops[0].Selections, declared)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%q: %v", tt.src, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%q: error = %v, want %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+// postGraphQL sends a GraphQL request body to graphQLHandler
+func postGraphQL(t *testing.T, body string) (int, graphQLResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	graphQLHandler(rec, httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(body)))
+	var resp struct {
+		Data   map[string]interface{} `json:"data"`
+		Errors []graphQLError         `json:"errors"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, graphQLResponse{Errors: resp.Errors}
+}
+
+func TestGraphQLHandler(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+		code   string
+	}{
+		{
+			name:   "callback_url",
+			body:   `{"query": "mutation ($o: Options) { segment(image: \"data:image/png;base64,\", options: $o) { id } }", "variables": {"o": {"callback_url": "https://example.com/hook"}}}`,
+			status: http.StatusOK,
+			want:   `option "callback_url" is not supported by the segment mutation`,
+			code:   codeInvalidParameters.name,
+		},
+		{
+			name:   "deep nesting",
+			body:   `{"query": "{ result(id: ` + strings.Repeat("[", 4096) + `) { id } }"}`,
+			status: http.StatusBadRequest,
+			want:   "Syntax error: document nested deeper than 32 levels",
+		},
+		{
+			name:   "query size",
+			body:   `{"query": "{ __typename ` + strings.Repeat(" ", maxGraphQLQueryBytes) + `}"}`,
+			status: http.StatusRequestEntityTooLarge,
+			want:   "exceeds the limit",
+		},
+		{
+			name:   "unknown field",
+			body:   `{"query": "{ nope }"}`,
+			status: http.StatusBadRequest,
+			want:   `Validation error: cannot query field "nope" on type Query`,
+		},
+		{
+			name:   "missing variable",
+			body:   `{"query": "query ($id: String!) { result(id: $id) { id } }"}`,
+			status: http.StatusOK,
+			want:   "variable $id of non-null type was not provided",
+		},
+	}
+	for _, tt := range tests {
+		status, resp := postGraphQL(t, tt.body)
+		if status != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, status, tt.status)
+		}
+		if len(resp.Errors) != 1 || !strings.Contains(resp.Errors[0].Message, tt.want) {
+			t.Errorf("%s: errors = %+v, want %q", tt.name, resp.Errors, tt.want)
+			continue
+		}
+		if tt.code != "" && resp.Errors[0].Extensions["code"] != tt.code {
+			t.Errorf("%s: code = %q, want %q", tt.name, resp.Errors[0].Extensions["code"], tt.code)
+		}
+	}
+}
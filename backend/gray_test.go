@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestIntensityGray(t *testing.T) {
+	for v := 0; v < 256; v++ {
+		gray := color.Gray{uint8(v)}
+		rgba := color.RGBA{uint8(v), uint8(v), uint8(v), 255}
+		for _, channel := range []string{channelLuma, channelRed, channelGreen, channelBlue} {
+			got, want := intensity(gray, channel), uint32(v)*0x101
+			if got != want {
+				t.Fatalf("intensity(Gray{%d}, %s) = %#x, want %#x", v, channel, got, want)
+			}
+			if rgb := intensity(rgba, channel); rgb != got {
+				t.Fatalf("intensity(Gray{%d}, %s) = %#x, but the equivalent RGBA gives %#x", v, channel, got, rgb)
+			}
+		}
+	}
+}
+
+func TestIntensityGray16(t *testing.T) {
+	// Values that differ only in the low byte must not collapse together
+	for _, v := range []uint16{0, 0x00ff, 0x7fff, 0x8000, 0x8001, 0x80ff, 0xfffe, 0xffff} {
+		for _, channel := range []string{channelLuma, channelRed, channelGreen, channelBlue} {
+			if got := intensity(color.Gray16{v}, channel); got != uint32(v) {
+				t.Errorf("intensity(Gray16{%#x}, %s) = %#x, want %#x", v, channel, got, v)
+			}
+		}
+	}
+}
+
+func TestThresholdGray(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 16, 16))
+	rgba := image.NewRGBA(gray.Bounds())
+	for i := range gray.Pix {
+		v := uint8(i)
+		gray.Pix[i] = v
+		rgba.SetRGBA(i%16, i/16, color.RGBA{v, v, v, 255})
+	}
+
+	params := defaultSegmentParams()
+	got, err := foregroundMask(context.Background(), gray, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := foregroundMask(context.Background(), rgba, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("pixel %d (level %d): gray mask %v, RGBA mask %v", i, i, got[i], want[i])
+		}
+		if got[i] != (i >= 128) {
+			t.Fatalf("pixel %d (level %d): foreground %v with threshold 128", i, i, got[i])
+		}
+	}
+}
+
+func TestThresholdGray16(t *testing.T) {
+	// Every row holds levels just below, at and just above 0x8000, which an
+	// 8-bit round trip would all map to 0x8080
+	img := image.NewGray16(image.Rect(0, 0, 8, 8))
+	levels := []uint16{0, 0x7f00, 0x7fff, 0x8000, 0x8001, 0x8040, 0xff00, 0xffff}
+	for y := 0; y < 8; y++ {
+		for x, v := range levels {
+			img.SetGray16(x, y, color.Gray16{v})
+		}
+	}
+
+	for _, rotate := range []int{0, 90, 180, 270} {
+		params := defaultSegmentParams()
+		params.Rotate = rotate
+		processed, err := preprocessImage(img, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := processed.(*image.Gray16); !ok {
+			t.Errorf("rotate %d: preprocessing returned %T, want *image.Gray16", rotate, processed)
+		}
+
+		mask, err := foregroundMask(context.Background(), processed, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for _, fg := range mask {
+			if fg {
+				count++
+			}
+		}
+		// 0x8001, 0x8040, 0xff00 and 0xffff are above 128<<8 in all 8 rows
+		if count != 4*8 {
+			t.Errorf("rotate %d: %d foreground pixels, want %d", rotate, count, 4*8)
+		}
+	}
+}
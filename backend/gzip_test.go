@@ -0,0 +1,67 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// flushRecorder records how much of the body had reached the client at
+// every flush
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushed = append(r.flushed, r.Body.Len())
+	r.ResponseRecorder.Flush()
+}
+
+func TestCompressedStreamsFlushes(t *testing.T) {
+	chunks := []string{`{"part":1}`, `{"part":2}`}
+	for _, contentType := range []string{"application/json", "image/png"} {
+		handler := compressed(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			stream := &flushWriter{w: w, rc: http.NewResponseController(w)}
+			for _, chunk := range chunks {
+				if _, err := stream.Write([]byte(chunk)); err != nil {
+					t.Errorf("%s: %v", contentType, err)
+				}
+			}
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Errorf("%s: flush: %v", contentType, err)
+			}
+		})
+
+		rec := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+		r := httptest.NewRequest(http.MethodPost, "/api/segment", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		handler(rec, r)
+
+		// Every write must reach the client before the handler returns
+		if len(rec.flushed) < len(chunks) || rec.flushed[0] == 0 {
+			t.Fatalf("%s: flushed %v, want a non-empty flush per write", contentType, rec.flushed)
+		}
+
+		body := io.Reader(rec.Body)
+		if rec.Header().Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%s: %v", contentType, err)
+			}
+			body = zr
+		} else if contentType == "application/json" {
+			t.Errorf("%s: response was not gzipped", contentType)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatalf("%s: %v", contentType, err)
+		}
+		if string(data) != chunks[0]+chunks[1] {
+			t.Errorf("%s: body %q", contentType, data)
+		}
+	}
+}
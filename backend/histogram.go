@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+)
+
+// histogramResponse is the JSON body of the histogram endpoint
+type histogramResponse struct {
+	Histogram     [256]int `json:"histogram"`
+	Total         int      `json:"total"`
+	Mean          float64  `json:"mean"`
+	Median        int      `json:"median"`
+	OtsuThreshold int      `json:"otsu_threshold"`
+	Warnings      []string `json:"warnings,omitempty"`
+}
+
+// levelHistogram counts the pixels at each gray level
+func levelHistogram(levels []uint8) [256]int {
+	var hist [256]int
+	for _, v := range levels {
+		hist[v]++
+	}
+	return hist
+}
+
+// histogramMedian returns the lowest level at or below which at least half
+// of the pixels lie
+func histogramMedian(hist [256]int, total int) int {
+	seen := 0
+	for level, count := range hist {
+		seen += count
+		if 2*seen >= total {
+			return level
+		}
+	}
+	return 255
+}
+
+// otsuThreshold returns the level t maximizing the between-class variance
+// of the pixels at or below t and the pixels above it, so that t can be
+// used directly as the threshold field
+func otsuThreshold(hist [256]int, total int) int {
+	sumAll := 0.0
+	for level, count := range hist {
+		sumAll += float64(level * count)
+	}
+
+	best, bestVariance := 0, -1.0
+	sumBelow, countBelow := 0.0, 0
+	for t := 0; t < 255; t++ {
+		countBelow += hist[t]
+		sumBelow += float64(t * hist[t])
+		countAbove := total - countBelow
+		if countBelow == 0 || countAbove == 0 {
+			continue
+		}
+
+		meanBelow := sumBelow / float64(countBelow)
+		meanAbove := (sumAll - sumBelow) / float64(countAbove)
+		variance := float64(countBelow) * float64(countAbove) * (meanBelow - meanAbove) * (meanBelow - meanAbove)
+		if variance > bestVariance {
+			best, bestVariance = t, variance
+		}
+	}
+	return best
+}
+
+// histogramHandler returns the 256-bin histogram of the selected channel of
+// an uploaded image with its mean, median and Otsu threshold. The channel
+// and preprocessing fields of /api/upload apply.
+func histogramHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse multipart form with 10MB max memory
+	err := parseLimitedMultipartForm(r, 10<<20)
+	if errors.Is(err, errFormLimit) {
+		writeError(w, r, codeFormLimit, "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Unable to parse form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// The body has been read: only the processing holds a worker
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	file, handler, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, r, codeMissingImage, "Error retrieving file")
+		return
+	}
+	defer file.Close()
+
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+
+	var result Result
+	img, err := decodeInput(file, handler.Filename, params.decodeOptions(), &result)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeDecodeFailed), "Error decoding image: "+err.Error())
+		return
+	}
+	img, err = preprocessImage(img, params)
+	if isInvalidInput(err) {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeInternal, "Error processing image: "+err.Error())
+		return
+	}
+
+	levels := grayLevels(img, params.Channel)
+	hist := levelHistogram(levels)
+	total := len(levels)
+
+	sum := 0
+	for level, count := range hist {
+		sum += level * count
+	}
+
+	writeJSON(w, r, histogramResponse{
+		Histogram:     hist,
+		Total:         total,
+		Mean:          math.Round(100*float64(sum)/float64(total)) / 100,
+		Median:        histogramMedian(hist, total),
+		OtsuThreshold: otsuThreshold(hist, total),
+		Warnings:      result.Warnings,
+	})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"image"
+)
+
+// grayLevels returns the 8-bit value of the selected channel of every pixel
+// in row-major order
+func grayLevels(img image.Image, channel string) []uint8 {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	levels := make([]uint8, width*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			levels[(y-bounds.Min.Y)*width+(x-bounds.Min.X)] = uint8(intensity(img.At(x, y), channel) >> 8)
+		}
+	}
+
+	return levels
+}
+
+// hysteresisMask binarizes an image with two thresholds. Pixels above high
+// are foreground, as they are above the threshold of binary mode, pixels
+// below low are background, and pixels from low to high are foreground only
+// if they are connected to a foreground pixel, through edges only with
+// connectivity 4 or also through corners with 8.
+func hysteresisMask(ctx context.Context, img image.Image, channel string, low uint8, high uint8, connectivity int) ([]bool, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	levels := grayLevels(img, channel)
+	foreground := make([]bool, len(levels))
+
+	// Seed the flood fill with all strong pixels
+	stack := make([]int, 0, len(levels)/4)
+	for i, v := range levels {
+		if v > high {
+			foreground[i] = true
+			stack = append(stack, i)
+		}
+	}
+
+	// Grow the strong regions into connected weak pixels
+	for popped := 0; len(stack) > 0; popped++ {
+		if popped%width == 0 {
+			if err := canceled(ctx); err != nil {
+				return nil, err
+			}
+		}
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		x, y := i%width, i/width
+
+		for _, d := range neighborOffsets(connectivity) {
+			nx, ny := x+d.X, y+d.Y
+			if nx < 0 || ny < 0 || nx >= width || ny >= height {
+				continue
+			}
+			n := ny*width + nx
+			if !foreground[n] && levels[n] >= low {
+				foreground[n] = true
+				stack = append(stack, n)
+			}
+		}
+	}
+
+	return foreground, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestHysteresisMaskBoundaries(t *testing.T) {
+	// Isolated pixels around 128 and a weak pixel next to a strong one
+	levels := []uint8{127, 0, 128, 0, 129, 0, 128, 200}
+	img := image.NewGray(image.Rect(0, 0, len(levels), 1))
+	copy(img.Pix, levels)
+
+	tests := []struct {
+		low, high uint8
+		want      []bool
+	}{
+		{128, 128, []bool{false, false, false, false, true, false, true, true}},
+		{127, 128, []bool{false, false, false, false, true, false, true, true}},
+		{128, 129, []bool{false, false, false, false, false, false, true, true}},
+		{0, 255, []bool{false, false, false, false, false, false, false, false}},
+	}
+	for _, tt := range tests {
+		got, err := hysteresisMask(context.Background(), img, channelLuma, tt.low, tt.high, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("low %d, high %d: mask = %v, want %v", tt.low, tt.high, got, tt.want)
+		}
+	}
+
+	// With low = high every pixel is decided like the binary threshold
+	for _, level := range []uint8{0, 127, 128, 129, 200, 255} {
+		params := defaultSegmentParams()
+		params.Threshold = level
+		binary, err := thresholdMask(context.Background(), img, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		params.Hysteresis, params.Low, params.High = true, level, level
+		hysteresis, err := thresholdMask(context.Background(), img, params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Only weak pixels touching a strong one may differ
+		for i := range levels {
+			if levels[i] != level && binary[i] != hysteresis[i] {
+				t.Errorf("level %d, pixel %d (%d): binary %v, hysteresis %v", level, i, levels[i], binary[i], hysteresis[i])
+			}
+		}
+	}
+}
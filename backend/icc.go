@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// maxICCProfileBytes caps the size of an embedded profile that is parsed
+const maxICCProfileBytes = 4 << 20
+
+// iccLUTSize is the resolution of the decoding and encoding lookup tables
+const iccLUTSize = 4096
+
+// xyzToLinearSRGB converts D50 XYZ, the profile connection space, to linear
+// sRGB (Bradford-adapted, from Lindbloom)
+var xyzToLinearSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// iccProfile is an RGB matrix/TRC profile: a tone curve per channel to
+// linear light, then a matrix to D50 XYZ
+type iccProfile struct {
+	description string
+	toXYZ       [3][3]float64
+	curves      [3]func(float64) float64
+}
+
+// readICCProfile returns the ICC profile embedded in a PNG (iCCP chunk) or
+// JPEG (APP2 ICC_PROFILE segments) file, or nil when there is none
+func readICCProfile(data []byte, path string) []byte {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return readPNGProfile(data)
+	case ".jpg", ".jpeg":
+		return readJPEGProfile(data)
+	default:
+		return nil
+	}
+}
+
+func readPNGProfile(data []byte) []byte {
+	if len(data) < 8 || string(data[1:4]) != "PNG" {
+		return nil
+	}
+	for p := 8; p+8 <= len(data); {
+		n := int(binary.BigEndian.Uint32(data[p:]))
+		typ := string(data[p+4 : p+8])
+		if n < 0 || p+12+n > len(data) || typ == "IDAT" || typ == "IEND" {
+			return nil
+		}
+		if typ == "iCCP" {
+			// Profile name, NUL, compression method (always zlib), profile
+			chunk := data[p+8 : p+8+n]
+			i := bytes.IndexByte(chunk, 0)
+			if i < 0 || i+2 > len(chunk) {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(chunk[i+2:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(io.LimitReader(zr, maxICCProfileBytes))
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+		p += 12 + n
+	}
+	return nil
+}
+
+func readJPEGProfile(data []byte) []byte {
+	const signature = "ICC_PROFILE\x00"
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+
+	// Large profiles are split over several segments numbered from 1
+	chunks := map[int][]byte{}
+	for p := 2; p+4 <= len(data) && data[p] == 0xff; {
+		marker := data[p+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(data[p+2:]))
+		if n < 2 || p+2+n > len(data) {
+			break
+		}
+		segment := data[p+4 : p+2+n]
+		if marker == 0xe2 && len(segment) > len(signature)+2 && string(segment[:len(signature)]) == signature {
+			chunks[int(segment[len(signature)])] = segment[len(signature)+2:]
+		}
+		p += 2 + n
+	}
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	seqs := make([]int, 0, len(chunks))
+	for seq := range chunks {
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	var profile []byte
+	for _, seq := range seqs {
+		profile = append(profile, chunks[seq]...)
+	}
+	return profile
+}
+
+// parseICCProfile reads an RGB matrix/TRC profile. Other profiles, such as
+// CMYK, grayscale or LUT-only ones, are returned as errors naming what was
+// found.
+func parseICCProfile(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, fmt.Errorf("malformed profile")
+	}
+	if space := string(data[16:20]); space != "RGB " {
+		return nil, fmt.Errorf("%s profile", strings.TrimSpace(space))
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count && 132+12*(i+1) <= len(data); i++ {
+		entry := data[132+12*i:]
+		offset, size := binary.BigEndian.Uint32(entry[4:]), binary.BigEndian.Uint32(entry[8:])
+		if uint64(offset)+uint64(size) <= uint64(len(data)) {
+			tags[string(entry[:4])] = data[offset : offset+size]
+		}
+	}
+
+	profile := &iccProfile{description: iccDescription(tags["desc"])}
+	for c, name := range []string{"r", "g", "b"} {
+		xyz, ok := parseXYZTag(tags[name+"XYZ"])
+		if !ok {
+			return nil, fmt.Errorf("profile without RGB colorant matrix")
+		}
+		for row := range xyz {
+			profile.toXYZ[row][c] = xyz[row]
+		}
+		curve, ok := parseCurveTag(tags[name+"TRC"])
+		if !ok {
+			return nil, fmt.Errorf("profile with unsupported tone curve")
+		}
+		profile.curves[c] = curve
+	}
+	return profile, nil
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+func parseXYZTag(tag []byte) ([3]float64, bool) {
+	if len(tag) < 20 || string(tag[:4]) != "XYZ " {
+		return [3]float64{}, false
+	}
+	return [3]float64{s15Fixed16(tag[8:]), s15Fixed16(tag[12:]), s15Fixed16(tag[16:])}, true
+}
+
+// parseCurveTag reads a curv or para tone curve as a function from encoded
+// to linear values in [0, 1]
+func parseCurveTag(tag []byte) (func(float64) float64, bool) {
+	if len(tag) < 12 {
+		return nil, false
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		switch {
+		case n == 0:
+			return func(x float64) float64 { return x }, true
+		case n == 1 && len(tag) >= 14:
+			gamma := float64(binary.BigEndian.Uint16(tag[12:])) / 256
+			return func(x float64) float64 { return math.Pow(x, gamma) }, true
+		case n > 1 && len(tag) >= 12+2*n:
+			table := make([]float64, n)
+			for i := range table {
+				table[i] = float64(binary.BigEndian.Uint16(tag[12+2*i:])) / 65535
+			}
+			return func(x float64) float64 {
+				pos := x * float64(n-1)
+				i := min(int(pos), n-2)
+				return table[i] + (pos-float64(i))*(table[i+1]-table[i])
+			}, true
+		}
+	case "para":
+		kind := binary.BigEndian.Uint16(tag[8:])
+		counts := []int{1, 3, 4, 5, 7}
+		if int(kind) >= len(counts) || len(tag) < 12+4*counts[kind] {
+			return nil, false
+		}
+		var p [7]float64
+		for i := 0; i < counts[kind]; i++ {
+			p[i] = s15Fixed16(tag[12+4*i:])
+		}
+		g, a, b, c, d, e, f := p[0], p[1], p[2], p[3], p[4], p[5], p[6]
+		pow := func(x float64) float64 { return math.Pow(math.Max(a*x+b, 0), g) }
+		switch kind {
+		case 0:
+			return func(x float64) float64 { return math.Pow(x, g) }, true
+		case 1:
+			return func(x float64) float64 { return pow(x) }, true
+		case 2:
+			return func(x float64) float64 { return pow(x) + c }, true
+		case 3:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(x)
+				}
+				return c * x
+			}, true
+		case 4:
+			return func(x float64) float64 {
+				if x >= d {
+					return pow(x) + e
+				}
+				return c*x + f
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// iccDescription reads the profile description from a desc (ICC v2) or
+// mluc (ICC v4) tag, or returns "" if it has neither
+func iccDescription(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if n > 0 && 12+n <= len(tag) {
+			return strings.TrimRight(string(tag[12:12+n]), "\x00")
+		}
+	case "mluc":
+		if len(tag) < 28 {
+			return ""
+		}
+		n, offset := int(binary.BigEndian.Uint32(tag[20:])), int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+n > len(tag) {
+			return ""
+		}
+		units := make([]uint16, n/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+2*i:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
+
+// toSRGB returns the matrix from the profile's linear RGB to linear sRGB
+func (p *iccProfile) toSRGB() [3][3]float64 {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzToLinearSRGB[i][k] * p.toXYZ[k][j]
+			}
+		}
+	}
+	return m
+}
+
+// isSRGB reports whether converting with the profile would leave colors
+// practically unchanged, as for the sRGB profiles most software embeds
+func (p *iccProfile) isSRGB() bool {
+	m := p.toSRGB()
+	for i := range m {
+		for j := range m[i] {
+			want := 0.0
+			if i == j {
+				want = 1
+			}
+			if math.Abs(m[i][j]-want) > 0.01 {
+				return false
+			}
+		}
+	}
+	for _, curve := range p.curves {
+		for x := 0.0; x <= 1; x += 0.125 {
+			if math.Abs(curve(x)-srgbToLinear(x)) > 0.004 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func srgbToLinear(v float64) float64 {
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) float64 {
+	if v <= 0.0031308 {
+		return 12.92 * v
+	}
+	return 1.055*math.Pow(v, 1/2.4) - 0.055
+}
+
+// convertToSRGB converts the colors of img from the profile's color space
+// to sRGB, keeping alpha
+func convertToSRGB(img image.Image, p *iccProfile) *image.NRGBA {
+	var decode [3][iccLUTSize]float64
+	for c, curve := range p.curves {
+		for i := range decode[c] {
+			decode[c][i] = curve(float64(i) / (iccLUTSize - 1))
+		}
+	}
+	var encode [iccLUTSize]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(255 * linearToSRGB(float64(i)/(iccLUTSize-1))))
+	}
+	m := p.toSRGB()
+
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			lin := [3]float64{
+				decode[0][(int(c.R)*(iccLUTSize-1)+0x7fff)/0xffff],
+				decode[1][(int(c.G)*(iccLUTSize-1)+0x7fff)/0xffff],
+				decode[2][(int(c.B)*(iccLUTSize-1)+0x7fff)/0xffff],
+			}
+			var rgb [3]uint8
+			for i := range rgb {
+				v := m[i][0]*lin[0] + m[i][1]*lin[1] + m[i][2]*lin[2]
+				rgb[i] = encode[int(math.Round(math.Min(math.Max(v, 0), 1)*(iccLUTSize-1)))]
+			}
+			out.SetNRGBA(x, y, color.NRGBA{rgb[0], rgb[1], rgb[2], uint8(c.A >> 8)})
+		}
+	}
+	return out
+}
+
+// applyICCProfile converts img to sRGB when the file it was decoded from
+// embeds an RGB matrix/TRC profile other than sRGB, and warns about
+// profiles that cannot be applied. Grayscale images are left alone.
+func applyICCProfile(img image.Image, data []byte, path string, result *Result) image.Image {
+	raw := readICCProfile(data, path)
+	if raw == nil {
+		return img
+	}
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return img
+	}
+
+	profile, err := parseICCProfile(raw)
+	if err != nil {
+		result.warn("image has an embedded ICC profile that was ignored (%v); colors may be inaccurate", err)
+		return img
+	}
+	if profile.isSRGB() {
+		return img
+	}
+
+	name := profile.description
+	if name == "" {
+		name = "unnamed"
+	}
+	result.warn("image colors were converted from its embedded ICC profile (%s) to sRGB", name)
+	return convertToSRGB(img, profile)
+}
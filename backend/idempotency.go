@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyEntry is the outcome of a request made with an Idempotency-Key:
+// its result, or the callback job it was accepted as. Both are nil while
+// the request is still being processed.
+type idempotencyEntry struct {
+	result  *Result
+	job     *callbackJob
+	expires time.Time
+}
+
+// done reports whether the request of e has finished
+func (e *idempotencyEntry) done() bool {
+	return e.result != nil || e.job != nil
+}
+
+// idempotencyCache remembers the results of uploads by Idempotency-Key so
+// that client retries return the original result instead of reprocessing
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+}
+
+var idempotencyKeys = &idempotencyCache{entries: make(map[string]*idempotencyEntry)}
+
+// begin claims key for a new request. If the key was already used it
+// returns the cached outcome, or inFlight if that request has not finished.
+func (c *idempotencyCache) begin(key string, ttl time.Duration) (cached *idempotencyEntry, inFlight bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if e.done() && now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	if e, ok := c.entries[key]; ok {
+		if !e.done() {
+			return nil, true
+		}
+		return e, false
+	}
+
+	c.entries[key] = &idempotencyEntry{expires: now.Add(ttl)}
+	return nil, false
+}
+
+// finish stores the result for key, keeping it until the TTL expires
+func (c *idempotencyCache) finish(key string, result Result, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = &idempotencyEntry{result: &result, expires: time.Now().Add(ttl)}
+}
+
+// accept stores the callback job key's request was accepted as, keeping it
+// until the TTL expires
+func (c *idempotencyCache) accept(key string, job callbackJob, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = &idempotencyEntry{job: &job, expires: time.Now().Add(ttl)}
+}
+
+// abort releases key after a failed request so that a retry is processed again
+func (c *idempotencyCache) abort(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok && !e.done() {
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+// integralImage is a summed-area table over a row-major grid of values.
+// Any rectangular window sum is answered in constant time.
+type integralImage struct {
+	width  int
+	height int
+
+	// table holds the total of the values above and to the left of each
+	// position, exclusive, with a zero row and column in front
+	table []float64
+}
+
+// newIntegralImage builds the summed-area table of values laid out in rows
+// of width entries, transformed by f (nil for the identity)
+func newIntegralImage(values []uint8, width int, height int, f func(float64) float64) *integralImage {
+	stride := width + 1
+	table := make([]float64, stride*(height+1))
+
+	for y := 0; y < height; y++ {
+		rowSum := 0.0
+		for x := 0; x < width; x++ {
+			v := float64(values[y*width+x])
+			if f != nil {
+				v = f(v)
+			}
+			rowSum += v
+			table[(y+1)*stride+x+1] = table[y*stride+x+1] + rowSum
+		}
+	}
+
+	return &integralImage{width: width, height: height, table: table}
+}
+
+// load recomputes the table in place from values laid out in rows of
+// width entries, so one table can be reused across many passes
+func (ii *integralImage) load(values []float64) {
+	stride := ii.width + 1
+	for y := 0; y < ii.height; y++ {
+		rowSum := 0.0
+		for x := 0; x < ii.width; x++ {
+			rowSum += values[y*ii.width+x]
+			ii.table[(y+1)*stride+x+1] = ii.table[y*stride+x+1] + rowSum
+		}
+	}
+}
+
+// sum returns the total over the half-open window [x0, x1) x [y0, y1),
+// clipped to the grid
+func (ii *integralImage) sum(x0 int, y0 int, x1 int, y1 int) float64 {
+	x0, x1 = clampInt(x0, 0, ii.width), clampInt(x1, 0, ii.width)
+	y0, y1 = clampInt(y0, 0, ii.height), clampInt(y1, 0, ii.height)
+	if x0 >= x1 || y0 >= y1 {
+		return 0
+	}
+
+	stride := ii.width + 1
+	return ii.table[y1*stride+x1] - ii.table[y0*stride+x1] - ii.table[y1*stride+x0] + ii.table[y0*stride+x0]
+}
+
+// window returns the clipped bounds and pixel count of the square window
+// of side 2*half+1 centered on (x, y)
+func (ii *integralImage) window(x int, y int, half int) (x0 int, y0 int, x1 int, y1 int, n int) {
+	x0, x1 = clampInt(x-half, 0, ii.width), clampInt(x+half+1, 0, ii.width)
+	y0, y1 = clampInt(y-half, 0, ii.height), clampInt(y+half+1, 0, ii.height)
+	return x0, y0, x1, y1, (x1 - x0) * (y1 - y0)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// bruteForceSum adds up the clipped window [x0, x1) x [y0, y1) directly
+func bruteForceSum(values []uint8, width int, height int, x0 int, y0 int, x1 int, y1 int, f func(float64) float64) float64 {
+	total := 0.0
+	for y := max(y0, 0); y < min(y1, height); y++ {
+		for x := max(x0, 0); x < min(x1, width); x++ {
+			v := float64(values[y*width+x])
+			if f != nil {
+				v = f(v)
+			}
+			total += v
+		}
+	}
+	return total
+}
+
+func TestIntegralImageSum(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	square := func(v float64) float64 { return v * v }
+
+	for _, size := range [][2]int{{1, 1}, {1, 9}, {7, 1}, {13, 8}, {64, 33}} {
+		width, height := size[0], size[1]
+		values := make([]uint8, width*height)
+		for i := range values {
+			values[i] = uint8(rng.Intn(256))
+		}
+
+		for _, f := range []func(float64) float64{nil, square} {
+			ii := newIntegralImage(values, width, height, f)
+
+			// Windows may extend past the grid on any side, or be empty
+			for i := 0; i < 500; i++ {
+				x0, x1 := rng.Intn(width+6)-3, rng.Intn(width+6)-3
+				y0, y1 := rng.Intn(height+6)-3, rng.Intn(height+6)-3
+				got := ii.sum(x0, y0, x1, y1)
+				want := bruteForceSum(values, width, height, x0, y0, x1, y1, f)
+				if got != want {
+					t.Fatalf("%dx%d: sum(%d, %d, %d, %d) = %v, want %v", width, height, x0, y0, x1, y1, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestIntegralImageWindow(t *testing.T) {
+	values := make([]uint8, 10*6)
+	for i := range values {
+		values[i] = 1
+	}
+	ii := newIntegralImage(values, 10, 6, nil)
+
+	tests := []struct {
+		x, y, half int
+		want       int
+	}{
+		{5, 3, 0, 1},
+		{5, 3, 1, 9},
+		{0, 0, 1, 4},
+		{9, 5, 2, 9},
+		{5, 3, 20, 60},
+	}
+	for _, tt := range tests {
+		x0, y0, x1, y1, n := ii.window(tt.x, tt.y, tt.half)
+		if n != tt.want {
+			t.Errorf("window(%d, %d, %d) has %d pixels, want %d", tt.x, tt.y, tt.half, n, tt.want)
+		}
+		if sum := ii.sum(x0, y0, x1, y1); sum != float64(n) {
+			t.Errorf("window(%d, %d, %d) sums to %v, want %d", tt.x, tt.y, tt.half, sum, n)
+		}
+	}
+}
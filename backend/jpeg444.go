@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+)
+
+// JPEG chroma subsampling choices
+const (
+	jpegSubsampling420 = "420"
+	jpegSubsampling444 = "444"
+)
+
+// jpegQuality is the quality every JPEG output is encoded at
+const jpegQuality = 90
+
+// The standard library encoder always halves the chroma resolution of color
+// images (4:2:0) and has no option to turn that off, so 4:4:4 output is
+// written by the small baseline encoder below. It uses the same quantization
+// and Huffman tables as the standard library, from Annex K of the JPEG
+// specification.
+
+// jpegZigzag maps the zig-zag position of a coefficient to its index in
+// the 8x8 block in natural order
+var jpegZigzag = [64]int{
+	0, 1, 8, 16, 9, 2, 3, 10,
+	17, 24, 32, 25, 18, 11, 4, 5,
+	12, 19, 26, 33, 40, 48, 41, 34,
+	27, 20, 13, 6, 7, 14, 21, 28,
+	35, 42, 49, 56, 57, 50, 43, 36,
+	29, 22, 15, 23, 30, 37, 44, 51,
+	58, 59, 52, 45, 38, 31, 39, 46,
+	53, 60, 61, 54, 47, 55, 62, 63,
+}
+
+// jpegQuantTables are the unscaled luminance and chrominance quantization
+// tables in zig-zag order
+var jpegQuantTables = [2][64]int{
+	{
+		16, 11, 12, 14, 12, 10, 16, 14,
+		13, 14, 18, 17, 16, 19, 24, 40,
+		26, 24, 22, 22, 24, 49, 35, 37,
+		29, 40, 58, 51, 61, 60, 57, 51,
+		56, 55, 64, 72, 92, 78, 64, 68,
+		87, 69, 55, 56, 80, 109, 81, 87,
+		95, 98, 103, 104, 103, 62, 77, 113,
+		121, 112, 100, 120, 92, 101, 103, 99,
+	},
+	{
+		17, 18, 18, 24, 21, 24, 47, 26,
+		26, 47, 99, 66, 56, 66, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+		99, 99, 99, 99, 99, 99, 99, 99,
+	},
+}
+
+// huffmanSpec is a Huffman table as stored in a DHT segment: the number of
+// codes of each length from 1 to 16 bits and the symbols in code order
+type huffmanSpec struct {
+	counts  [16]byte
+	symbols []byte
+}
+
+// jpegHuffmanSpecs are the luminance DC, luminance AC, chrominance DC and
+// chrominance AC tables
+var jpegHuffmanSpecs = [4]huffmanSpec{
+	{
+		[16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 125},
+		[]byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+			0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+			0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+			0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+			0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+			0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+			0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+			0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+			0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+			0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+			0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+	{
+		[16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+		[]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+	},
+	{
+		[16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 119},
+		[]byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+			0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+			0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+			0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+			0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+			0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+			0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+			0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+			0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+			0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+			0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		},
+	},
+}
+
+// huffmanCode is the code and bit length a symbol is written with
+type huffmanCode struct {
+	code   uint32
+	length uint
+}
+
+// codes assigns the canonical Huffman codes of a table to its symbols
+func (s huffmanSpec) codes() [256]huffmanCode {
+	var codes [256]huffmanCode
+	code, k := uint32(0), 0
+	for length, count := range s.counts {
+		for i := 0; i < int(count); i++ {
+			codes[s.symbols[k]] = huffmanCode{code, uint(length + 1)}
+			code++
+			k++
+		}
+		code <<= 1
+	}
+	return codes
+}
+
+// dctCos holds C(u)/2 * cos((2x+1)uπ/16) for the forward DCT
+var dctCos = func() [8][8]float64 {
+	var t [8][8]float64
+	for u := 0; u < 8; u++ {
+		c := 0.5
+		if u == 0 {
+			c = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			t[u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return t
+}()
+
+// encodeJPEG writes img as a baseline JPEG, without chroma subsampling when
+// subsampling is jpegSubsampling444. Grayscale images have no chroma and are
+// always written by the standard library.
+func encodeJPEG(w io.Writer, img image.Image, subsampling string) error {
+	if _, gray := img.(*image.Gray); gray || subsampling != jpegSubsampling444 {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: jpegQuality})
+	}
+	return encodeJPEG444(w, img)
+}
+
+// jpegWriter writes the entropy-coded segment of a JPEG bit by bit
+type jpegWriter struct {
+	w     *bufio.Writer
+	bits  uint32
+	nBits uint
+	err   error
+}
+
+// writeBits appends the low n bits of v, stuffing a zero byte after every
+// 0xff byte as the format requires
+func (e *jpegWriter) writeBits(v uint32, n uint) {
+	e.bits = e.bits<<n | v&(1<<n-1)
+	e.nBits += n
+	for e.nBits >= 8 {
+		b := byte(e.bits >> (e.nBits - 8))
+		e.writeByte(b)
+		if b == 0xff {
+			e.writeByte(0)
+		}
+		e.nBits -= 8
+	}
+	e.bits &= 1<<e.nBits - 1
+}
+
+func (e *jpegWriter) writeByte(b byte) {
+	if e.err == nil {
+		e.err = e.w.WriteByte(b)
+	}
+}
+
+func (e *jpegWriter) write(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+// writeMarker writes a marker segment with its length prefix
+func (e *jpegWriter) writeMarker(marker byte, payload []byte) {
+	n := len(payload) + 2
+	e.write([]byte{0xff, marker, byte(n >> 8), byte(n)})
+	e.write(payload)
+}
+
+// encodeJPEG444 writes img as a three-component baseline JPEG with every
+// component at full resolution
+func encodeJPEG444(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	e := &jpegWriter{w: bufio.NewWriter(w)}
+
+	// Quality scaling as in libjpeg and the standard library
+	scale := 200 - 2*jpegQuality
+	if jpegQuality < 50 {
+		scale = 5000 / jpegQuality
+	}
+	var quant [2][64]float64
+	dqt := []byte{}
+	for t, table := range jpegQuantTables {
+		dqt = append(dqt, byte(t))
+		for k, q := range table {
+			q = min(max((q*scale+50)/100, 1), 255)
+			quant[t][k] = float64(q)
+			dqt = append(dqt, byte(q))
+		}
+	}
+
+	e.write([]byte{0xff, 0xd8})
+	e.writeMarker(0xdb, dqt)
+	e.writeMarker(0xc0, []byte{
+		8, byte(height >> 8), byte(height), byte(width >> 8), byte(width), 3,
+		1, 0x11, 0, 2, 0x11, 1, 3, 0x11, 1,
+	})
+	dht := []byte{}
+	for i, class := range []byte{0x00, 0x10, 0x01, 0x11} {
+		dht = append(dht, class)
+		dht = append(dht, jpegHuffmanSpecs[i].counts[:]...)
+		dht = append(dht, jpegHuffmanSpecs[i].symbols...)
+	}
+	e.writeMarker(0xc4, dht)
+	e.writeMarker(0xda, []byte{3, 1, 0x00, 2, 0x11, 3, 0x11, 0, 63, 0})
+
+	var codes [4][256]huffmanCode
+	for i, spec := range jpegHuffmanSpecs {
+		codes[i] = spec.codes()
+	}
+
+	var blocks [3][64]float64
+	var prevDC [3]int
+	for by := 0; by < height; by += 8 {
+		for bx := 0; bx < width; bx += 8 {
+			// Blocks past the edge of the image repeat its last row and column
+			for i := 0; i < 64; i++ {
+				x := bounds.Min.X + min(bx+i%8, width-1)
+				y := bounds.Min.Y + min(by+i/8, height-1)
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				yy, cb, cr := color.RGBToYCbCr(c.R, c.G, c.B)
+				blocks[0][i] = float64(yy) - 128
+				blocks[1][i] = float64(cb) - 128
+				blocks[2][i] = float64(cr) - 128
+			}
+			for c := range blocks {
+				t := 0
+				if c > 0 {
+					t = 1
+				}
+				prevDC[c] = e.writeBlock(&blocks[c], &quant[t], prevDC[c], &codes[2*t], &codes[2*t+1])
+			}
+		}
+	}
+
+	// Pad the last byte with one bits, then end the image
+	e.writeBits(0x7f, 7)
+	e.write([]byte{0xff, 0xd9})
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// writeBlock transforms, quantizes and entropy codes one 8x8 block of
+// level-shifted samples and returns its DC coefficient
+func (e *jpegWriter) writeBlock(block *[64]float64, quant *[64]float64, prevDC int, dc *[256]huffmanCode, ac *[256]huffmanCode) int {
+	// Separable forward DCT: rows, then columns
+	var rows, coef [64]float64
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			var s float64
+			for x := 0; x < 8; x++ {
+				s += dctCos[u][x] * block[y*8+x]
+			}
+			rows[y*8+u] = s
+		}
+	}
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			var s float64
+			for y := 0; y < 8; y++ {
+				s += dctCos[v][y] * rows[y*8+u]
+			}
+			coef[v*8+u] = s
+		}
+	}
+
+	var q [64]int
+	for k := 0; k < 64; k++ {
+		q[k] = int(math.Round(coef[jpegZigzag[k]] / quant[k]))
+	}
+
+	e.writeValue(dc, 0, q[0]-prevDC)
+	run := 0
+	for k := 1; k < 64; k++ {
+		if q[k] == 0 {
+			run++
+			continue
+		}
+		for run > 15 {
+			e.writeBits(ac[0xf0].code, ac[0xf0].length)
+			run -= 16
+		}
+		e.writeValue(ac, run, q[k])
+		run = 0
+	}
+	if run > 0 {
+		e.writeBits(ac[0x00].code, ac[0x00].length)
+	}
+	return q[0]
+}
+
+// writeValue writes the Huffman code of a zero run and the size category
+// of v, followed by the bits of v (one's complement when negative)
+func (e *jpegWriter) writeValue(codes *[256]huffmanCode, run int, v int) {
+	magnitude, bits := v, v
+	if v < 0 {
+		magnitude, bits = -v, v-1
+	}
+	size := uint(0)
+	for magnitude > 0 {
+		size++
+		magnitude >>= 1
+	}
+	h := codes[run<<4|int(size)]
+	e.writeBits(h.code, h.length)
+	if size > 0 {
+		e.writeBits(uint32(bits), size)
+	}
+}
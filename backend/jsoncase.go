@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// JSON field casings for responses
+const (
+	caseSnake = "snake"
+	caseCamel = "camel"
+)
+
+// responseCase returns the JSON field casing for a request. A client can
+// override the server default with an Accept parameter such as
+// "application/json; case=camel".
+func responseCase(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || (mediaType != "application/json" && mediaType != "*/*") {
+			continue
+		}
+		if c := params["case"]; c == caseSnake || c == caseCamel {
+			return c
+		}
+	}
+	return config.JSONCase
+}
+
+// marshalJSON encodes v with the struct tags' snake_case field names, then
+// rewrites every object key to camelCase if requested
+func marshalJSON(v interface{}, fieldCase string) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || fieldCase != caseCamel {
+		return data, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var generic interface{}
+	if err := dec.Decode(&generic); err != nil {
+		return nil, err
+	}
+	return json.Marshal(camelCaseKeys(generic))
+}
+
+// camelCaseKeys recursively renames the object keys in a decoded JSON value
+func camelCaseKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			renamed[snakeToCamel(key)] = camelCaseKeys(value)
+		}
+		return renamed
+	case []interface{}:
+		for i, value := range v {
+			v[i] = camelCaseKeys(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// snakeToCamel converts a snake_case name such as "segmented_image" to "segmentedImage"
+func snakeToCamel(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
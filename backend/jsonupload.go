@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxJSONImageBytes caps the decoded size of an image sent as base64 JSON
+const maxJSONImageBytes = 10 << 20
+
+// dataURIExtensions maps the media types accepted in data URIs to the file
+// extension that selects the decoder
+var dataURIExtensions = map[string]string{
+	"image/png":                ".png",
+	"image/jpeg":               ".jpg",
+	"image/gif":                ".gif",
+	"image/x-portable-bitmap":  ".pbm",
+	"image/x-portable-graymap": ".pgm",
+	"image/x-portable-pixmap":  ".ppm",
+	"image/x-portable-anymap":  ".pnm",
+}
+
+// decodeDataURI decodes a base64 data URI such as data:image/png;base64,...
+// and returns the media type and the decoded bytes
+func decodeDataURI(uri string) (string, []byte, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok || !strings.HasPrefix(uri, "data:") {
+		return "", nil, errors.New("image is not a data URI")
+	}
+
+	mediaType, encoding, _ := strings.Cut(header, ";")
+	if encoding != "base64" {
+		return "", nil, errors.New("data URI must be base64 encoded")
+	}
+	if base64.StdEncoding.DecodedLen(len(payload)) > maxJSONImageBytes+2 {
+		return "", nil, fmt.Errorf("image exceeds %d bytes", maxJSONImageBytes)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid base64 data: %v", err)
+	}
+	if len(data) > maxJSONImageBytes {
+		return "", nil, fmt.Errorf("image exceeds %d bytes", maxJSONImageBytes)
+	}
+	return strings.ToLower(mediaType), data, nil
+}
+
+// jsonFormValues flattens the scalar fields of a JSON upload into form
+// values, so the options are parsed exactly like multipart fields. Arrays of
+// scalars are joined with commas, as in cutoffs, and a params object is
+// kept as JSON for parseSegmentParams.
+func jsonFormValues(fields map[string]json.RawMessage) (url.Values, error) {
+	form := url.Values{}
+	for name, raw := range fields {
+		if name == "image" {
+			continue
+		}
+
+		// Numbers keep their text so that 64-bit seeds survive
+		d := json.NewDecoder(bytes.NewReader(raw))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		if _, ok := v.(map[string]interface{}); ok && name == "params" {
+			form.Set(name, string(raw))
+			continue
+		}
+		if items, ok := v.([]interface{}); ok {
+			parts := make([]string, len(items))
+			for i, item := range items {
+				s, ok := jsonScalar(item)
+				if !ok {
+					return nil, fmt.Errorf("field %q must only hold strings, numbers or booleans", name)
+				}
+				parts[i] = s
+			}
+			form.Set(name, strings.Join(parts, ","))
+			continue
+		}
+		s, ok := jsonScalar(v)
+		if !ok {
+			return nil, fmt.Errorf("field %q must be a string, number or boolean", name)
+		}
+		form.Set(name, s)
+	}
+	return form, nil
+}
+
+// jsonScalar formats a decoded JSON string, number or boolean like the form
+// value it stands for
+func jsonScalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// jsonUploadHandler accepts an upload as a JSON object whose image field is
+// a base64 data URI and whose other fields are the /api/upload options,
+// then runs the same pipeline as uploadHandler
+func jsonUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Base64 inflates the image by 4/3; leave room for the other fields
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONImageBytes*4/3+64<<10)
+
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		writeError(w, r, codeMalformedRequest, "Invalid JSON body: "+err.Error())
+		return
+	}
+
+	upload, ok := decodeJSONUpload(w, r, fields)
+	if !ok {
+		return
+	}
+	// A background job waits for a worker of its own
+	if upload.opts.CallbackURL != "" {
+		submitCallbackJob(w, r, bytes.NewReader(upload.data), upload.filename, upload.params, upload.opts)
+		return
+	}
+
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	result, ok := storeAndSegment(w, r, bytes.NewReader(upload.data), int64(len(upload.data)), upload.filename, upload.params, upload.opts)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+// jsonUpload is the image and options of a decoded JSON upload
+type jsonUpload struct {
+	data     []byte
+	filename string
+	params   SegmentParams
+	opts     uploadOptions
+}
+
+// segmentJSONUpload stores and segments the image of a decoded JSON upload
+// with the options in its other fields, which must not ask for a callback.
+// On failure it writes the error response and returns false.
+func segmentJSONUpload(w http.ResponseWriter, r *http.Request, fields map[string]json.RawMessage) (Result, bool) {
+	upload, ok := decodeJSONUpload(w, r, fields)
+	if !ok {
+		return Result{}, false
+	}
+	return storeAndSegment(w, r, bytes.NewReader(upload.data), int64(len(upload.data)), upload.filename, upload.params, upload.opts)
+}
+
+// decodeJSONUpload decodes the image of a JSON upload and parses the options
+// in its other fields. On failure it writes the error response and returns
+// false.
+func decodeJSONUpload(w http.ResponseWriter, r *http.Request, fields map[string]json.RawMessage) (jsonUpload, bool) {
+	var uri string
+	if err := json.Unmarshal(fields["image"], &uri); err != nil || uri == "" {
+		writeError(w, r, codeInvalidParameters, "Invalid parameters: image must be a data URI string")
+		return jsonUpload{}, false
+	}
+	mediaType, data, err := decodeDataURI(uri)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return jsonUpload{}, false
+	}
+	ext, ok := dataURIExtensions[mediaType]
+	if !ok {
+		writeError(w, r, codeUnsupportedFormat, fmt.Sprintf("Invalid parameters: unsupported image type %q", mediaType))
+		return jsonUpload{}, false
+	}
+
+	if r.Form, err = jsonFormValues(fields); err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return jsonUpload{}, false
+	}
+
+	// The extension of the name always follows the data URI's media type
+	filename := "upload"
+	if v := filepath.Base(r.Form.Get("filename")); v != "." && v != string(filepath.Separator) {
+		filename = strings.TrimSuffix(v, filepath.Ext(v))
+	}
+	filename += ext
+
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return jsonUpload{}, false
+	}
+	opts, err := parseUploadOptions(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return jsonUpload{}, false
+	}
+
+	return jsonUpload{data, filename, params, opts}, true
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// kmeansIterations bounds the number of Lloyd iterations
+const kmeansIterations = 20
+
+// errTooManyClusters is returned when k leaves fewer pixels per cluster
+// than KMEANS_MIN_CLUSTER_PIXELS
+var errTooManyClusters = errors.New("too many clusters for the image size")
+
+// kmeansClusters is the outcome of clustering pixel colors
+type kmeansClusters struct {
+	centers [][3]float64 // cluster centers in 8-bit RGB
+	counts  []int        // number of pixels in each cluster
+	labels  []int        // cluster of each pixel
+}
+
+// imagePixels returns the 8-bit RGB values of every pixel in row-major order
+func imagePixels(img image.Image) [][3]float64 {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	pixels := make([][3]float64, width*bounds.Dy())
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			pixels[(y-bounds.Min.Y)*width+(x-bounds.Min.X)] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+		}
+	}
+
+	return pixels
+}
+
+func colorDistSq(a [3]float64, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return dr*dr + dg*dg + db*db
+}
+
+// kmeansPlusPlus picks k initial centers, each chosen with probability
+// proportional to its squared distance from the centers picked so far
+func kmeansPlusPlus(pixels [][3]float64, k int, rng *rand.Rand) [][3]float64 {
+	centers := [][3]float64{pixels[rng.Intn(len(pixels))]}
+	dist := make([]float64, len(pixels))
+	for i, p := range pixels {
+		dist[i] = colorDistSq(p, centers[0])
+	}
+
+	for len(centers) < k {
+		total := 0.0
+		for _, d := range dist {
+			total += d
+		}
+
+		next := rng.Intn(len(pixels))
+		if total > 0 {
+			target := rng.Float64() * total
+			for i, d := range dist {
+				if target -= d; target <= 0 {
+					next = i
+					break
+				}
+			}
+		}
+		centers = append(centers, pixels[next])
+
+		for i, p := range pixels {
+			dist[i] = math.Min(dist[i], colorDistSq(p, pixels[next]))
+		}
+	}
+
+	return centers
+}
+
+// kmeansPartial holds one worker's share of an assignment step
+type kmeansPartial struct {
+	sums    [][3]float64
+	counts  []int
+	changed int
+}
+
+// kmeansCluster groups pixel colors into k clusters with Lloyd's algorithm.
+// The assignment step is split across workers, each handling a contiguous
+// range of pixels and accumulating partial sums that are merged afterwards
+// to update the centers. Cancellation is checked between iterations.
+func kmeansCluster(ctx context.Context, pixels [][3]float64, k int, workers int, rng *rand.Rand) (kmeansClusters, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(pixels) {
+		workers = len(pixels)
+	}
+
+	centers := kmeansPlusPlus(pixels, k, rng)
+	labels := make([]int, len(pixels))
+	for i := range labels {
+		labels[i] = -1
+	}
+	counts := make([]int, k)
+
+	chunk := (len(pixels) + workers - 1) / workers
+	for iter := 0; iter < kmeansIterations; iter++ {
+		if err := canceled(ctx); err != nil {
+			return kmeansClusters{}, err
+		}
+		partials := make([]kmeansPartial, workers)
+		var wg sync.WaitGroup
+
+		for w := 0; w < workers; w++ {
+			start, end := w*chunk, (w+1)*chunk
+			if end > len(pixels) {
+				end = len(pixels)
+			}
+
+			wg.Add(1)
+			go func(part *kmeansPartial, start int, end int) {
+				defer wg.Done()
+				part.sums = make([][3]float64, k)
+				part.counts = make([]int, k)
+
+				for i := start; i < end; i++ {
+					best, bestDist := 0, math.Inf(1)
+					for c, center := range centers {
+						if d := colorDistSq(pixels[i], center); d < bestDist {
+							best, bestDist = c, d
+						}
+					}
+					if labels[i] != best {
+						labels[i] = best
+						part.changed++
+					}
+					part.sums[best][0] += pixels[i][0]
+					part.sums[best][1] += pixels[i][1]
+					part.sums[best][2] += pixels[i][2]
+					part.counts[best]++
+				}
+			}(&partials[w], start, end)
+		}
+		wg.Wait()
+
+		// Merge the partial sums and move each center to its cluster mean
+		changed := 0
+		for c := range centers {
+			var sum [3]float64
+			counts[c] = 0
+			for _, part := range partials {
+				sum[0] += part.sums[c][0]
+				sum[1] += part.sums[c][1]
+				sum[2] += part.sums[c][2]
+				counts[c] += part.counts[c]
+			}
+			if counts[c] == 0 {
+				// Restart an empty cluster from a random pixel
+				centers[c] = pixels[rng.Intn(len(pixels))]
+				continue
+			}
+			n := float64(counts[c])
+			centers[c] = [3]float64{sum[0] / n, sum[1] / n, sum[2] / n}
+		}
+		for _, part := range partials {
+			changed += part.changed
+		}
+
+		if changed == 0 {
+			break
+		}
+	}
+
+	return kmeansClusters{centers: centers, counts: counts, labels: labels}, nil
+}
+
+func init() {
+	registerMode(modeKMeans, "Every pixel painted with the center of its k-means color cluster", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		pixels := imagePixels(img)
+		k, err := fitClusterCount(pixels, params.K, result)
+		if err != nil {
+			return nil, err
+		}
+		return kmeansSegment(ctx, img, pixels, k, config.KMeansWorkers, modeRand(params, result))
+	}))
+}
+
+// countDistinctColors returns the number of different colors among pixels,
+// counting no further than limit
+func countDistinctColors(pixels [][3]float64, limit int) int {
+	seen := map[[3]float64]bool{}
+	for _, p := range pixels {
+		if seen[p] {
+			continue
+		}
+		if seen[p] = true; len(seen) >= limit {
+			break
+		}
+	}
+	return len(seen)
+}
+
+// fitClusterCount returns the k to cluster pixels with: k itself, or the
+// number of distinct colors with a warning when there are fewer, since
+// the extra clusters would stay empty. A k leaving fewer pixels per
+// cluster than KMEANS_MIN_CLUSTER_PIXELS is rejected.
+func fitClusterCount(pixels [][3]float64, k int, result *Result) (int, error) {
+	if min := config.KMeansMinClusterPixels; min > 0 && k*min > len(pixels) {
+		err := fmt.Errorf("%w: k=%d needs at least %d pixels (%d per cluster), the image has %d",
+			errTooManyClusters, k, k*min, min, len(pixels))
+		if most := len(pixels) / min; most >= 2 {
+			err = fmt.Errorf("%w; use k=%d or less", err, most)
+		}
+		return 0, err
+	}
+	if n := countDistinctColors(pixels, k); n < k {
+		result.warn("the image has only %d distinct colors; k was reduced from %d to %d", n, k, n)
+		return n, nil
+	}
+	return k, nil
+}
+
+// kmeansSegment paints every pixel of img, whose colors are pixels, with
+// the center of its color cluster.
+// The output is paletted, the index of a pixel being its cluster.
+func kmeansSegment(ctx context.Context, img image.Image, pixels [][3]float64, k int, workers int, rng *rand.Rand) (image.Image, error) {
+	clusters, err := kmeansCluster(ctx, pixels, k, workers, rng)
+	if err != nil {
+		return nil, err
+	}
+
+	palette := make([]color.RGBA, len(clusters.centers))
+	for c, center := range clusters.centers {
+		palette[c] = color.RGBA{
+			uint8(math.Round(center[0])), uint8(math.Round(center[1])), uint8(math.Round(center[2])), 255,
+		}
+	}
+
+	return labelImage(img.Bounds(), clusters.labels, palette), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Colors of the text drawn on output images
+var (
+	labelColor      = color.RGBA{255, 255, 255, 255}
+	labelBackground = color.RGBA{0, 0, 0, 160}
+)
+
+// labelFont is a 5x7 bitmap font covering the digits and the letters of
+// the panel labels
+var labelFont = map[rune][7]string{
+	'0': {".###.", "#...#", "#..##", "#.#.#", "##..#", "#...#", ".###."},
+	'1': {"..#..", ".##..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'2': {".###.", "#...#", "....#", "...#.", "..#..", ".#...", "#####"},
+	'3': {"####.", "....#", "....#", ".###.", "....#", "....#", "####."},
+	'4': {"...#.", "..##.", ".#.#.", "#..#.", "#####", "...#.", "...#."},
+	'5': {"#####", "#....", "####.", "....#", "....#", "#...#", ".###."},
+	'6': {".###.", "#....", "#....", "####.", "#...#", "#...#", ".###."},
+	'7': {"#####", "....#", "...#.", "..#..", ".#...", ".#...", ".#..."},
+	'8': {".###.", "#...#", "#...#", ".###.", "#...#", "#...#", ".###."},
+	'9': {".###.", "#...#", "#...#", ".####", "....#", "....#", ".###."},
+	'A': {".###.", "#...#", "#...#", "#####", "#...#", "#...#", "#...#"},
+	'G': {".###.", "#...#", "#....", "#.###", "#...#", "#...#", ".###."},
+	'I': {".###.", "..#..", "..#..", "..#..", "..#..", "..#..", ".###."},
+	'K': {"#...#", "#..#.", "#.#..", "##...", "#.#..", "#..#.", "#...#"},
+	'L': {"#....", "#....", "#....", "#....", "#....", "#....", "#####"},
+	'M': {"#...#", "##.##", "#.#.#", "#.#.#", "#...#", "#...#", "#...#"},
+	'N': {"#...#", "##..#", "#.#.#", "#..##", "#...#", "#...#", "#...#"},
+	'O': {".###.", "#...#", "#...#", "#...#", "#...#", "#...#", ".###."},
+	'R': {"####.", "#...#", "#...#", "####.", "#.#..", "#..#.", "#...#"},
+	'S': {".####", "#....", "#....", ".###.", "....#", "....#", "####."},
+}
+
+// drawLabel writes text with its top-left corner at p on a translucent box,
+// each font pixel drawn as a scale x scale square. Labels that do not fit
+// are clipped.
+func drawLabel(img *image.RGBA, p image.Point, text string, scale int) {
+	pad := scale
+	advance := 6 * scale
+	box := image.Rect(p.X, p.Y, p.X+len(text)*advance-scale+2*pad, p.Y+7*scale+2*pad)
+	draw.Draw(img, box.Intersect(img.Bounds()), image.NewUniform(labelBackground), image.Point{}, draw.Over)
+
+	for i, ch := range text {
+		glyph := labelFont[ch]
+		for row, line := range glyph {
+			for col, bit := range line {
+				if bit != '#' {
+					continue
+				}
+				x := p.X + pad + i*advance + col*scale
+				y := p.Y + pad + row*scale
+				dot := image.Rect(x, y, x+scale, y+scale).Intersect(img.Bounds())
+				draw.Draw(img, dot, image.NewUniform(labelColor), image.Point{}, draw.Src)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Log levels
+const (
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+)
+
+// infof prints a message at the info log level, which is always enabled
+func infof(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+// debugf prints a message when the debug log level is enabled
+func debugf(format string, args ...interface{}) {
+	if config.LogLevel == logLevelDebug {
+		fmt.Printf("[debug] "+format+"\n", args...)
+	}
+}
+
+// stageTimer records how long each stage of the segmentation pipeline takes
+type stageTimer struct {
+	last      time.Time
+	stages    []string
+	durations []time.Duration
+}
+
+func newStageTimer() *stageTimer {
+	return &stageTimer{last: time.Now()}
+}
+
+// mark records the time elapsed since the previous mark under the given stage name
+func (t *stageTimer) mark(stage string) {
+	now := time.Now()
+	t.stages = append(t.stages, stage)
+	t.durations = append(t.durations, now.Sub(t.last))
+	t.last = now
+}
+
+func (t *stageTimer) String() string {
+	parts := make([]string, len(t.stages))
+	for i, stage := range t.stages {
+		parts[i] = fmt.Sprintf("%s=%s", stage, t.durations[i])
+	}
+	return strings.Join(parts, " ")
+}
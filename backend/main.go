@@ -1,31 +1,84 @@
 package main
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// uploadsDir is where originals and segmentation results are stored
+const uploadsDir = "uploads"
+
 // Result represents the segmentation result
 type Result struct {
-	OriginalImage  string `json:"original_image"`
-	SegmentedImage string `json:"segmented_image"`
-	Message        string `json:"message"`
+	ID             string       `json:"id,omitempty"`
+	OriginalImage  string       `json:"original_image,omitempty"`
+	SegmentedImage string       `json:"segmented_image,omitempty"`
+	Message        string       `json:"message"`
+	Contours       [][]Point    `json:"contours,omitempty"`
+	Warnings       []string     `json:"warnings,omitempty"`
+	Seed           *int64       `json:"seed,omitempty"`
+	BlobCount      *int         `json:"blob_count,omitempty"`
+	Blobs          []Blob       `json:"blobs,omitempty"`
+	Stats          *MaskStats   `json:"stats,omitempty"`
+	Regions        []Region     `json:"regions,omitempty"`
+	RLE            *MaskRLE     `json:"rle,omitempty"`
+	AutoCrop       *BoundingBox `json:"autocrop,omitempty"`
+	Preview        bool         `json:"preview,omitempty"`
+	PreviewStep    int          `json:"preview_step,omitempty"`
+	FaceRegions    []FaceRegion `json:"face_regions,omitempty"`
+
+	ThresholdOverlays []ThresholdOverlay `json:"threshold_overlays,omitempty"`
+
+	// taggedFaces are the face regions found in the metadata of the
+	// decoded image
+	taggedFaces []FaceRegion
+
+	// overlays are the images of ThresholdOverlays, in the same order,
+	// until they are stored
+	overlays []image.Image
+
+	// svg is the vector document rendered by contours mode for svg
+	// output, stored or sent instead of a raster image
+	svg []byte
+}
+
+// warn records a non-fatal notice for the client
+func (r *Result) warn(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
 }
 
+// enableCORS lets browsers on other origins call the API. With credentials
+// enabled, only the configured origins are allowed, each echoed back on its
+// own since browsers refuse credentials with a wildcard; requests from
+// other origins get no CORS headers and are blocked by the browser.
 func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		if origin, ok := allowedOrigin(r.Header.Get("Origin")); ok {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		if config.CORSCredentials {
+			w.Header().Add("Vary", "Origin")
+			if w.Header().Get("Access-Control-Allow-Origin") != "" {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, HEAD, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key, Upload-ID, Upload-Length, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, X-Queue-Depth, Retry-After")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -36,53 +89,358 @@ func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// performImageSegmentation performs basic image segmentation
-func performImageSegmentation(inputPath string, outputPath string) error {
-	// Open the input file
-	file, err := os.Open(inputPath)
-	if err != nil {
-		return fmt.Errorf("error opening image: %v", err)
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request
+// from origin, or false when that origin is not allowed
+func allowedOrigin(origin string) (string, bool) {
+	for _, allowed := range config.CORSOrigins {
+		switch {
+		case allowed == "*":
+			return "*", true
+		case origin != "" && strings.EqualFold(allowed, origin):
+			return origin, true
+		}
 	}
-	defer file.Close()
+	return "", false
+}
 
-	// Decode the image
-	var img image.Image
-	var decodeErr error
+// errUnsupportedInput is returned for an upload that is in none of the
+// formats the server can decode
+var errUnsupportedInput = errors.New("unsupported image format")
 
-	if strings.HasSuffix(strings.ToLower(inputPath), ".png") {
-		img, decodeErr = png.Decode(file)
-	} else {
-		img, decodeErr = jpeg.Decode(file)
+// decodeImage decodes an image based on the file extension of path
+func decodeImage(r io.Reader, path string) (image.Image, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".png":
+		return png.Decode(r)
+	case ".gif":
+		return gif.Decode(r)
+	case ".pbm", ".pgm", ".ppm", ".pnm":
+		return decodeNetpbm(r)
+	case ".jpg", ".jpeg":
+		return jpeg.Decode(r)
+	default:
+		// Other names, including names without an extension, are tried as JPEG
+		img, err := jpeg.Decode(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %v", errUnsupportedInput, ext, err)
+		}
+		return img, nil
 	}
+}
 
-	if decodeErr != nil {
-		return fmt.Errorf("error decoding image: %v", decodeErr)
+// decodeImageConfig reads the dimensions of an image without decoding it,
+// based on the file extension of path
+func decodeImageConfig(r io.Reader, path string) (image.Config, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		return png.DecodeConfig(r)
+	case ".gif":
+		return gif.DecodeConfig(r)
+	case ".pbm", ".pgm", ".ppm", ".pnm":
+		return decodeNetpbmConfig(r)
+	default:
+		return jpeg.DecodeConfig(r)
 	}
+}
 
-	// Get image bounds
-	bounds := img.Bounds()
-	// width := bounds.Max.X - bounds.Min.X
-	// height := bounds.Max.Y - bounds.Min.Y
+// decodeOptions are the decoder settings a request can change
+type decodeOptions struct {
+	// BestEffort decodes truncated JPEGs as far as their data goes,
+	// filling the missing rows with Fill, instead of rejecting them
+	BestEffort bool
+	Fill       color.RGBA
+}
 
-	// Create a new RGBA image
-	segmented := image.NewRGBA(bounds)
+// decodeInput decodes an uploaded image and records a warning in result
+// when part of the input is discarded, such as extra GIF frames, or
+// missing. Colors are converted to sRGB when the file embeds a different
+// ICC profile. The format is detected from the content, the extension of
+// path only being used for content that is not recognized.
+func decodeInput(r io.Reader, path string, opts decodeOptions, result *Result) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if format := sniffFormat(data); format != "" {
+		path = strings.TrimSuffix(path, filepath.Ext(path)) + "." + format
+	}
 
-	// Simple thresholding for segmentation
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			pixel := img.At(x, y)
-			r, g, b, _ := color.RGBAModel.Convert(pixel).RGBA()
-			
-			// Calculate grayscale value
-			gray := (r + g + b) / 3
-			
-			// Simple threshold
-			if gray > 32768 { // 32768 is middle value (65535/2)
-				segmented.Set(x, y, color.RGBA{255, 255, 255, 255}) // White
+	if !isGIF(path) {
+		img, err := decodeImage(bytes.NewReader(data), path)
+		if err != nil && opts.BestEffort && sniffFormat(data) == "jpg" {
+			partial, missing, perr := decodePartialJPEG(data, opts.Fill)
+			if perr != nil {
+				return nil, err
+			}
+			if height := partial.Bounds().Dy(); missing < height {
+				result.warn("image data is incomplete (%v); rows %d to %d were filled with #%02x%02x%02x",
+					err, missing, height-1, opts.Fill.R, opts.Fill.G, opts.Fill.B)
 			} else {
-				segmented.Set(x, y, color.RGBA{0, 0, 0, 255}) // Black
+				result.warn("image data is incomplete (%v); it was decoded as far as it goes", err)
 			}
+			img, err = partial, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if xmp := readXMP(data, path); xmp != nil {
+			result.taggedFaces = parseFaceRegions(xmp, img.Bounds())
+		}
+		return applyICCProfile(img, data, path, result), nil
+	}
+
+	// Only the first frame is decoded; the others are merely counted
+	frames, _, err := scanGIFFrames(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if frames > 1 {
+		result.warn("animated GIF has %d frames; only the first frame was segmented", frames)
+	}
+	return img, nil
+}
+
+// encodeOptions are the encoder settings a request can change
+type encodeOptions struct {
+	// JPEGSubsampling is the chroma subsampling of JPEG output,
+	// jpegSubsampling420 or jpegSubsampling444
+	JPEGSubsampling string
+
+	// PNGText are the tEXt chunks written into PNG output
+	PNGText []pngText
+}
+
+// encodeImage encodes an image based on the file extension of path
+func encodeImage(w io.Writer, img image.Image, path string, opts encodeOptions) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".png":
+		if len(opts.PNGText) > 0 {
+			w = newPNGTextWriter(w, opts.PNGText)
 		}
+		return png.Encode(w, img)
+	case ".gif":
+		return gif.Encode(w, img, nil)
+	case ".pbm", ".pgm", ".ppm", ".pnm":
+		return encodeNetpbm(w, img, path)
+	case ".jpg", ".jpeg":
+		return encodeJPEG(w, img, opts.JPEGSubsampling)
+	default:
+		return fmt.Errorf("%w %q", errUnsupportedOutput, filepath.Ext(path))
+	}
+}
+
+// intensity returns the 16-bit value of the selected channel of a pixel.
+// Luma is the mean of the red, green and blue channels. Gray pixels have the
+// same value in every channel, which is read directly so that 16-bit levels
+// are not rounded through an 8-bit color.
+func intensity(pixel color.Color, channel string) uint32 {
+	switch c := pixel.(type) {
+	case color.Gray:
+		return uint32(c.Y) * 0x101
+	case color.Gray16:
+		return uint32(c.Y)
+	}
+
+	r, g, b, _ := pixel.RGBA()
+	switch channel {
+	case channelRed:
+		return r
+	case channelGreen:
+		return g
+	case channelBlue:
+		return b
+	default:
+		return (r + g + b) / 3
+	}
+}
+
+// foregroundMask thresholds an image into a row-major foreground mask and
+// despeckles it
+func foregroundMask(ctx context.Context, img image.Image, params SegmentParams) ([]bool, error) {
+	mask, err := thresholdMask(ctx, img, params)
+	if err != nil {
+		return nil, err
+	}
+	despeckle(mask, img.Bounds().Dx(), img.Bounds().Dy(), params.Despeckle, params.Connectivity)
+	return mask, nil
+}
+
+// thresholdMask marks the pixels above the threshold, or selected by
+// hysteresis, as foreground
+func thresholdMask(ctx context.Context, img image.Image, params SegmentParams) ([]bool, error) {
+	if params.Hysteresis {
+		return hysteresisMask(ctx, img, params.Channel, params.Low, params.High, params.Connectivity)
+	}
+
+	return pixelBackend().Threshold(ctx, img, params.Channel, params.Threshold)
+}
+
+// maskImage renders a row-major foreground mask as a black and white image
+func maskImage(bounds image.Rectangle, mask []bool) *image.RGBA {
+	return pixelBackend().RenderMask(bounds, mask)
+}
+
+func init() {
+	registerMode(modeBinary, "Black and white mask of the pixels above threshold, or selected by low/high hysteresis", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		return thresholdImage(ctx, img, params)
+	}))
+}
+
+// thresholdImage converts an image into a black and white mask
+func thresholdImage(ctx context.Context, img image.Image, params SegmentParams) (*image.RGBA, error) {
+	mask, err := foregroundMask(ctx, img, params)
+	if err != nil {
+		return nil, err
+	}
+	return maskImage(img.Bounds(), mask), nil
+}
+
+// segmentDecodedImage preprocesses a decoded image and runs the selected
+// mode on it under the watchdog. It returns a nil image for modes that only
+// fill in result.
+func segmentDecodedImage(ctx context.Context, img image.Image, params SegmentParams, result *Result, timer *stageTimer) (image.Image, error) {
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		c := params.Background
+		result.warn("image has transparency; transparent pixels were composited over #%02x%02x%02x", c.R, c.G, c.B)
+	}
+
+	img, err := preprocessImage(img, params)
+	if err != nil {
+		return nil, err
+	}
+	if params.Preview {
+		result.Preview, result.PreviewStep = true, params.PreviewStep
+	}
+	if err := checkAspectRatio(img.Bounds()); err != nil {
+		result.warn("%v; local windows are limited by the shorter side", err)
+	}
+	full := img
+	if params.ROI != nil {
+		if img, err = cropROI(full, *params.ROI); err != nil {
+			return nil, err
+		}
+	}
+	timer.mark("preprocess")
+
+	// The mode writes to a copy of result so that a segmentation abandoned
+	// by the watchdog cannot race with the handler
+	scratch := *result
+	scratch.Warnings = append([]string(nil), result.Warnings...)
+
+	var segmented image.Image
+	err = runWithWatchdog(ctx, params.Mode+" segmentation", config.SegmentTimeout, func(ctx context.Context) error {
+		var err error
+		if params.Faces {
+			segmented, err = segmentFaces(ctx, img, params, &scratch)
+			return err
+		}
+		if segmented, err = runMode(ctx, img, params, &scratch); err != nil || len(params.Thresholds) == 0 {
+			return err
+		}
+		return thresholdOverlays(ctx, img, params, &scratch)
+	})
+	timer.mark("segment")
+	if err != nil {
+		return nil, err
+	}
+
+	*result = scratch
+	if segmented == nil {
+		return nil, nil
+	}
+	if params.ROI != nil && params.ROIOutput == roiOutputFull && !params.StatsOnly {
+		segmented = pasteROI(full, segmented, *params.ROI, params.ROIFill)
+	}
+	segmented = resizeImage(segmented, params)
+	if params.AutoCrop {
+		return autoCropImage(segmented, result)
+	}
+	return segmented, nil
+}
+
+// modeRand returns the random source for a randomized mode, seeded from
+// params. When the request did not pick a seed one is generated and
+// reported in result so the output can be reproduced.
+func modeRand(params SegmentParams, result *Result) *rand.Rand {
+	if params.Seed != nil {
+		return rand.New(rand.NewSource(*params.Seed))
+	}
+
+	// Stay within the integers JSON clients can represent exactly
+	seed := rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(1 << 53)
+	result.Seed = &seed
+	return rand.New(rand.NewSource(seed))
+}
+
+// runMode runs the segmentation mode selected by params on a preprocessed image
+func runMode(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+	img, err := denoiseImage(ctx, img, params)
+	if err != nil {
+		return nil, err
+	}
+
+	segmenter, ok := lookupMode(params.Mode)
+	if !ok {
+		return nil, fmt.Errorf("unknown mode %q", params.Mode)
+	}
+	return segmenter.Segment(ctx, img, params, result)
+}
+
+// performImageSegmentation performs basic image segmentation and records
+// its outputs in result
+func performImageSegmentation(ctx context.Context, inputPath string, outputPath string, params SegmentParams, result *Result) error {
+	if params.AllFrames && isGIF(inputPath) {
+		if params.Mode == modeBinary && isGIF(outputPath) {
+			if err := performAnimatedSegmentation(ctx, inputPath, outputPath, params); err != nil {
+				return err
+			}
+			result.SegmentedImage = uploadURL(outputPath)
+			return nil
+		}
+		result.warn("all_frames requires binary mode and GIF output; segmenting the first frame only")
+	}
+
+	timer := newStageTimer()
+	defer func() { debugf("%s: %s", inputPath, timer) }()
+
+	// Open the input file
+	file, err := os.Open(inputPath)
+	if err != nil {
+		return fmt.Errorf("error opening image: %v", err)
+	}
+	defer file.Close()
+
+	// Decode the image
+	img, err := decodeInput(file, inputPath, params.decodeOptions(), result)
+	if err != nil {
+		return fmt.Errorf("%w image: %w", errDecodeFailed, err)
+	}
+	timer.mark("decode")
+
+	segmented, err := segmentDecodedImage(ctx, img, params, result, timer)
+	if err != nil {
+		return err
+	}
+	if result.svg != nil {
+		if err := os.WriteFile(outputPath, result.svg, 0o644); err != nil {
+			return fmt.Errorf("error writing output file: %v", err)
+		}
+		result.SegmentedImage = uploadURL(outputPath)
+		return nil
+	}
+	if err := storeThresholdOverlays(outputPath, result); err != nil {
+		return err
+	}
+	if segmented == nil {
+		return nil
+	}
+	if params.OutputFormat == outputRLE {
+		result.RLE = encodeRLE(segmented)
+		return nil
 	}
 
 	// Create output file
@@ -93,92 +451,396 @@ func performImageSegmentation(inputPath string, outputPath string) error {
 	defer out.Close()
 
 	// Encode and save the segmented image
-	if strings.HasSuffix(strings.ToLower(outputPath), ".png") {
-		err = png.Encode(out, segmented)
-	} else {
-		err = jpeg.Encode(out, segmented, &jpeg.Options{Quality: 90})
-	}
-
-	if err != nil {
+	if err := encodeImage(out, segmented, outputPath, params.encodeOptions(result)); err != nil {
 		return fmt.Errorf("error encoding output image: %v", err)
 	}
+	timer.mark("encode")
+	result.SegmentedImage = uploadURL(outputPath)
 
 	return nil
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
+	// Replay the stored result when a client retries with the same key
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if idempotencyKey != "" {
+		cached, inFlight := idempotencyKeys.begin(idempotencyKey, config.IdempotencyTTL)
+		if inFlight {
+			writeError(w, r, codeConflict, "A request with this Idempotency-Key is still being processed")
+			return
+		}
+		if cached != nil {
+			w.Header().Set("Idempotent-Replayed", "true")
+			if cached.job != nil {
+				writeAcceptedJob(w, r, *cached.job)
+				return
+			}
+			writeJSON(w, r, cached.result)
+			return
+		}
+		// Failed requests release the key so that a retry is processed again
+		defer idempotencyKeys.abort(idempotencyKey)
+	}
+
+	// Count the received bytes when the client wants to poll for progress
+	var progress *uploadProgress
+	if uploadID := r.Header.Get("Upload-ID"); uploadID != "" {
+		var err error
+		if progress, err = uploadProgresses.start(uploadID, r.ContentLength); err != nil {
+			writeError(w, r, errorCodeOf(err, codeInternal), err.Error())
+			return
+		}
+		r.Body = countingReader{r.Body, progress}
+		defer progress.fail()
+	}
+
 	// Parse multipart form with 10MB max memory
-	err := r.ParseMultipartForm(10 << 20)
+	err := parseLimitedMultipartForm(r, 10<<20)
+	if errors.Is(err, errFormLimit) {
+		writeError(w, r, codeFormLimit, "Invalid request: "+err.Error())
+		return
+	}
 	if err != nil {
-		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		writeError(w, r, codeMalformedRequest, "Unable to parse form")
 		return
 	}
+	progress.setState(stateProcessing)
 
 	file, handler, err := r.FormFile("image")
 	if err != nil {
-		http.Error(w, "Error retrieving file", http.StatusBadRequest)
+		writeError(w, r, codeMissingImage, "Error retrieving file")
 		return
 	}
 	defer file.Close()
 
-	// Create uploads directory if it doesn't exist
-	uploadsDir := "uploads"
-	if err := os.MkdirAll(uploadsDir, os.ModePerm); err != nil {
-		http.Error(w, "Error creating upload directory", http.StatusInternalServerError)
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
 		return
 	}
 
-	// Create unique filenames for original and segmented images
-	originalPath := filepath.Join(uploadsDir, "original_"+handler.Filename)
-	segmentedPath := filepath.Join(uploadsDir, "segmented_"+handler.Filename)
-
-	// Save original file
-	dst, err := os.Create(originalPath)
+	opts, err := parseUploadOptions(r)
 	if err != nil {
-		http.Error(w, "Error creating file", http.StatusInternalServerError)
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
 		return
 	}
-	defer dst.Close()
 
-	if _, err := io.Copy(dst, file); err != nil {
-		http.Error(w, "Error saving file", http.StatusInternalServerError)
+	// A background job is the outcome of the request, replayed on retries;
+	// it waits for a worker of its own
+	if opts.CallbackURL != "" {
+		job, ok := submitCallbackJob(w, r, file, handler.Filename, params, opts)
+		if !ok {
+			return
+		}
+		if idempotencyKey != "" {
+			idempotencyKeys.accept(idempotencyKey, job, config.IdempotencyTTL)
+		}
+		progress.setState(stateDone)
 		return
 	}
 
-	// Perform image segmentation
-	err = performImageSegmentation(originalPath, segmentedPath)
-	if err != nil {
-		http.Error(w, "Error performing segmentation: "+err.Error(), http.StatusInternalServerError)
+	release, ok := awaitWorker(w, r)
+	if !ok {
 		return
 	}
+	defer release()
 
-	// Prepare response
-	result := Result{
-		OriginalImage:  "/uploads/original_" + handler.Filename,
-		SegmentedImage: "/uploads/segmented_" + handler.Filename,
-		Message:        "Image segmentation completed successfully",
+	result, ok := storeAndSegment(w, r, file, handler.Size, handler.Filename, params, opts)
+	if !ok {
+		return
 	}
 
+	if idempotencyKey != "" {
+		idempotencyKeys.finish(idempotencyKey, result, config.IdempotencyTTL)
+	}
+	progress.setState(stateDone)
+
 	// Send response
+	writeJSON(w, r, result)
+}
+
+// uploadOptions are the storage options of an upload
+type uploadOptions struct {
+	// KeepOriginal keeps the uploaded original on disk after segmentation
+	KeepOriginal bool
+
+	// Policy decides what happens when an output name is already taken
+	Policy string
+
+	// CallbackURL makes the upload a background job whose result is
+	// POSTed there, or is empty to answer with the result
+	CallbackURL string
+}
+
+// parseUploadOptions reads the storage options from the request form
+func parseUploadOptions(r *http.Request) (uploadOptions, error) {
+	opts := uploadOptions{KeepOriginal: config.KeepOriginals, Policy: config.OutputPolicy}
+
+	if v := formValue(r, "keep_original"); v != "" {
+		keep, err := parseBoolField("keep_original", v)
+		if err != nil {
+			return opts, err
+		}
+		opts.KeepOriginal = keep
+	}
+
+	if v := formValue(r, "output_policy"); v != "" {
+		if !validOutputPolicy(v) {
+			return opts, fieldError("output_policy", v, "expected overwrite, error or version")
+		}
+		opts.Policy = v
+	}
+
+	if v := formValue(r, "callback_url"); v != "" {
+		if err := checkCallbackURL(v); err != nil {
+			return opts, err
+		}
+		opts.CallbackURL = v
+	}
+
+	return opts, nil
+}
+
+// storeAndSegment saves an uploaded original of size bytes, segments it
+// into the uploads directory and returns the result. On failure it writes
+// the error response and returns false. It always runs synchronously:
+// uploads with a callback URL are submitted as jobs by the handlers, which
+// call it from the job.
+func storeAndSegment(w http.ResponseWriter, r *http.Request, file io.Reader, size int64, filename string, params SegmentParams, opts uploadOptions) (Result, bool) {
+	// Statistics are computed in memory and nothing is written to disk
+	if params.StatsOnly {
+		result, ok := segmentStatsOnly(w, r, file, filename, params)
+		return result, ok && recordResult(w, r, &result, params)
+	}
+
+	// Create uploads directory if it doesn't exist
+	if err := os.MkdirAll(uploadsDir, os.ModePerm); err != nil {
+		writeError(w, r, codeInternal, "Error creating upload directory")
+		return Result{}, false
+	}
+
+	reservation, err := uploadsQuota.reserve(uploadReservation(size, params))
+	if errors.Is(err, errQuotaExceeded) {
+		writeError(w, r, codeQuotaExceeded, err.Error())
+		return Result{}, false
+	}
+	if err != nil {
+		writeError(w, r, codeInternal, "Error checking disk usage: "+err.Error())
+		return Result{}, false
+	}
+	defer reservation.release()
+	if err := checkFreeSpace(uploadsDir, size); err != nil {
+		writeError(w, r, errorCodeOf(err, codeInternal), err.Error())
+		return Result{}, false
+	}
+
+	file = resolveInputFormat(file, &params)
+	requestedName, err := outputName(config.OutputTemplate, filename, params)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidOutputName), "Invalid request: "+err.Error())
+		return Result{}, false
+	}
+	requestedName = forceOutputExt(requestedName, config.ForceOutputFormat)
+	segmentedName, err := checkOutputFormat(requestedName, config.UnsupportedOutputPolicy)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidOutputName), "Invalid request: "+err.Error())
+		return Result{}, false
+	}
+
+	// Apply the overwrite policy before anything is written
+	segmentedPath, err := resolveOutputPath(filepath.Join(uploadsDir, segmentedName), opts.Policy)
+	if err != nil {
+		writeError(w, r, codeOutputExists, err.Error())
+		return Result{}, false
+	}
+
+	// Save original file, reusing an identical original if one is stored
+	originalPath, created, err := originals.save(r.Context(), file, uploadsDir, filename, opts.Policy)
+	if errors.Is(err, errOutputExists) {
+		writeError(w, r, codeOutputExists, err.Error())
+		return Result{}, false
+	}
+	if errors.Is(err, context.Canceled) {
+		// The client is gone, there is nobody to answer
+		return Result{}, false
+	}
+	if err != nil {
+		writeError(w, r, codeInternal, "Error saving file")
+		return Result{}, false
+	}
+
+	// Perform image segmentation
+	result := Result{
+		OriginalImage: uploadURL(originalPath),
+		Message:       "Image segmentation completed successfully",
+	}
+	if segmentedName != requestedName {
+		result.warn("output %s has no supported format; it was written as PNG", requestedName)
+	}
+	err = performImageSegmentation(r.Context(), originalPath, segmentedPath, params, &result)
+	reservation.wrote(resultOutputs(&storedResult{Result: result})...)
+
+	// Drop our reference to the original when it should not be persisted.
+	// An identical original kept by an earlier upload stays on disk.
+	if !opts.KeepOriginal {
+		if releaseErr := originals.release(originalPath); releaseErr != nil {
+			fmt.Printf("Error removing original %s: %s\n", originalPath, releaseErr)
+		}
+		result.OriginalImage = ""
+	}
+	// A released original is gone and counts for nothing
+	if created {
+		reservation.wrote(originalPath)
+	}
+
+	if err != nil {
+		writeSegmentError(w, r, err)
+		return Result{}, false
+	}
+
+	if !recordResult(w, r, &result, params) {
+		return Result{}, false
+	}
+	reservation.wrote(filepath.Join(resultsDir, result.ID+".json"))
+	return result, true
+}
+
+// recordResult saves a successful result so that it can be fetched again
+// by ID, answering 500 when it cannot be saved
+func recordResult(w http.ResponseWriter, r *http.Request, result *Result, params SegmentParams) bool {
+	if err := saveResult(result, params); err != nil {
+		writeError(w, r, codeInternal, "Error saving result: "+err.Error())
+		return false
+	}
+	return true
+}
+
+// writeJSON sends v as a JSON response using the field casing requested by r
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+// writeJSONStatus is writeJSON with a status other than 200. The body is
+// encoded first, so that an encoding error can still be answered with 500.
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	data, err := marshalJSON(v, responseCase(r))
+	if err != nil {
+		writeError(w, r, codeInternal, "Error encoding response")
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(result)
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
 }
 
 func main() {
+	if err := loadConfig(); err != nil {
+		fmt.Printf("Error loading configuration: %s\n", err)
+		os.Exit(1)
+	}
+
+	uploadProgresses = newProgressTracker(config.MaxTrackedUploads, config.ProgressRetention)
+	segmentQueue = newWorkQueue(config.SegmentWorkers)
+
+	// Find out early whether results can be stored at all
+	if err := checkStorage(); err != nil {
+		fmt.Printf("Error checking storage: %s\n", err)
+		os.Exit(1)
+	}
+
+	// Index stored originals so repeated uploads are deduplicated
+	if err := originals.index(uploadsDir); err != nil {
+		fmt.Printf("Error indexing uploads: %s\n", err)
+	}
+
+	if err := uploadsQuota.recount(); err != nil {
+		fmt.Printf("Error counting uploads: %s\n", err)
+	}
+	go uploadsQuota.recountEvery(quotaRecountInterval)
+	go resumables.sweepEvery(resumableSweepInterval)
+
 	// Serve static files from the uploads directory
-	fs := http.FileServer(http.Dir("uploads"))
+	fs := http.FileServer(http.Dir(uploadsDir))
 	http.Handle("/uploads/", http.StripPrefix("/uploads/", fs))
 
+	// Middleware applied to every API endpoint, outermost first
+	api := []middleware{enableCORS, compressed}
+
+	// Endpoints storing files, which are disabled in transform-only mode.
+	// Endpoints processing images wait for a worker themselves, see
+	// awaitWorker.
+	store := append(api, writesStorage)
+
 	// Handle upload endpoint
-	http.HandleFunc("/api/upload", enableCORS(uploadHandler))
+	http.HandleFunc("/api/upload", chain(uploadHandler, store...))
+
+	// Handle resumable uploads
+	http.HandleFunc("/api/resumable", chain(resumableHandler, store...))
+
+	// Handle mask comparisons
+	http.HandleFunc("/api/diff", chain(diffHandler, store...))
+
+	// Handle applying client-supplied masks
+	http.HandleFunc("/api/mask", chain(maskHandler, store...))
+
+	// Handle raw float exports of intermediate data
+	http.HandleFunc("/api/export", chain(exportHandler, api...))
+
+	// Handle dominant color extraction
+	http.HandleFunc("/api/palette", chain(paletteHandler, api...))
 
-	fmt.Println("Server starting on :8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	// Describe the modes and their parameters
+	http.HandleFunc("/api/schema", chain(schemaHandler, api...))
+
+	// Handle intensity histograms
+	http.HandleFunc("/api/histogram", chain(histogramHandler, api...))
+
+	// Handle the pipeline self-test
+	http.HandleFunc("/api/selftest", chain(selfTestHandler, api...))
+
+	// Handle batch re-segmentation of the stored originals
+	http.HandleFunc("/api/reprocess", chain(reprocessHandler, store...))
+
+	// Handle stored result lookups by ID
+	http.HandleFunc("/api/result/", chain(resultHandler, api...))
+
+	// Handle upload progress queries
+	http.HandleFunc("/api/progress", chain(progressHandler, api...))
+
+	// Handle uploads sent as base64 JSON
+	http.HandleFunc("/api/upload/json", chain(jsonUploadHandler, store...))
+
+	// Handle composites of image stacks
+	http.HandleFunc("/api/stack", chain(stackHandler, store...))
+
+	// Handle GraphQL queries and mutations
+	http.HandleFunc("/api/graphql", chain(graphQLHandler, api...))
+
+	// Handle pure-transform endpoint, which stores nothing
+	http.HandleFunc("/api/segment", chain(transformHandler, api...))
+
+	// Serve the built-in test page
+	http.Handle("/", webHandler())
+
+	// Serve HTTPS when both a certificate and key are configured
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+
+	var err error
+	if certFile != "" && keyFile != "" {
+		fmt.Println("Server starting on :8080 (HTTPS)...")
+		err = http.ListenAndServeTLS(":8080", certFile, keyFile, nil)
+	} else {
+		fmt.Println("Server starting on :8080 (HTTP)...")
+		err = http.ListenAndServe(":8080", nil)
+	}
+	if err != nil {
 		fmt.Printf("Error starting server: %s\n", err)
 	}
 }
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+)
+
+// maskResponse is the JSON body of the mask endpoint
+type maskResponse struct {
+	MaskedImage string   `json:"masked_image"`
+	KeptPercent float64  `json:"kept_percent"`
+	Warnings    []string `json:"warnings,omitempty"`
+}
+
+// applyMask keeps the pixels of img where the mask is foreground and
+// replaces the others with fill, or makes them transparent when fill is
+// nil. The mask must have the same dimensions as the image.
+func applyMask(img image.Image, mask image.Image, fill *color.RGBA, invert bool) (*image.NRGBA, int, error) {
+	ib, mb := img.Bounds(), mask.Bounds()
+	if ib.Size() != mb.Size() {
+		return nil, 0, fmt.Errorf("%w: image is %dx%d, mask is %dx%d",
+			errSizeMismatch, ib.Dx(), ib.Dy(), mb.Dx(), mb.Dy())
+	}
+
+	width := ib.Dx()
+	keep := maskBits(mask)
+	out := image.NewNRGBA(image.Rect(0, 0, width, ib.Dy()))
+	kept := 0
+	for i, fg := range keep {
+		x, y := i%width, i/width
+		switch {
+		case fg != invert:
+			out.Set(x, y, img.At(ib.Min.X+x, ib.Min.Y+y))
+			kept++
+		case fill != nil:
+			out.Set(x, y, *fill)
+		}
+	}
+	return out, kept, nil
+}
+
+// maskHandler applies a mask supplied by the client to an uploaded image,
+// the reverse of segmentation. The mask is sent as a file (mask) or as a
+// stored result (mask_result), and the masked-out pixels are made
+// transparent or painted with the fill color.
+func maskHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse multipart form with 10MB max memory
+	err := parseLimitedMultipartForm(r, 10<<20)
+	if errors.Is(err, errFormLimit) {
+		writeError(w, r, codeFormLimit, "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Unable to parse form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// The body has been read: only the processing holds a worker
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	file, handler, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, r, codeMissingImage, "Error retrieving file")
+		return
+	}
+	defer file.Close()
+
+	var fill *color.RGBA
+	if v := formValue(r, "fill"); v != "" {
+		c, err := parseHexColor(v)
+		if err != nil {
+			writeError(w, r, codeInvalidParameters, "Invalid parameters: "+fieldError("fill", v, "expected a hex color such as #00ff00").Error())
+			return
+		}
+		fill = &c
+	}
+	invert := false
+	if v := formValue(r, "invert"); v != "" {
+		if invert, err = parseBoolField("invert", v); err != nil {
+			writeError(w, r, codeInvalidParameters, "Invalid parameters: "+err.Error())
+			return
+		}
+	}
+
+	var result Result
+	img, err := decodeInput(file, handler.Filename, decodeOptions{}, &result)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeDecodeFailed), "Error decoding image: "+err.Error())
+		return
+	}
+	mask, err := loadMaskInput(r, "mask")
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+
+	masked, kept, err := applyMask(img, mask, fill, invert)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+
+	maskedPath, err := storeGeneratedPNG("masked_", masked)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInternal), "Error storing masked image: "+err.Error())
+		return
+	}
+
+	resp := maskResponse{MaskedImage: uploadURL(maskedPath), Warnings: result.Warnings}
+	if total := len(masked.Pix) / 4; total > 0 {
+		resp.KeptPercent = math.Round(10000*float64(kept)/float64(total)) / 100
+	}
+	writeJSON(w, r, resp)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// maxMeanShiftPixels caps the image size in meanshift mode. Each pixel
+// scans a (2*spatial+1)^2 window on every iteration, so the cost grows with
+// both the image size and the square of the spatial bandwidth.
+const maxMeanShiftPixels = 512 * 512
+
+// meanShiftIterations bounds the number of shifts per pixel
+const meanShiftIterations = 10
+
+// errImageTooLarge is returned when an image exceeds the size limit of a mode
+var errImageTooLarge = errors.New("image too large")
+
+func init() {
+	registerMode(modeMeanShift, "The image flattened into regions of homogeneous color by mean-shift filtering", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		radius := params.SpatialRadius
+		if side := fitWindow(2*radius+1, img.Bounds()); side != 2*radius+1 {
+			radius = side / 2
+			result.warn("spatial_radius %d does not fit the %dx%d image; %d was used", params.SpatialRadius, img.Bounds().Dx(), img.Bounds().Dy(), radius)
+		}
+		return meanShiftSegment(ctx, img, radius, params.ColorRadius)
+	}))
+}
+
+// meanShiftSegment filters an image with joint spatial-range mean shift.
+// Every pixel climbs to the mode of the colors within colorRadius of it in a
+// window of spatialRadius pixels, and is painted with the converged color,
+// which flattens the image into regions of homogeneous color.
+func meanShiftSegment(ctx context.Context, img image.Image, spatialRadius int, colorRadius float64) (*image.RGBA, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width*height > maxMeanShiftPixels {
+		return nil, fmt.Errorf("%w: meanshift mode supports at most %d pixels, got %dx%d",
+			errImageTooLarge, maxMeanShiftPixels, width, height)
+	}
+
+	// Work on 8-bit RGB values in row-major order
+	pixels := make([][3]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.RGBA)
+			pixels[y*width+x] = [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+		}
+	}
+
+	colorRadiusSq := colorRadius * colorRadius
+	segmented := image.NewRGBA(bounds)
+
+	for y := 0; y < height; y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		for x := 0; x < width; x++ {
+			cx, cy := float64(x), float64(y)
+			mode := pixels[y*width+x]
+
+			for iter := 0; iter < meanShiftIterations; iter++ {
+				var sx, sy float64
+				var sum [3]float64
+				n := 0
+
+				x0, x1 := clampInt(int(cx)-spatialRadius, 0, width-1), clampInt(int(cx)+spatialRadius, 0, width-1)
+				y0, y1 := clampInt(int(cy)-spatialRadius, 0, height-1), clampInt(int(cy)+spatialRadius, 0, height-1)
+				for wy := y0; wy <= y1; wy++ {
+					for wx := x0; wx <= x1; wx++ {
+						p := pixels[wy*width+wx]
+						dr, dg, db := p[0]-mode[0], p[1]-mode[1], p[2]-mode[2]
+						if dr*dr+dg*dg+db*db > colorRadiusSq {
+							continue
+						}
+						sx += float64(wx)
+						sy += float64(wy)
+						sum[0] += p[0]
+						sum[1] += p[1]
+						sum[2] += p[2]
+						n++
+					}
+				}
+				if n == 0 {
+					break
+				}
+
+				nx, ny := sx/float64(n), sy/float64(n)
+				next := [3]float64{sum[0] / float64(n), sum[1] / float64(n), sum[2] / float64(n)}
+				shift := (nx-cx)*(nx-cx) + (ny-cy)*(ny-cy) +
+					(next[0]-mode[0])*(next[0]-mode[0]) + (next[1]-mode[1])*(next[1]-mode[1]) + (next[2]-mode[2])*(next[2]-mode[2])
+				cx, cy, mode = nx, ny, next
+
+				// Stop once the window has effectively stopped moving
+				if shift < 0.01 {
+					break
+				}
+			}
+
+			segmented.SetRGBA(bounds.Min.X+x, bounds.Min.Y+y, color.RGBA{
+				uint8(math.Round(mode[0])), uint8(math.Round(mode[1])), uint8(math.Round(mode[2])), 255,
+			})
+		}
+	}
+
+	return segmented, nil
+}
+
+func clampInt(v int, lo int, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
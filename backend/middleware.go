@@ -0,0 +1,15 @@
+package main
+
+import "net/http"
+
+// middleware wraps a handler with behavior shared by several endpoints
+type middleware func(next http.HandlerFunc) http.HandlerFunc
+
+// chain wraps handler with the middleware in order, the first one being the
+// outermost: chain(h, a, b) runs a, then b, then h
+func chain(handler http.HandlerFunc, middlewares ...middleware) http.HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
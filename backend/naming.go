@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// defaultOutputTemplate reproduces the historical segmented_<filename> names
+const defaultOutputTemplate = "segmented_{name}{ext}"
+
+// Behaviors for an output name whose extension has no encoder
+const (
+	unsupportedToPNG  = "png"
+	unsupportedReject = "error"
+)
+
+// errUnsupportedOutput is returned for an output extension with no encoder
+var errUnsupportedOutput = errors.New("unsupported output format")
+
+// supportedOutputExt reports whether encodeImage can write ext, or contours
+// mode for .svg. No file is written for .rle, the mask being returned in
+// the response.
+func supportedOutputExt(ext string) bool {
+	switch strings.ToLower(ext) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".pbm", ".pgm", ".ppm", ".pnm", ".svg", ".rle":
+		return true
+	}
+	return false
+}
+
+// checkOutputFormat makes sure an output name has an extension that can be
+// encoded. Under unsupportedToPNG another extension is replaced with .png
+// (or .png is appended to a name without one); under unsupportedReject
+// errUnsupportedOutput is returned.
+func checkOutputFormat(name string, policy string) (string, error) {
+	ext := filepath.Ext(name)
+	if supportedOutputExt(ext) {
+		return name, nil
+	}
+	if policy == unsupportedReject {
+		if ext == "" {
+			return "", fmt.Errorf("%w: output name %q has no extension", errUnsupportedOutput, name)
+		}
+		return "", fmt.Errorf("%w %q (expected png, jpg, gif, pbm, pgm, ppm, pnm or svg)", errUnsupportedOutput, ext)
+	}
+	return strings.TrimSuffix(name, ext) + ".png", nil
+}
+
+// forcedOutputFormats maps the FORCE_OUTPUT_FORMAT values to the media type
+// of their encoding
+var forcedOutputFormats = map[string]string{
+	"png": "image/png",
+	"jpg": "image/jpeg",
+	"gif": "image/gif",
+	"pbm": "image/x-portable-bitmap",
+	"pgm": "image/x-portable-graymap",
+	"ppm": "image/x-portable-pixmap",
+}
+
+// forceOutputExt gives an output name the extension of format, the
+// FORCE_OUTPUT_FORMAT value, unless format is empty. SVG and RLE outputs
+// keep theirs, being no image encoding.
+func forceOutputExt(name string, format string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if format == "" || ext == ".svg" || ext == ".rle" {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + "." + format
+}
+
+// outputName expands an output naming template for an upload. The
+// placeholders are {name} (upload filename without extension), {ext} (output
+// extension including the dot), {mode} and {id} (random, unique per upload).
+func outputName(template string, filename string, params SegmentParams) (string, error) {
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+	if params.OutputFormat != "" {
+		ext = "." + params.OutputFormat
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+
+	out := strings.NewReplacer(
+		"{name}", name,
+		"{ext}", ext,
+		"{mode}", params.Mode,
+		"{id}", hex.EncodeToString(id[:]),
+	).Replace(template)
+	if err := checkOutputName(out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// checkOutputName rejects names that would escape the uploads directory,
+// be hidden like temporary uploads, or collide with stored originals
+func checkOutputName(name string) error {
+	switch {
+	case name == "" || name != filepath.Base(name) || strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("output name %q is not a plain file name", name)
+	case strings.HasPrefix(name, "."):
+		return fmt.Errorf("output name %q is hidden", name)
+	case strings.HasPrefix(name, "original_"):
+		return fmt.Errorf("output name %q is reserved for uploaded originals", name)
+	}
+	return nil
+}
+
+// validOutputTemplate reports whether a naming template only knows the
+// supported placeholders and yields safe names
+func validOutputTemplate(template string) error {
+	rest := strings.NewReplacer("{name}", "", "{ext}", "", "{mode}", "", "{id}", "").Replace(template)
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unknown placeholder in %q", template)
+	}
+	if !strings.Contains(template, "{name}") && !strings.Contains(template, "{id}") {
+		return fmt.Errorf("template %q must contain {name} or {id}", template)
+	}
+
+	_, err := outputName(template, "example.png", defaultSegmentParams())
+	return err
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// maxNetpbmPixels bounds the size of a Netpbm image. Samples are decoded to
+// 16 bits, so the largest image takes 128 MiB as RGBA64.
+const maxNetpbmPixels = 1 << 24
+
+func isNetpbm(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pbm", ".pgm", ".ppm", ".pnm":
+		return true
+	}
+	return false
+}
+
+// netpbmReader reads the whitespace separated tokens of a Netpbm header
+type netpbmReader struct {
+	*bufio.Reader
+}
+
+// skipSpace skips whitespace and '#' comments
+func (r netpbmReader) skipSpace() error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case b == '#':
+			if _, err := r.ReadString('\n'); err != nil {
+				return err
+			}
+		case b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f':
+		default:
+			return r.UnreadByte()
+		}
+	}
+}
+
+// readInt reads a non-negative decimal integer
+func (r netpbmReader) readInt() (int, error) {
+	if err := r.skipSpace(); err != nil {
+		return 0, err
+	}
+
+	n, digits := 0, 0
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF && digits > 0 {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if b < '0' || b > '9' {
+			if digits == 0 {
+				return 0, fmt.Errorf("unexpected character %q", b)
+			}
+			return n, r.UnreadByte()
+		}
+		if n > 1<<24 {
+			return 0, errors.New("value too large")
+		}
+		n = n*10 + int(b-'0')
+		digits++
+	}
+}
+
+// readBit reads a single 0 or 1 from a plain PBM raster, which may omit
+// whitespace between bits
+func (r netpbmReader) readBit() (bool, error) {
+	if err := r.skipSpace(); err != nil {
+		return false, err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return false, err
+	}
+	if b != '0' && b != '1' {
+		return false, fmt.Errorf("unexpected character %q", b)
+	}
+	return b == '1', nil
+}
+
+// netpbmHeader is the parsed header of a Netpbm image
+type netpbmHeader struct {
+	kind   byte // '1' to '6', from the magic number
+	width  int
+	height int
+	maxVal int
+}
+
+// readNetpbmHeader parses the header up to the start of the raster
+func readNetpbmHeader(r netpbmReader) (netpbmHeader, error) {
+	var h netpbmHeader
+
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return h, err
+	}
+	if magic[0] != 'P' || magic[1] < '1' || magic[1] > '6' {
+		return h, errors.New("netpbm: invalid magic number")
+	}
+	h.kind = magic[1]
+
+	var err error
+	if h.width, err = r.readInt(); err != nil {
+		return h, fmt.Errorf("netpbm: invalid width: %v", err)
+	}
+	if h.height, err = r.readInt(); err != nil {
+		return h, fmt.Errorf("netpbm: invalid height: %v", err)
+	}
+	if h.width <= 0 || h.height <= 0 || h.width*h.height > maxNetpbmPixels {
+		return h, fmt.Errorf("netpbm: unsupported dimensions %dx%d", h.width, h.height)
+	}
+
+	h.maxVal = 1
+	if h.kind != '1' && h.kind != '4' {
+		if h.maxVal, err = r.readInt(); err != nil {
+			return h, fmt.Errorf("netpbm: invalid maxval: %v", err)
+		}
+		if h.maxVal <= 0 || h.maxVal > 65535 {
+			return h, fmt.Errorf("netpbm: unsupported maxval %d", h.maxVal)
+		}
+	}
+
+	// A single whitespace byte separates the header from a raw raster
+	if h.kind >= '4' {
+		if _, err := r.ReadByte(); err != nil {
+			return h, err
+		}
+	}
+
+	return h, nil
+}
+
+// decodeNetpbmConfig returns the dimensions of a Netpbm image without
+// reading its raster
+func decodeNetpbmConfig(src io.Reader) (image.Config, error) {
+	h, err := readNetpbmHeader(netpbmReader{bufio.NewReader(src)})
+	if err != nil {
+		return image.Config{}, err
+	}
+
+	model := color.Gray16Model
+	switch h.kind {
+	case '1', '4':
+		model = color.GrayModel
+	case '3', '6':
+		model = color.RGBA64Model
+	}
+	return image.Config{ColorModel: model, Width: h.width, Height: h.height}, nil
+}
+
+// decodeNetpbm decodes PBM, PGM and PPM images in both plain (P1-P3) and
+// raw (P4-P6) form
+func decodeNetpbm(src io.Reader) (image.Image, error) {
+	r := netpbmReader{bufio.NewReader(src)}
+
+	h, err := readNetpbmHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	kind, width, height, maxVal := h.kind, h.width, h.height, h.maxVal
+
+	// A forged header must not allocate more than the body can fill
+	raster, err := readNetpbmRaster(r, h)
+	if err != nil {
+		return nil, err
+	}
+	r = netpbmReader{bufio.NewReader(bytes.NewReader(raster))}
+
+	bounds := image.Rect(0, 0, width, height)
+	switch kind {
+	case '1', '4':
+		return decodePBM(r, bounds, kind == '4')
+	case '2', '5':
+		img := image.NewGray16(bounds)
+		for i := 0; i < width*height; i++ {
+			v, err := readSample(r, kind == '5', maxVal)
+			if err != nil {
+				return nil, err
+			}
+			img.SetGray16(i%width, i/width, color.Gray16{v})
+		}
+		return img, nil
+	default:
+		img := image.NewRGBA64(bounds)
+		for i := 0; i < width*height; i++ {
+			var rgb [3]uint16
+			for c := range rgb {
+				if rgb[c], err = readSample(r, kind == '6', maxVal); err != nil {
+					return nil, err
+				}
+			}
+			img.SetRGBA64(i%width, i/width, color.RGBA64{rgb[0], rgb[1], rgb[2], 0xffff})
+		}
+		return img, nil
+	}
+}
+
+// readNetpbmRaster reads the raster following header h and rejects it when
+// it is shorter than the dimensions require. Raw rasters are read up to
+// their exact size, plain ones to the end, each sample taking at least one
+// digit and all but the last a separator too (PBM bits may omit it).
+func readNetpbmRaster(r netpbmReader, h netpbmHeader) ([]byte, error) {
+	pixels := int64(h.width) * int64(h.height)
+	sampleBytes := int64(1)
+	if h.maxVal > 255 {
+		sampleBytes = 2
+	}
+
+	var need int64
+	switch h.kind {
+	case '1':
+		need = pixels
+	case '2':
+		need = 2*pixels - 1
+	case '3':
+		need = 6*pixels - 1
+	case '4':
+		need = int64(h.height) * int64((h.width+7)/8)
+	case '5':
+		need = pixels * sampleBytes
+	default:
+		need = 3 * pixels * sampleBytes
+	}
+
+	src := io.Reader(r)
+	if h.kind >= '4' {
+		src = io.LimitReader(r, need)
+	}
+	raster, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raster)) < need {
+		return nil, fmt.Errorf("netpbm: %dx%d raster needs at least %d bytes, got %d", h.width, h.height, need, len(raster))
+	}
+	return raster, nil
+}
+
+// decodePBM reads a bitmap raster, where 1 is black and 0 is white
+func decodePBM(r netpbmReader, bounds image.Rectangle, raw bool) (image.Image, error) {
+	img := image.NewGray(bounds)
+	width, height := bounds.Dx(), bounds.Dy()
+
+	for y := 0; y < height; y++ {
+		if raw {
+			// Raw rows are packed 8 pixels per byte, padded to a whole byte
+			row := make([]byte, (width+7)/8)
+			if _, err := io.ReadFull(r, row); err != nil {
+				return nil, err
+			}
+			for x := 0; x < width; x++ {
+				if row[x/8]&(0x80>>(x%8)) == 0 {
+					img.Pix[y*img.Stride+x] = 0xff
+				}
+			}
+			continue
+		}
+
+		for x := 0; x < width; x++ {
+			black, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if !black {
+				img.Pix[y*img.Stride+x] = 0xff
+			}
+		}
+	}
+
+	return img, nil
+}
+
+// readSample reads one sample and scales it from [0, maxVal] to 16 bits
+func readSample(r netpbmReader, raw bool, maxVal int) (uint16, error) {
+	var v int
+	switch {
+	case !raw:
+		n, err := r.readInt()
+		if err != nil {
+			return 0, err
+		}
+		v = n
+	case maxVal < 256:
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = int(b)
+	default:
+		var buf [2]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, err
+		}
+		v = int(buf[0])<<8 | int(buf[1])
+	}
+
+	if v > maxVal {
+		return 0, fmt.Errorf("netpbm: sample %d exceeds maxval %d", v, maxVal)
+	}
+	return uint16(v * 0xffff / maxVal), nil
+}
+
+// encodeNetpbm writes img as a raw PBM, PGM or PPM depending on the
+// extension of path. PBM output marks pixels darker than mid-gray as black.
+func encodeNetpbm(w io.Writer, img image.Image, path string) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	bw := bufio.NewWriter(w)
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".pbm":
+		fmt.Fprintf(bw, "P4\n%d %d\n", width, height)
+		row := make([]byte, (width+7)/8)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for i := range row {
+				row[i] = 0
+			}
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y < 128 {
+					i := x - bounds.Min.X
+					row[i/8] |= 0x80 >> (i % 8)
+				}
+			}
+			bw.Write(row)
+		}
+	case ".pgm":
+		// 16-bit images keep their precision, with samples written big-endian
+		if gray16, ok := img.(*image.Gray16); ok {
+			fmt.Fprintf(bw, "P5\n%d %d\n65535\n", width, height)
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					v := gray16.Gray16At(x, y).Y
+					bw.Write([]byte{byte(v >> 8), byte(v)})
+				}
+			}
+			break
+		}
+		fmt.Fprintf(bw, "P5\n%d %d\n255\n", width, height)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				bw.WriteByte(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+			}
+		}
+	default:
+		fmt.Fprintf(bw, "P6\n%d %d\n255\n", width, height)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				bw.Write([]byte{c.R, c.G, c.B})
+			}
+		}
+	}
+
+	return bw.Flush()
+}
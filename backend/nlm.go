@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"math"
+)
+
+// Denoise filters
+const (
+	denoiseNone = ""
+	denoiseNLM  = "nlm"
+)
+
+// maxDenoisePixels caps the image size for non-local means. Every pixel is
+// compared with each of the (2*nlmSearchRadius+1)^2 offsets around it, so
+// a 1 megapixel image takes 224 full passes, several seconds of CPU.
+const maxDenoisePixels = 1 << 20
+
+// nlmPatchRadius and nlmSearchRadius are the half sizes of the patches that
+// are compared and of the window the similar patches are searched in
+const (
+	nlmPatchRadius  = 3
+	nlmSearchRadius = 7
+)
+
+// denoiseImage applies the requested denoise filter, returning img
+// unchanged when there is none
+func denoiseImage(ctx context.Context, img image.Image, params SegmentParams) (image.Image, error) {
+	if params.Denoise != denoiseNLM {
+		return img, nil
+	}
+	return nlmDenoise(ctx, img, params.Channel, params.DenoiseStrength)
+}
+
+// nlmDenoise filters the selected channel of an image with non-local means.
+// Each pixel becomes the average of the pixels in its search window,
+// weighted by exp(-d/h^2) where d is the mean squared difference between
+// the patches around the two pixels. Patch distances for one offset are
+// read from an integral image of the squared differences, so the cost does
+// not depend on the patch size.
+func nlmDenoise(ctx context.Context, img image.Image, channel string, h float64) (*image.Gray, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width*height > maxDenoisePixels {
+		return nil, fmt.Errorf("%w: nlm denoising supports at most %d pixels, got %dx%d",
+			errImageTooLarge, maxDenoisePixels, width, height)
+	}
+
+	levels := grayLevels(img, channel)
+	values := make([]float64, len(levels))
+	for i, v := range levels {
+		values[i] = float64(v)
+	}
+
+	// Every pixel is its own most similar patch
+	total := make([]float64, len(values))
+	weights := make([]float64, len(values))
+	copy(total, values)
+	for i := range weights {
+		weights[i] = 1
+	}
+
+	diffs := make([]float64, len(values))
+	ii := &integralImage{width: width, height: height, table: make([]float64, (width+1)*(height+1))}
+	hSq := h * h
+
+	for dy := -nlmSearchRadius; dy <= nlmSearchRadius; dy++ {
+		for dx := -nlmSearchRadius; dx <= nlmSearchRadius; dx++ {
+			if dx == 0 && dy == 0 {
+				continue
+			}
+			if err := canceled(ctx); err != nil {
+				return nil, err
+			}
+
+			// Pixels whose offset neighbour lies inside the image
+			vx0, vx1 := max(0, -dx), min(width, width-dx)
+			vy0, vy1 := max(0, -dy), min(height, height-dy)
+
+			for i := range diffs {
+				diffs[i] = 0
+			}
+			for y := vy0; y < vy1; y++ {
+				for x := vx0; x < vx1; x++ {
+					d := values[y*width+x] - values[(y+dy)*width+x+dx]
+					diffs[y*width+x] = d * d
+				}
+			}
+			ii.load(diffs)
+
+			for y := vy0; y < vy1; y++ {
+				py0, py1 := max(y-nlmPatchRadius, vy0), min(y+nlmPatchRadius+1, vy1)
+				for x := vx0; x < vx1; x++ {
+					px0, px1 := max(x-nlmPatchRadius, vx0), min(x+nlmPatchRadius+1, vx1)
+					n := float64((px1 - px0) * (py1 - py0))
+					distance := ii.sum(px0, py0, px1, py1) / n
+
+					w := math.Exp(-distance / hSq)
+					i := y*width + x
+					total[i] += w * values[(y+dy)*width+x+dx]
+					weights[i] += w
+				}
+			}
+		}
+	}
+
+	denoised := image.NewGray(bounds)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			denoised.Pix[y*denoised.Stride+x] = uint8(math.Round(total[i] / weights[i]))
+		}
+	}
+	return denoised, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+)
+
+// maxPaletteColors bounds the n parameter of the palette endpoint
+const maxPaletteColors = 64
+
+// paletteColor is one dominant color and the share of pixels near it
+type paletteColor struct {
+	Color string  `json:"color"`
+	Share float64 `json:"share"` // percent of the image's pixels
+}
+
+// paletteResponse is the JSON body of the palette endpoint
+type paletteResponse struct {
+	Colors   []paletteColor `json:"colors"`
+	Seed     *int64         `json:"seed,omitempty"`
+	Warnings []string       `json:"warnings,omitempty"`
+}
+
+// dominantColors clusters the pixel colors of pixels into n groups with
+// k-means and returns the cluster centers, most common first
+func dominantColors(ctx context.Context, pixels [][3]float64, n int, workers int, params SegmentParams, result *Result) ([]paletteColor, error) {
+	clusters, err := kmeansCluster(ctx, pixels, n, workers, modeRand(params, result))
+	if err != nil {
+		return nil, err
+	}
+
+	colors := make([]paletteColor, 0, len(clusters.centers))
+	for c, center := range clusters.centers {
+		if clusters.counts[c] == 0 {
+			continue
+		}
+		colors = append(colors, paletteColor{
+			Color: fmt.Sprintf("#%02x%02x%02x", uint8(math.Round(center[0])), uint8(math.Round(center[1])), uint8(math.Round(center[2]))),
+			Share: math.Round(10000*float64(clusters.counts[c])/float64(len(pixels))) / 100,
+		})
+	}
+
+	sort.SliceStable(colors, func(i, j int) bool { return colors[i].Share > colors[j].Share })
+	return colors, nil
+}
+
+// paletteHandler returns the n dominant colors of an uploaded image with
+// their pixel shares, without producing an output image. The preprocessing
+// and seed fields of /api/upload apply.
+func paletteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse multipart form with 10MB max memory
+	err := parseLimitedMultipartForm(r, 10<<20)
+	if errors.Is(err, errFormLimit) {
+		writeError(w, r, codeFormLimit, "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Unable to parse form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// The body has been read: only the processing holds a worker
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	file, handler, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, r, codeMissingImage, "Error retrieving file")
+		return
+	}
+	defer file.Close()
+
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+
+	n := 5
+	if v := formValue(r, "n"); v != "" {
+		if n, err = parseIntField("n", v, 1, maxPaletteColors); err != nil {
+			writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+			return
+		}
+	}
+
+	var result Result
+	img, err := decodeInput(file, handler.Filename, params.decodeOptions(), &result)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeDecodeFailed), "Error decoding image: "+err.Error())
+		return
+	}
+	img, err = preprocessImage(img, params)
+	if isInvalidInput(err) {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeInternal, "Error processing image: "+err.Error())
+		return
+	}
+
+	var colors []paletteColor
+	pixels := imagePixels(img)
+	err = runWithWatchdog(r.Context(), "palette extraction", config.SegmentTimeout, func(ctx context.Context) error {
+		var err error
+		colors, err = dominantColors(ctx, pixels, n, config.KMeansWorkers, params, &result)
+		return err
+	})
+	if errors.Is(err, errSegmentTimeout) {
+		writeError(w, r, codeSegmentTimeout, "Error extracting palette: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeInternal, "Error extracting palette: "+err.Error())
+		return
+	}
+
+	writeJSON(w, r, paletteResponse{Colors: colors, Seed: result.Seed, Warnings: result.Warnings})
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// labelImage paints each pixel of a row-major label map with the color of
+// its label. Up to 256 labels the image is paletted, with palette entry i
+// for label i, so that outputs stay small and labels can be read back from
+// the pixel indices of an indexed PNG or GIF.
+func labelImage(bounds image.Rectangle, labels []int, colors []color.RGBA) image.Image {
+	width := bounds.Dx()
+	if len(colors) > 256 {
+		out := image.NewRGBA(bounds)
+		for i, label := range labels {
+			out.SetRGBA(bounds.Min.X+i%width, bounds.Min.Y+i/width, colors[label])
+		}
+		return out
+	}
+
+	palette := make(color.Palette, len(colors))
+	for i, c := range colors {
+		palette[i] = c
+	}
+	out := image.NewPaletted(bounds, palette)
+	for i, label := range labels {
+		out.SetColorIndex(bounds.Min.X+i%width, bounds.Min.Y+i/width, uint8(label))
+	}
+	return out
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Segmentation modes
+const (
+	modeBinary          = "binary"
+	modeContours        = "contours"
+	modeMeanShift       = "meanshift"
+	modeBands           = "bands"
+	modeKMeans          = "kmeans"
+	modeSauvola         = "sauvola"
+	modeBgSubtract      = "bgsubtract"
+	modeBlobs           = "blobs"
+	modeSideBySide      = "sidebyside"
+	modeRegionStats     = "regionstats"
+	modeDoG             = "dog"
+	modeSoftMask        = "softmask"
+	modeChromaKey       = "chromakey"
+	modeGradientHeatmap = "gradientheatmap"
+)
+
+// Channels that can feed the threshold comparison
+const (
+	channelLuma  = "luma"
+	channelRed   = "r"
+	channelGreen = "g"
+	channelBlue  = "b"
+)
+
+// SegmentParams holds the per-request options for segmentation
+type SegmentParams struct {
+	// Mode selects the segmentation output
+	Mode string
+
+	// Simplify is the Douglas-Peucker tolerance in pixels for contour mode
+	Simplify float64
+
+	// K is the number of color clusters in kmeans mode
+	K int
+
+	// Window is the side length in pixels of the neighbourhood used for
+	// local statistics in sauvola mode
+	Window int
+
+	// SauvolaK and SauvolaR are the sensitivity and the dynamic range of
+	// the standard deviation in the Sauvola threshold
+	SauvolaK float64
+	SauvolaR float64
+
+	// Sigma is the Gaussian scale in pixels of blob detection, which finds
+	// blobs of radius about Sigma*sqrt(2)
+	Sigma float64
+
+	// BlobThreshold is the minimum scale-normalized LoG response of a blob
+	BlobThreshold float64
+
+	// DoGSigma1 and DoGSigma2 are the Gaussian scales in pixels whose
+	// blurs are subtracted in dog mode, DoGSigma1 the smaller
+	DoGSigma1 float64
+	DoGSigma2 float64
+
+	// Softness is the width in gray levels of the ramp of softmask mode
+	Softness float64
+
+	// KeyColor is made transparent in chromakey mode, along with the colors
+	// within KeyTolerance of it in 8-bit RGB distance. SpillSuppression
+	// removes the tint it leaves on the edges of the kept pixels.
+	KeyColor         color.RGBA
+	KeyTolerance     float64
+	SpillSuppression bool
+
+	// HeatmapRamp is the color ramp of gradientheatmap mode
+	HeatmapRamp string
+
+	// Seed seeds the random source of randomized modes such as kmeans, or
+	// nil to pick one per request
+	Seed *int64
+
+	// SpatialRadius and ColorRadius are the meanshift bandwidths in pixels
+	// and 8-bit RGB units
+	SpatialRadius int
+	ColorRadius   float64
+
+	// OutputFormat is the file extension of the segmented image, or empty to
+	// use the extension of the upload's name, or outputInput to use the
+	// format of its content
+	OutputFormat string
+
+	// JPEGSubsampling is the chroma subsampling of JPEG output,
+	// jpegSubsampling420 or jpegSubsampling444
+	JPEGSubsampling string
+
+	// MinArea is the smallest region in pixels reported in regionstats mode
+	MinArea int
+
+	// Annotate draws the regions found in regionstats mode on an output image
+	Annotate bool
+
+	// Labels writes panel labels on the sidebyside composite
+	Labels bool
+
+	// StatsOnly returns the mask statistics instead of storing and
+	// encoding the segmented image
+	StatsOnly bool
+
+	// AllFrames segments every frame of an animated GIF instead of only the first
+	AllFrames bool
+
+	// AutoCrop trims the background borders of the segmented image
+	AutoCrop bool
+
+	// Preview segments only every PreviewStep-th pixel of every
+	// PreviewStep-th row of the preprocessed image, for a quick look
+	Preview     bool
+	PreviewStep int
+
+	// Background is composited under transparent pixels before thresholding
+	Background color.RGBA
+
+	// Alpha is how color values are read when flattening, alphaStraight or
+	// alphaPremultiplied
+	Alpha string
+
+	// WhiteBalance is the color cast correction, whiteBalanceNone,
+	// whiteBalanceGrayWorld or whiteBalanceWhitePatch
+	WhiteBalance string
+
+	// BestEffort accepts truncated JPEGs, decoding them as far as they go
+	BestEffort bool
+
+	// Orientation is the EXIF orientation (1-8) of the stored pixels,
+	// undone before any other transform
+	Orientation int
+
+	// Rotate is the clockwise rotation in degrees (0, 90, 180 or 270)
+	Rotate int
+
+	// Crop is the region to keep after rotation, or nil for the whole image
+	Crop *image.Rectangle
+
+	// ROI is the region of interest segmented within the preprocessed
+	// image, or nil for the whole image, and ROIOutput is whether the
+	// rest of the image is kept around it, roiOutputFull or roiOutputCrop.
+	// ROIFill is what surrounds it in full output, roiFillOriginal or one
+	// of roiFillColors.
+	ROI       *image.Rectangle
+	ROIOutput string
+	ROIFill   string
+
+	// Faces limits segmentation to the face regions tagged in the image's
+	// XMP metadata, segmenting the whole image when there are none
+	Faces bool
+
+	// OutWidth and OutHeight are the size the segmented image is resized to.
+	// Zero derives the dimension from the other one, or keeps the size if
+	// both are zero.
+	OutWidth  int
+	OutHeight int
+
+	// Interpolation is the resampling method of the resize, one of the
+	// interpolation constants
+	Interpolation string
+
+	// Denoise is the filter applied to the selected channel before
+	// thresholding, denoiseNone or denoiseNLM, and DenoiseStrength is the
+	// non-local means filtering parameter h in gray levels
+	Denoise         string
+	DenoiseStrength float64
+
+	// Channel selects which channel is compared against the threshold
+	Channel string
+
+	// Threshold is the gray level (0-255) above which pixels are foreground
+	Threshold uint8
+
+	// Reference is the background image subtracted in bgsubtract mode
+	Reference image.Image
+
+	// DiffThreshold is the difference from the reference above which
+	// pixels are foreground in bgsubtract mode
+	DiffThreshold uint8
+
+	// Cutoffs are the ascending intensity thresholds separating the bands
+	// in bands mode
+	Cutoffs []uint8
+
+	// Thresholds are the extra thresholds binary mode returns overlays of,
+	// to compare them in one request
+	Thresholds []uint8
+
+	// Connectivity is 4 or 8, whether pixels touching only at a corner
+	// belong to the same region in flood fills, contours and statistics
+	Connectivity int
+
+	// Despeckle is the size in pixels below which foreground specks are
+	// removed and background holes filled, or 0 to keep the mask as is
+	Despeckle int
+
+	// Debug selects a diagnostic image returned instead of the result,
+	// debugNone or debugThreshMap for the local threshold surface
+	Debug string
+
+	// BitDepth is the bits per sample of grayscale outputs, 8 or 16
+	BitDepth int
+
+	// Hysteresis enables dual-threshold binarization using Low and High
+	Hysteresis bool
+	Low        uint8
+	High       uint8
+
+	// fields are the segmentation fields the request gave, by name
+	fields map[string]string
+}
+
+// defaultSegmentParams returns the options used when a request sets none
+func defaultSegmentParams() SegmentParams {
+	return SegmentParams{
+		Mode:             config.DefaultMode,
+		Background:       color.RGBA{255, 255, 255, 255},
+		Alpha:            alphaStraight,
+		JPEGSubsampling:  jpegSubsampling420,
+		ROIOutput:        roiOutputFull,
+		ROIFill:          roiFillOriginal,
+		BitDepth:         8,
+		Orientation:      1,
+		Channel:          channelLuma,
+		Threshold:        128,
+		DiffThreshold:    32,
+		K:                4,
+		Window:           15,
+		Sigma:            2,
+		BlobThreshold:    10,
+		DoGSigma1:        1,
+		DoGSigma2:        1.6,
+		Softness:         8,
+		KeyColor:         color.RGBA{0, 255, 0, 255},
+		KeyTolerance:     100,
+		SpillSuppression: true,
+		HeatmapRamp:      heatmapRampRainbow,
+		Interpolation:    interpolationAuto,
+		PreviewStep:      4,
+		SauvolaK:         0.34,
+		SauvolaR:         128,
+		SpatialRadius:    8,
+		ColorRadius:      16,
+		DenoiseStrength:  10,
+		Connectivity:     8,
+		MinArea:          1,
+	}
+}
+
+// modeDefaults replaces the defaults of some fields with values suited to
+// one mode, the others keeping the defaults of defaultSegmentParams
+var modeDefaults = map[string]func(params *SegmentParams){
+	// Specks and pixel stairs would each become a path of their own
+	modeContours: func(params *SegmentParams) {
+		params.Despeckle = 4
+		params.Simplify = 1
+	},
+	// Sensor noise in the difference leaves isolated foreground pixels
+	modeBgSubtract: func(params *SegmentParams) {
+		params.Despeckle = 4
+	},
+	// Single pixels would flood the region list
+	modeRegionStats: func(params *SegmentParams) {
+		params.MinArea = 16
+	},
+}
+
+// modeDefaultParams returns the options used when a request selects mode
+// and sets nothing else
+func modeDefaultParams(mode string) SegmentParams {
+	params := defaultSegmentParams()
+	params.Mode = mode
+	if apply := modeDefaults[mode]; apply != nil {
+		apply(&params)
+	}
+	return params
+}
+
+// parseSegmentParams reads the segmentation options from the request form,
+// or from the JSON object of its params field, see segmentFields. Every
+// field is validated against segmentParamSchema and all invalid fields are
+// reported together in a paramErrors.
+func parseSegmentParams(r *http.Request) (SegmentParams, error) {
+	params := defaultSegmentParams()
+	var problems paramErrors
+
+	schema := segmentParamSchema()
+	value, err := segmentFields(r, schema)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// The mode is read first so that the other fields start from its
+	// defaults
+	for _, spec := range schema {
+		if spec.Name != "mode" {
+			continue
+		}
+		if v := value(spec.Name); v != "" {
+			if err := spec.parse(&params, v); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+	params = modeDefaultParams(params.Mode)
+	params.fields = map[string]string{}
+
+	for _, spec := range schema {
+		if spec.parse == nil || spec.Name == "mode" {
+			continue
+		}
+		if v := value(spec.Name); v != "" {
+			params.fields[spec.Name] = v
+			if err := spec.parse(&params, v); err != nil {
+				problems = append(problems, err.Error())
+			}
+		}
+	}
+
+	// Checks across fields
+	if params.StatsOnly && !statsModes[params.Mode] {
+		problems = append(problems, "stats_only requires binary, sauvola or bgsubtract mode")
+	}
+	if params.StatsOnly && params.AllFrames {
+		problems = append(problems, "stats_only cannot be combined with all_frames")
+	}
+	if nearestModes[params.Mode] && params.Interpolation != interpolationAuto && params.Interpolation != interpolationNearest {
+		problems = append(problems, fmt.Sprintf("interpolation %s cannot be used in %s mode, whose output is always resized with nearest", params.Interpolation, params.Mode))
+	}
+	if params.Preview && params.AllFrames {
+		problems = append(problems, "preview cannot be combined with all_frames")
+	}
+	if params.AutoCrop && (params.StatsOnly || params.AllFrames || params.OutputFormat == outputSVG) {
+		problems = append(problems, "autocrop cannot be combined with stats_only, all_frames or svg output")
+	}
+	if params.Denoise != denoiseNone && params.Mode != modeBinary && params.Mode != modeContours && params.Mode != modeSauvola {
+		problems = append(problems, "denoise requires binary, contours or sauvola mode")
+	}
+	if params.Mode == modeChromaKey && (params.OutputFormat == "" || params.OutputFormat == outputInput) {
+		params.OutputFormat = "png"
+	}
+	// A deployment-wide output format overrides the request's
+	if config.ForceOutputFormat != "" && params.OutputFormat != outputSVG && params.OutputFormat != outputRLE {
+		params.OutputFormat = config.ForceOutputFormat
+	}
+	if params.OutputFormat == outputSVG && params.Mode != modeContours {
+		problems = append(problems, "output_format svg requires contours mode")
+	}
+	if params.OutputFormat == outputRLE && !rleModes[params.Mode] {
+		problems = append(problems, "output_format rle requires binary, sauvola or bgsubtract mode")
+	}
+	if params.Mode == modeChromaKey && params.OutputFormat != "png" {
+		problems = append(problems, "chromakey mode requires png output")
+	}
+	if params.Debug != debugNone && params.Mode != modeSauvola {
+		problems = append(problems, "debug requires sauvola mode")
+	}
+	if params.Debug != debugNone && params.StatsOnly {
+		problems = append(problems, "debug cannot be combined with stats_only")
+	}
+	if params.Mode == modeDoG && params.DoGSigma2 <= params.DoGSigma1 {
+		problems = append(problems, fmt.Sprintf("dog_sigma2 (%g) must be greater than dog_sigma1 (%g)", params.DoGSigma2, params.DoGSigma1))
+	}
+	if params.Mode == modeBands && len(params.Cutoffs) == 0 && value("cutoffs") == "" {
+		problems = append(problems, "bands mode requires cutoffs")
+	}
+
+	var roi [4]int
+	given := 0
+	for i, name := range []string{"roi_x", "roi_y", "roi_w", "roi_h"} {
+		if v := value(name); v != "" {
+			roi[i], _ = strconv.Atoi(v)
+			given++
+		}
+	}
+	switch {
+	case given == 0:
+	case given < 4:
+		problems = append(problems, "roi_x, roi_y, roi_w and roi_h must be given together")
+	case !roiModes[params.Mode]:
+		names := roiModeNames()
+		problems = append(problems, fmt.Sprintf("roi requires %s or %s mode", strings.Join(names[:len(names)-1], ", "), names[len(names)-1]))
+	case params.AllFrames:
+		problems = append(problems, "roi cannot be combined with all_frames")
+	default:
+		rect := image.Rect(roi[0], roi[1], roi[0]+roi[2], roi[1]+roi[3])
+		if params.Preview {
+			if rect = previewRect(rect, params.PreviewStep); rect.Empty() {
+				problems = append(problems, fmt.Sprintf("roi holds no pixel of the preview taken every %d pixels", params.PreviewStep))
+			}
+		}
+		params.ROI = &rect
+	}
+
+	// Face regions are in the coordinates of the image as stored
+	if params.Faces {
+		switch {
+		case !roiModes[params.Mode]:
+			names := roiModeNames()
+			problems = append(problems, fmt.Sprintf("faces requires %s or %s mode", strings.Join(names[:len(names)-1], ", "), names[len(names)-1]))
+		case params.ROI != nil || given > 0:
+			problems = append(problems, "faces cannot be combined with roi")
+		case params.Orientation != 1 || params.Rotate != 0 || params.Crop != nil:
+			problems = append(problems, "faces cannot be combined with orientation, rotate or crop")
+		case params.StatsOnly || params.AllFrames:
+			problems = append(problems, "faces cannot be combined with stats_only or all_frames")
+		case params.Preview:
+			problems = append(problems, "faces cannot be combined with preview")
+		}
+	}
+
+	low, high := value("low"), value("high")
+	switch {
+	case low == "" && high == "":
+	case low == "" || high == "":
+		problems = append(problems, "low and high must be given together")
+	case params.Low > params.High:
+		problems = append(problems, fmt.Sprintf("low (%d) must not exceed high (%d)", params.Low, params.High))
+	default:
+		params.Hysteresis = true
+	}
+	if len(params.Thresholds) > 0 && params.Mode != modeBinary {
+		problems = append(problems, "thresholds requires binary mode")
+	}
+	if len(params.Thresholds) > 0 && (params.Hysteresis || params.StatsOnly || params.AllFrames || params.Faces) {
+		problems = append(problems, "thresholds cannot be combined with low/high, stats_only, all_frames or faces")
+	}
+
+	// The background is only decoded once every field is known to be valid
+	if len(problems) > 0 {
+		return params, problems
+	}
+	if params.Mode == modeBgSubtract {
+		var err error
+		if params.Reference, err = parseReferenceImage(r); err != nil {
+			return params, err
+		}
+	}
+
+	return params, nil
+}
+
+// decodeOptions returns the decoder settings selected by the request
+func (p SegmentParams) decodeOptions() decodeOptions {
+	return decodeOptions{BestEffort: p.BestEffort, Fill: p.Background}
+}
+
+// encodeOptions returns the encoder settings selected by the request, PNG
+// output recording the parameters behind result
+func (p SegmentParams) encodeOptions(result *Result) encodeOptions {
+	return encodeOptions{JPEGSubsampling: p.JPEGSubsampling, PNGText: provenanceText(p, result)}
+}
+
+// segmentFields returns the lookup of the segmentation fields of a request.
+// The params form field may hold a JSON object of fields, whose values
+// take precedence over the individual form fields of the same names and
+// are read like them, arrays such as cutoffs being joined with commas.
+// Names that are not in schema are rejected there, since they are most
+// likely typos.
+func segmentFields(r *http.Request, schema []paramSpec) (func(name string) string, error) {
+	fallback := func(name string) string { return formValue(r, name) }
+	raw := formValue(r, "params")
+	if raw == "" {
+		return fallback, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &fields); err != nil || fields == nil {
+		return fallback, fieldError("params", raw, "expected a JSON object")
+	}
+	known := map[string]bool{}
+	for _, spec := range schema {
+		known[spec.Name] = true
+	}
+	var unknown []string
+	for name := range fields {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fallback, fmt.Errorf("params has unknown fields %s", strings.Join(unknown, ", "))
+	}
+	values, err := jsonFormValues(fields)
+	if err != nil {
+		return fallback, fmt.Errorf("params: %v", err)
+	}
+
+	return func(name string) string {
+		if _, ok := values[name]; ok {
+			return strings.TrimSpace(values.Get(name))
+		}
+		return formValue(r, name)
+	}, nil
+}
+
+// formValue returns a form field with surrounding whitespace removed
+func formValue(r *http.Request, name string) string {
+	return strings.TrimSpace(r.FormValue(name))
+}
+
+// fieldError reports an invalid form field, naming the field and the value
+func fieldError(name string, v string, reason string) error {
+	return fmt.Errorf("invalid %s value %q (%s)", name, v, reason)
+}
+
+// parseIntField parses a base 10 integer field within [lo, hi]
+func parseIntField(name string, v string, lo int, hi int) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fieldError(name, v, "not an integer")
+	}
+	if n < lo || n > hi {
+		return 0, fieldError(name, v, fmt.Sprintf("expected %d-%d", lo, hi))
+	}
+	return n, nil
+}
+
+// parseFloatField parses a finite decimal field within [lo, hi]. Only '.' is
+// accepted as the decimal separator, whatever the client's locale.
+func parseFloatField(name string, v string, lo float64, hi float64) (float64, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		if strings.Contains(v, ",") {
+			return 0, fieldError(name, v, "not a number, use '.' as the decimal separator")
+		}
+		return 0, fieldError(name, v, "not a number")
+	}
+	if f < lo || f > hi {
+		if math.IsInf(hi, 1) {
+			return 0, fieldError(name, v, fmt.Sprintf("expected at least %g", lo))
+		}
+		return 0, fieldError(name, v, fmt.Sprintf("expected %g-%g", lo, hi))
+	}
+	return f, nil
+}
+
+// parseBoolField parses a boolean field such as true, false, 1 or 0
+func parseBoolField(name string, v string) (bool, error) {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fieldError(name, v, "expected true or false")
+	}
+	return b, nil
+}
+
+// parseIntensity parses a 0-255 intensity value
+func parseIntensity(name string, v string) (uint8, error) {
+	n, err := parseIntField(name, v, 0, 255)
+	return uint8(n), err
+}
+
+// parseReferenceImage decodes the background form file used by bgsubtract mode
+func parseReferenceImage(r *http.Request) (image.Image, error) {
+	file, header, err := r.FormFile("background")
+	if err != nil {
+		return nil, fmt.Errorf("bgsubtract mode requires a background image")
+	}
+	defer file.Close()
+
+	// The background goes through the same color conversion as the image
+	var scratch Result
+	img, err := decodeInput(file, header.Filename, decodeOptions{}, &scratch)
+	if err != nil {
+		return nil, fmt.Errorf("%w background image: %w", errDecodeFailed, err)
+	}
+	return img, nil
+}
+
+// parseHexColor parses an opaque color written as rrggbb or #rrggbb
+func parseHexColor(v string) (color.RGBA, error) {
+	v = strings.TrimPrefix(v, "#")
+	if len(v) != 6 {
+		return color.RGBA{}, fmt.Errorf("invalid color %q", v)
+	}
+	n, err := strconv.ParseUint(v, 16, 32)
+	if err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 255}, nil
+}
+
+// parseRect parses a rectangle written as x,y,w,h
+func parseRect(v string) (image.Rectangle, error) {
+	parts := strings.Split(v, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("expected 4 values, got %d", len(parts))
+	}
+
+	var n [4]int
+	for i, part := range parts {
+		var err error
+		if n[i], err = strconv.Atoi(strings.TrimSpace(part)); err != nil {
+			return image.Rectangle{}, fmt.Errorf("%q is not an integer", strings.TrimSpace(part))
+		}
+	}
+	if n[0] < 0 || n[1] < 0 || n[2] <= 0 || n[3] <= 0 {
+		return image.Rectangle{}, fmt.Errorf("negative or empty rectangle")
+	}
+
+	return image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+)
+
+// jpegPadBytesPerBlock is the padding appended per 8x8 block of a
+// truncated JPEG, enough for the few bits each padded block decodes from
+const jpegPadBytesPerBlock = 32
+
+// decodePartialJPEG decodes a truncated JPEG as far as its data goes. The
+// missing tail of the entropy-coded data is padded so the decoder can
+// finish, once with zero bits and once with a different bit pattern: rows
+// that decode the same both times come from the file, the others are
+// filled with fill. It returns the image and the first filled row, which
+// is the height of the image when every row could be recovered.
+func decodePartialJPEG(data []byte, fill color.RGBA) (image.Image, int, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// A trailing 0xff starts a stuffed byte or a marker that is cut off
+	data = bytes.TrimSuffix(data, []byte{0xff, 0xd9})
+	data = bytes.TrimRight(data, "\xff")
+	blocks := ((cfg.Width + 7) / 8) * ((cfg.Height + 7) / 8) * 4
+	padded := func(first byte) []byte {
+		b := make([]byte, len(data), len(data)+blocks*jpegPadBytesPerBlock+2)
+		copy(b, data)
+		b = append(b, first)
+		b = append(b, make([]byte, blocks*jpegPadBytesPerBlock-1)...)
+		return append(b, 0xff, 0xd9)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(padded(0x00)))
+	if err != nil {
+		return nil, 0, err
+	}
+	other, err := jpeg.Decode(bytes.NewReader(padded(0x80)))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	bounds := img.Bounds()
+	missing := bounds.Dy()
+	for y := 0; y < bounds.Dy() && missing == bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if img.At(bounds.Min.X+x, bounds.Min.Y+y) != other.At(bounds.Min.X+x, bounds.Min.Y+y) {
+				missing = y
+				break
+			}
+		}
+	}
+	if missing == bounds.Dy() {
+		return img, missing, nil
+	}
+
+	// The row of blocks holding the first difference was cut part way
+	missing -= missing % jpegMCUHeight(img)
+	rows := image.Rect(bounds.Min.X, bounds.Min.Y+missing, bounds.Max.X, bounds.Max.Y)
+	switch m := img.(type) {
+	case *image.YCbCr:
+		// Stays YCbCr so the recovered rows keep their exact colors
+		yy, cb, cr := color.RGBToYCbCr(fill.R, fill.G, fill.B)
+		for y := rows.Min.Y; y < rows.Max.Y; y++ {
+			for x := rows.Min.X; x < rows.Max.X; x++ {
+				m.Y[m.YOffset(x, y)] = yy
+				m.Cb[m.COffset(x, y)], m.Cr[m.COffset(x, y)] = cb, cr
+			}
+		}
+	case draw.Image:
+		draw.Draw(m, rows, &image.Uniform{fill}, image.Point{}, draw.Src)
+	}
+	return img, missing, nil
+}
+
+// jpegMCUHeight returns the height in pixels of a row of minimum coded
+// units of a decoded JPEG, chroma subsampled vertically doubling it
+func jpegMCUHeight(img image.Image) int {
+	if ycc, ok := img.(*image.YCbCr); ok {
+		switch ycc.SubsampleRatio {
+		case image.YCbCrSubsampleRatio420, image.YCbCrSubsampleRatio440, image.YCbCrSubsampleRatio410:
+			return 16
+		}
+	}
+	return 8
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// pngHeaderLen is the length of the PNG signature and IHDR chunk, which
+// the encoder writes first and which must precede every other chunk
+const pngHeaderLen = 8 + 4 + 4 + 13 + 4
+
+// pngText is a tEXt chunk of PNG output
+type pngText struct {
+	Keyword string
+	Text    string
+}
+
+// provenanceText returns the tEXt chunks recording how an output was
+// made: the software, and as JSON the parameters it was segmented with,
+// including a generated seed
+func provenanceText(params SegmentParams, result *Result) []pngText {
+	used := usedParameters(params)
+	if result != nil && result.Seed != nil {
+		used["seed"] = *result.Seed
+	}
+	data, err := json.Marshal(used)
+	if err != nil {
+		return nil
+	}
+	return []pngText{
+		{"Software", "Remote-Image-Segmentation"},
+		{"Segmentation parameters", asciiJSON(string(data))},
+	}
+}
+
+// asciiJSON escapes the non-ASCII characters of a JSON document, tEXt
+// chunks holding Latin-1 only
+func asciiJSON(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r < 0x80:
+			b.WriteRune(r)
+		case r > 0xffff:
+			r -= 0x10000
+			fmt.Fprintf(&b, `\u%04x\u%04x`, 0xd800+(r>>10), 0xdc00+(r&0x3ff))
+		default:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String()
+}
+
+// appendPNGChunk appends a chunk with its length and CRC to b
+func appendPNGChunk(b []byte, kind string, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	start := len(b)
+	b = append(append(b, kind...), data...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(b[start:]))
+}
+
+// pngTextWriter inserts tEXt chunks right after the IHDR chunk of the PNG
+// stream written through it
+type pngTextWriter struct {
+	w      io.Writer
+	head   int
+	chunks []byte
+}
+
+func newPNGTextWriter(w io.Writer, texts []pngText) *pngTextWriter {
+	var chunks []byte
+	for _, t := range texts {
+		chunks = appendPNGChunk(chunks, "tEXt", []byte(t.Keyword+"\x00"+t.Text))
+	}
+	return &pngTextWriter{w: w, head: pngHeaderLen, chunks: chunks}
+}
+
+func (t *pngTextWriter) Write(p []byte) (int, error) {
+	n := 0
+	if t.head > 0 {
+		n = min(t.head, len(p))
+		if _, err := t.w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+		t.head -= n
+		if p = p[n:]; t.head > 0 {
+			return n, nil
+		}
+		if _, err := t.w.Write(t.chunks); err != nil {
+			return n, err
+		}
+	}
+	m, err := t.w.Write(p)
+	return n + m, err
+}
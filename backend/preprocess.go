@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Interpretations of the color values of images with an alpha channel
+const (
+	alphaStraight      = "straight"
+	alphaPremultiplied = "premultiplied"
+)
+
+// flattenAlpha composites an image with transparency over a solid background
+// so that transparent pixels threshold predictably. Opaque images are
+// returned unchanged.
+//
+// With alphaStraight the stored color values are independent of alpha, as
+// the PNG format specifies, and are weighted by alpha when compositing. With
+// alphaPremultiplied they are taken to be already multiplied by alpha, as
+// written by some tools, and only the background is weighted.
+func flattenAlpha(img image.Image, background color.RGBA, alpha string) image.Image {
+	if o, ok := img.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return img
+	}
+
+	bounds := img.Bounds()
+	flat := image.NewRGBA(bounds)
+	if alpha != alphaPremultiplied {
+		draw.Draw(flat, bounds, &image.Uniform{background}, image.Point{}, draw.Src)
+		draw.Draw(flat, bounds, img, bounds.Min, draw.Over)
+		return flat
+	}
+
+	bg := [3]uint32{uint32(background.R), uint32(background.G), uint32(background.B)}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// NRGBA64 exposes the stored values of non-premultiplied images
+			c := color.NRGBA64Model.Convert(img.At(x, y)).(color.NRGBA64)
+			stored := [3]uint32{uint32(c.R), uint32(c.G), uint32(c.B)}
+			var out [3]uint8
+			for i := range out {
+				v := stored[i] + bg[i]*0x101*(0xffff-uint32(c.A))/0xffff
+				out[i] = uint8(min(v, 0xffff) >> 8)
+			}
+			flat.SetRGBA(x, y, color.RGBA{out[0], out[1], out[2], 255})
+		}
+	}
+	return flat
+}
+
+// errInvalidCrop is returned when the crop region does not fit the image
+var errInvalidCrop = errors.New("invalid crop region")
+
+// errImageTooSmall is returned for images below the minimum dimension
+var errImageTooSmall = errors.New("image too small")
+
+// isInvalidInput reports whether a segmentation error was caused by the
+// request rather than by the server
+func isInvalidInput(err error) bool {
+	return errors.Is(err, errInvalidCrop) || errors.Is(err, errImageTooSmall) ||
+		errors.Is(err, errImageTooLarge) || errors.Is(err, errSizeMismatch) ||
+		errors.Is(err, errDecodeFailed) || errors.Is(err, errExtremeAspectRatio) ||
+		errors.Is(err, errTooManyClusters)
+}
+
+// checkImageSize rejects images whose width or height is below the
+// configured minimum, which are almost always uploaded by mistake
+func checkImageSize(bounds image.Rectangle) error {
+	if min := config.MinImageDimension; bounds.Dx() < min || bounds.Dy() < min {
+		return fmt.Errorf("%w: %dx%d is below the minimum of %dx%d",
+			errImageTooSmall, bounds.Dx(), bounds.Dy(), min, min)
+	}
+	return nil
+}
+
+// preprocessImage applies the requested input transforms before
+// segmentation: alpha flattening, white balance, then orientation,
+// rotation and cropping. The crop region is relative to the rotated image.
+func preprocessImage(img image.Image, params SegmentParams) (image.Image, error) {
+	if err := checkImageSize(img.Bounds()); err != nil {
+		return nil, err
+	}
+
+	img = flattenAlpha(img, params.Background, params.Alpha)
+	img = whiteBalance(img, params.WhiteBalance)
+
+	img = orientImage(img, params.Orientation)
+
+	if params.Rotate != 0 {
+		img = rotateImage(img, params.Rotate)
+	}
+
+	if params.Crop != nil {
+		cropped, err := cropImage(img, *params.Crop)
+		if err != nil {
+			return nil, err
+		}
+		img = cropped
+	}
+
+	if params.Preview {
+		img = subsampleImage(img, params.PreviewStep)
+	}
+
+	if config.AspectRatioPolicy == aspectReject {
+		if err := checkAspectRatio(img.Bounds()); err != nil {
+			return nil, err
+		}
+	}
+
+	return img, nil
+}
+
+// newImageLike allocates an image of the given bounds that can hold the
+// pixels of img without loss. Grayscale images stay grayscale so their
+// levels, including 16-bit ones, survive rotation and cropping exactly;
+// everything else is copied into RGBA.
+func newImageLike(img image.Image, bounds image.Rectangle) draw.Image {
+	switch img.(type) {
+	case *image.Gray:
+		return image.NewGray(bounds)
+	case *image.Gray16:
+		return image.NewGray16(bounds)
+	default:
+		return image.NewRGBA(bounds)
+	}
+}
+
+// rotateImage rotates an image clockwise by 90, 180 or 270 degrees
+func rotateImage(img image.Image, degrees int) draw.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var rotated draw.Image
+	if degrees == 180 {
+		rotated = newImageLike(img, image.Rect(0, 0, width, height))
+	} else {
+		rotated = newImageLike(img, image.Rect(0, 0, height, width))
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := img.At(bounds.Min.X+x, bounds.Min.Y+y)
+			switch degrees {
+			case 90:
+				rotated.Set(height-1-y, x, c)
+			case 180:
+				rotated.Set(width-1-x, height-1-y, c)
+			case 270:
+				rotated.Set(y, width-1-x, c)
+			}
+		}
+	}
+
+	return rotated
+}
+
+// degreeOrientations maps the clockwise rotations accepted by the
+// orientation field to the EXIF orientation they undo
+var degreeOrientations = map[int]int{0: 1, 90: 6, 180: 3, 270: 8}
+
+// orientImage turns an image stored with the given EXIF orientation
+// upright: 3, 6 and 8 rotate it clockwise by 180, 90 and 270 degrees, 2
+// and 4 mirror it horizontally and vertically, 5 and 7 transpose it
+// across its main and its anti-diagonal
+func orientImage(img image.Image, orientation int) image.Image {
+	switch orientation {
+	case 1:
+		return img
+	case 3:
+		return rotateImage(img, 180)
+	case 6:
+		return rotateImage(img, 90)
+	case 8:
+		return rotateImage(img, 270)
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	var oriented draw.Image
+	if orientation == 5 || orientation == 7 {
+		oriented = newImageLike(img, image.Rect(0, 0, height, width))
+	} else {
+		oriented = newImageLike(img, image.Rect(0, 0, width, height))
+	}
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := img.At(bounds.Min.X+x, bounds.Min.Y+y)
+			switch orientation {
+			case 2:
+				oriented.Set(width-1-x, y, c)
+			case 4:
+				oriented.Set(x, height-1-y, c)
+			case 5:
+				oriented.Set(y, x, c)
+			case 7:
+				oriented.Set(height-1-y, width-1-x, c)
+			}
+		}
+	}
+
+	return oriented
+}
+
+// cropImage copies the region r, given relative to the image origin, into a new image
+func cropImage(img image.Image, r image.Rectangle) (draw.Image, error) {
+	bounds := img.Bounds()
+	region := r.Add(bounds.Min)
+	if r.Empty() || !region.In(bounds) {
+		return nil, fmt.Errorf("%w: %d,%d,%d,%d does not fit in a %dx%d image",
+			errInvalidCrop, r.Min.X, r.Min.Y, r.Dx(), r.Dy(), bounds.Dx(), bounds.Dy())
+	}
+
+	cropped := newImageLike(img, image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), img, region.Min, draw.Src)
+	return cropped, nil
+}
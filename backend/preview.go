@@ -0,0 +1,23 @@
+package main
+
+import "image"
+
+// subsampleImage keeps every step-th pixel of every step-th row, starting
+// with the top-left one, for a quick preview of a large image
+func subsampleImage(img image.Image, step int) image.Image {
+	bounds := img.Bounds()
+	out := newImageLike(img, image.Rect(0, 0, (bounds.Dx()+step-1)/step, (bounds.Dy()+step-1)/step))
+	for y := 0; y < out.Bounds().Dy(); y++ {
+		for x := 0; x < out.Bounds().Dx(); x++ {
+			out.Set(x, y, img.At(bounds.Min.X+x*step, bounds.Min.Y+y*step))
+		}
+	}
+	return out
+}
+
+// previewRect maps a rectangle of the full-resolution image to the pixels
+// of its preview taken every step pixels
+func previewRect(r image.Rectangle, step int) image.Rectangle {
+	ceil := func(v int) int { return (v + step - 1) / step }
+	return image.Rect(ceil(r.Min.X), ceil(r.Min.Y), ceil(r.Max.X), ceil(r.Max.Y))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upload states reported by the progress endpoint
+const (
+	stateUploading  = "uploading"
+	stateProcessing = "processing"
+	stateDone       = "done"
+	stateFailed     = "failed"
+)
+
+// Errors starting to track an upload
+var (
+	errUploadIDInUse  = errors.New("Upload-ID is already in use")
+	errTooManyTracked = errors.New("too many uploads are being tracked")
+)
+
+// uploadProgress tracks one upload identified by its Upload-ID
+type uploadProgress struct {
+	received atomic.Int64
+	total    int64 // from Content-Length, -1 if unknown
+
+	mu       sync.Mutex
+	state    string
+	finished time.Time // zero until the upload has finished
+}
+
+// setState moves the upload to state, starting the retention period once
+// it has finished. It does nothing for untracked uploads (nil p).
+func (p *uploadProgress) setState(state string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state = state
+	if state == stateDone || state == stateFailed {
+		p.finished = time.Now()
+	}
+}
+
+// fail marks an upload that did not complete successfully
+func (p *uploadProgress) fail() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	done := p.state == stateDone
+	p.mu.Unlock()
+	if !done {
+		p.setState(stateFailed)
+	}
+}
+
+// expired reports whether the upload finished more than retention ago
+func (p *uploadProgress) expired(now time.Time, retention time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.finished.IsZero() && now.Sub(p.finished) > retention
+}
+
+// progressTracker holds the progress of uploads that sent an Upload-ID.
+// Finished uploads are dropped after the retention period, and at most
+// limit uploads are tracked at once so the map cannot grow without bound.
+type progressTracker struct {
+	mu        sync.RWMutex
+	entries   map[string]*uploadProgress
+	limit     int
+	retention time.Duration
+}
+
+// newProgressTracker returns a tracker of at most limit uploads, or any
+// number if limit is 0, keeping finished uploads for retention
+func newProgressTracker(limit int, retention time.Duration) *progressTracker {
+	return &progressTracker{entries: make(map[string]*uploadProgress), limit: limit, retention: retention}
+}
+
+var uploadProgresses = newProgressTracker(config.MaxTrackedUploads, config.ProgressRetention)
+
+// start registers a new upload of total bytes under id. It fails if the id
+// is used by an upload that is still tracked or if the tracker is full.
+func (t *progressTracker) start(id string, total int64) (*uploadProgress, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for k, p := range t.entries {
+		if p.expired(now, t.retention) {
+			delete(t.entries, k)
+		}
+	}
+
+	if _, ok := t.entries[id]; ok {
+		return nil, errUploadIDInUse
+	}
+	if t.limit > 0 && len(t.entries) >= t.limit {
+		return nil, errTooManyTracked
+	}
+	p := &uploadProgress{total: total, state: stateUploading}
+	t.entries[id] = p
+	return p, nil
+}
+
+// get returns the upload tracked under id, or nil if there is none or its
+// retention period is over
+func (t *progressTracker) get(id string) *uploadProgress {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	p := t.entries[id]
+	if p == nil || p.expired(time.Now(), t.retention) {
+		return nil
+	}
+	return p
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	progress *uploadProgress
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.progress.received.Add(int64(n))
+	return n, err
+}
+
+// progressResponse is the JSON body of the progress endpoint
+type progressResponse struct {
+	State         string `json:"state"`
+	ReceivedBytes int64  `json:"received_bytes"`
+	TotalBytes    int64  `json:"total_bytes,omitempty"`
+}
+
+// progressHandler reports the progress of the upload named by the id query
+// parameter, so a client can tell a slow upload from a slow segmentation
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	p := uploadProgresses.get(r.URL.Query().Get("id"))
+	if p == nil {
+		writeError(w, r, codeNotFound, "Unknown upload")
+		return
+	}
+
+	p.mu.Lock()
+	resp := progressResponse{State: p.state, ReceivedBytes: p.received.Load()}
+	p.mu.Unlock()
+	if p.total > 0 {
+		resp.TotalBytes = p.total
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, r, resp)
+}
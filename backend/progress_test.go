@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// finishAt marks p as finished at the given time, so tests can age entries
+// without sleeping
+func finishAt(p *uploadProgress, state string, at time.Time) {
+	p.setState(state)
+	p.mu.Lock()
+	p.finished = at
+	p.mu.Unlock()
+}
+
+func TestProgressTrackerConcurrentUploads(t *testing.T) {
+	tracker := newProgressTracker(0, time.Minute)
+	const uploads = 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < uploads; i++ {
+		id := fmt.Sprintf("upload-%d", i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			p, err := tracker.start(id, 100)
+			if err != nil {
+				t.Errorf("start %s: %v", id, err)
+				return
+			}
+			p.received.Add(100)
+			p.setState(stateProcessing)
+			p.setState(stateDone)
+		}()
+		// Status queries race with the upload they ask about
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if p := tracker.get(id); p != nil {
+					p.mu.Lock()
+					_ = p.state
+					p.mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < uploads; i++ {
+		id := fmt.Sprintf("upload-%d", i)
+		p := tracker.get(id)
+		if p == nil {
+			t.Fatalf("%s is not tracked", id)
+		}
+		if p.state != stateDone || p.received.Load() != 100 {
+			t.Errorf("%s: state %s with %d bytes, want done with 100", id, p.state, p.received.Load())
+		}
+	}
+}
+
+func TestProgressTrackerDuplicateID(t *testing.T) {
+	tracker := newProgressTracker(0, time.Minute)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	started, inUse := 0, 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := tracker.start("same", -1)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				started++
+			case errors.Is(err, errUploadIDInUse):
+				inUse++
+			default:
+				t.Errorf("start: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if started != 1 || inUse != 49 {
+		t.Errorf("%d starts succeeded and %d were rejected, want 1 and 49", started, inUse)
+	}
+}
+
+func TestProgressTrackerLimit(t *testing.T) {
+	tracker := newProgressTracker(2, time.Minute)
+
+	first, err := tracker.start("a", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.start("b", -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tracker.start("c", -1); !errors.Is(err, errTooManyTracked) {
+		t.Fatalf("third upload: got %v, want %v", err, errTooManyTracked)
+	}
+
+	// A finished upload keeps its slot until its retention is over
+	finishAt(first, stateDone, time.Now())
+	if _, err := tracker.start("c", -1); !errors.Is(err, errTooManyTracked) {
+		t.Fatalf("upload after a recent finish: got %v, want %v", err, errTooManyTracked)
+	}
+
+	finishAt(first, stateDone, time.Now().Add(-2*time.Minute))
+	if _, err := tracker.start("c", -1); err != nil {
+		t.Fatalf("upload after an expired finish: %v", err)
+	}
+	if tracker.get("a") != nil {
+		t.Error("expired upload a is still tracked")
+	}
+}
+
+func TestProgressTrackerRetention(t *testing.T) {
+	tracker := newProgressTracker(0, time.Minute)
+
+	running, _ := tracker.start("running", -1)
+	failed, _ := tracker.start("failed", -1)
+	done, _ := tracker.start("done", -1)
+	long := time.Now().Add(-time.Hour)
+	finishAt(failed, stateFailed, long)
+	finishAt(done, stateDone, time.Now())
+
+	// Unfinished uploads never expire, however old
+	running.setState(stateProcessing)
+
+	if tracker.get("running") == nil {
+		t.Error("running upload is not tracked")
+	}
+	if tracker.get("failed") != nil {
+		t.Error("upload that failed an hour ago is still tracked")
+	}
+	if tracker.get("done") == nil {
+		t.Error("upload that just finished is not tracked")
+	}
+
+	// The expired id can be reused
+	if _, err := tracker.start("failed", -1); err != nil {
+		t.Errorf("reusing an expired id: %v", err)
+	}
+}
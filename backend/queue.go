@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// errQueueTimeout is returned when a request waited too long for a worker
+var errQueueTimeout = errors.New("timed out waiting for a free worker")
+
+// workQueue lets a fixed number of requests run at once, the others
+// waiting in line for one of them to finish
+type workQueue struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+func newWorkQueue(workers int) *workQueue {
+	return &workQueue{slots: make(chan struct{}, workers)}
+}
+
+// acquire waits up to timeout for a worker. It returns the function
+// handing the worker back, or errQueueTimeout, or the error of ctx when
+// the client gave up first.
+func (q *workQueue) acquire(ctx context.Context, timeout time.Duration) (func(), error) {
+	release := func() { <-q.slots }
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	q.waiting.Add(1)
+	defer q.waiting.Add(-1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case q.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w after %s", errQueueTimeout, timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// depth returns the number of requests waiting for a worker
+func (q *workQueue) depth() int {
+	return int(q.waiting.Load())
+}
+
+// segmentQueue holds the requests of the segmentation endpoints
+var segmentQueue = newWorkQueue(config.SegmentWorkers)
+
+// awaitWorker waits for a worker of segmentQueue on behalf of a request,
+// rejecting it after QUEUE_TIMEOUT. Handlers call it once the request body
+// has been read, so that slow uploads do not hold workers, and run only the
+// processing with the worker. The response reports the number of requests
+// still waiting in X-Queue-Depth so that clients can back off. It returns
+// false, having answered the request if the client is still there, when
+// no worker was obtained.
+func awaitWorker(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, err := segmentQueue.acquire(r.Context(), config.QueueTimeout)
+	w.Header().Set("X-Queue-Depth", strconv.Itoa(segmentQueue.depth()))
+	if errors.Is(err, errQueueTimeout) {
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(config.QueueTimeout.Round(time.Second)/time.Second))))
+		writeError(w, r, errorCodeOf(err, codeInternal), "Server busy: "+err.Error())
+		return nil, false
+	}
+	if err != nil {
+		// The client is gone, there is nobody to answer
+		return nil, false
+	}
+	return release, true
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policies for uploads that would exceed UPLOADS_MAX_BYTES
+const (
+	quotaReject = "reject"
+	quotaEvict  = "evict"
+)
+
+// quotaRecountInterval is how often the usage is recounted from disk, to
+// catch up with files removed or overwritten outside the quota
+const quotaRecountInterval = time.Minute
+
+// errQuotaExceeded is returned when an upload does not fit under the cap
+var errQuotaExceeded = errors.New("uploads disk quota exceeded")
+
+// storedFile is an original or segmented output in the uploads directory
+type storedFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// diskQuota tracks the bytes stored in the uploads and results directories
+// and enforces the configured cap. used is a running total, recounted from
+// disk at startup and every quotaRecountInterval. pending holds the bytes
+// reserved by requests still writing, so that concurrent uploads cannot
+// all fit in the same free space; written files move from pending to used.
+type diskQuota struct {
+	mu      sync.Mutex
+	used    int64
+	pending int64
+}
+
+var uploadsQuota = &diskQuota{}
+
+// sidecarAllowance is reserved for the JSON sidecar of every stored result
+const sidecarAllowance = 64 << 10
+
+// storedFiles lists the originals, outputs and result sidecars in dirs,
+// oldest first. Hidden files, such as temporary files of uploads in
+// progress, are not included.
+func storedFiles(dirs ...string) ([]storedFile, error) {
+	var files []storedFile
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			files = append(files, storedFile{filepath.Join(dir, name), info.Size(), info.ModTime()})
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files, nil
+}
+
+// recount sets the usage to the size of the files on disk. The directories
+// are read before taking q.mu, so that uploads are not held up meanwhile.
+func (q *diskQuota) recount() error {
+	if config.UploadsMaxBytes == 0 {
+		return nil
+	}
+	files, err := storedFiles(uploadsDir, resultsDir)
+	if err != nil {
+		return fmt.Errorf("error reading uploads directory: %v", err)
+	}
+	var used int64
+	for _, f := range files {
+		used += f.size
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.used = used
+	return nil
+}
+
+// recountEvery recounts the usage every interval
+func (q *diskQuota) recountEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := q.recount(); err != nil {
+			infof("Error recounting the uploads quota: %s", err)
+		}
+	}
+}
+
+// uploadReservation is the space reserved for storing an upload of size
+// bytes: the original, a segmented output and every threshold overlay
+// allowed as much again each, and the sidecar. Outputs count with their
+// real size once written.
+func uploadReservation(size int64, params SegmentParams) int64 {
+	return int64(2+len(params.Thresholds))*size + sidecarAllowance
+}
+
+// quotaReservation is space set aside by reserve for files a request is
+// about to write
+type quotaReservation struct {
+	q    *diskQuota // nil without a cap
+	left int64
+}
+
+// reserve sets aside size bytes for files about to be written to the
+// uploads or results directory, until they are reported with wrote or the
+// reservation is released. Under quotaEvict the oldest results are deleted
+// until the reservation fits; under quotaReject errQuotaExceeded is
+// returned instead.
+func (q *diskQuota) reserve(size int64) (*quotaReservation, error) {
+	if config.UploadsMaxBytes == 0 {
+		return &quotaReservation{}, nil
+	}
+	if size > config.UploadsMaxBytes {
+		return nil, fmt.Errorf("%w: upload needing %d bytes exceeds the cap of %d bytes", errQuotaExceeded, size, config.UploadsMaxBytes)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.used+q.pending+size > config.UploadsMaxBytes {
+		if config.UploadsFullPolicy != quotaEvict {
+			return nil, fmt.Errorf("%w: %d of %d bytes in use or reserved", errQuotaExceeded, q.used+q.pending, config.UploadsMaxBytes)
+		}
+		if err := q.evict(size); err != nil {
+			return nil, err
+		}
+	}
+	if q.used+q.pending+size > config.UploadsMaxBytes {
+		return nil, fmt.Errorf("%w: %d of %d bytes in use or reserved by uploads in progress", errQuotaExceeded, q.used+q.pending, config.UploadsMaxBytes)
+	}
+
+	q.pending += size
+	return &quotaReservation{q: q, left: size}, nil
+}
+
+// wrote moves the files at paths, just written, from the reservation to
+// the usage. Files outgrowing the reservation are counted all the same.
+func (res *quotaReservation) wrote(paths ...string) {
+	if res.q == nil {
+		return
+	}
+	var size int64
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+
+	res.q.mu.Lock()
+	defer res.q.mu.Unlock()
+
+	moved := min(size, res.left)
+	res.left -= moved
+	res.q.pending -= moved
+	res.q.used += size
+}
+
+// release gives back what is left of the reservation. It may be called more
+// than once.
+func (res *quotaReservation) release() {
+	if res.q == nil {
+		return
+	}
+	res.q.mu.Lock()
+	defer res.q.mu.Unlock()
+
+	res.q.pending -= res.left
+	res.left = 0
+}
+
+// evictionUnit is what eviction deletes at once: a result with the files
+// only it links to, or a stored file no result links to
+type evictionUnit struct {
+	time   time.Time
+	result *storedResult // nil for a file
+	id     string
+	file   storedFile
+}
+
+// evict deletes results, oldest first, until size more bytes fit, together
+// with their outputs and threshold overlays unless a newer result links
+// to them too, and their reference to the original. Originals and
+// generated images no result links to go as well, unless an upload in
+// progress uses them. Outputs of uploads in progress have no sidecar yet
+// and are never candidates. It is called with q.mu held.
+func (q *diskQuota) evict(size int64) error {
+	results, err := listResults()
+	if err != nil {
+		return fmt.Errorf("error reading results directory: %v", err)
+	}
+	files, err := storedFiles(uploadsDir)
+	if err != nil {
+		return fmt.Errorf("error reading uploads directory: %v", err)
+	}
+
+	// How many results link to every output and overlay
+	linked := map[string]int{}
+	var units []evictionUnit
+	for id, stored := range results {
+		units = append(units, evictionUnit{time: stored.CreatedAt, result: stored, id: id})
+		for _, path := range resultOutputs(stored) {
+			linked[path]++
+		}
+		if path := uploadPath(stored.OriginalImage); path != "" {
+			linked[path]++
+		}
+	}
+	for _, f := range files {
+		name := filepath.Base(f.path)
+		generated := strings.HasPrefix(name, "diff_") || strings.HasPrefix(name, "masked_")
+		if linked[f.path] == 0 && (generated || strings.HasPrefix(name, "original_")) {
+			units = append(units, evictionUnit{time: f.modTime, file: f})
+		}
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i].time.Before(units[j].time) })
+
+	for _, unit := range units {
+		if q.used+q.pending+size <= config.UploadsMaxBytes {
+			break
+		}
+		if unit.result == nil {
+			if strings.HasPrefix(filepath.Base(unit.file.path), "original_") {
+				if !originals.removeUnreferenced(unit.file.path) {
+					continue
+				}
+			} else if err := os.Remove(unit.file.path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error evicting %s: %v", unit.file.path, err)
+			}
+			q.used -= unit.file.size
+			infof("Evicted %s (%d bytes) to stay under the uploads cap", unit.file.path, unit.file.size)
+			continue
+		}
+
+		freed, err := removeFile(filepath.Join(resultsDir, unit.id+".json"))
+		if err != nil {
+			return fmt.Errorf("error evicting result %s: %v", unit.id, err)
+		}
+		for _, path := range resultOutputs(unit.result) {
+			if linked[path]--; linked[path] > 0 {
+				continue
+			}
+			n, err := removeFile(path)
+			if err != nil {
+				return fmt.Errorf("error evicting %s: %v", path, err)
+			}
+			freed += n
+		}
+		if path := uploadPath(unit.result.OriginalImage); path != "" {
+			linked[path]--
+			info, statErr := os.Stat(path)
+			if err := originals.release(path); err != nil {
+				return fmt.Errorf("error evicting %s: %v", path, err)
+			}
+			if _, err := os.Stat(path); statErr == nil && os.IsNotExist(err) {
+				freed += info.Size()
+			}
+		}
+		q.used -= freed
+		infof("Evicted result %s (%d bytes) to stay under the uploads cap", unit.id, freed)
+	}
+	return nil
+}
+
+// resultOutputs returns the paths of the output and threshold overlays a
+// result links to
+func resultOutputs(stored *storedResult) []string {
+	var paths []string
+	if path := uploadPath(stored.SegmentedImage); path != "" {
+		paths = append(paths, path)
+	}
+	for _, overlay := range stored.ThresholdOverlays {
+		if path := uploadPath(overlay.Image); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// removeFile deletes path and returns its size, 0 when it was already gone
+func removeFile(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return info.Size(), nil
+}
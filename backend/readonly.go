@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Behaviors for storage directories that cannot be written at startup
+const (
+	readOnlyFail      = "fail"
+	readOnlyTransform = "transform"
+)
+
+// errReadOnlyStorage is returned by endpoints that store files while the
+// server runs in transform-only mode
+var errReadOnlyStorage = errors.New("storage is read-only; only /api/segment is available")
+
+// transformOnly is set at startup when the storage directories are
+// read-only and READ_ONLY_UPLOADS=transform, disabling every endpoint that
+// writes to disk
+var transformOnly bool
+
+// checkWritable makes sure files can be created in dir, creating it if
+// needed, by writing and removing a probe file
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".write-probe-*")
+	if err != nil {
+		return err
+	}
+	name := probe.Name()
+	probe.Close()
+	return os.Remove(name)
+}
+
+// checkStorage probes the uploads and results directories at startup. A
+// read-only one stops the server under READ_ONLY_UPLOADS=fail and switches
+// it to transform-only mode under READ_ONLY_UPLOADS=transform.
+func checkStorage() error {
+	for _, dir := range []string{uploadsDir, resultsDir} {
+		err := checkWritable(dir)
+		if err == nil {
+			continue
+		}
+		if config.ReadOnlyUploads == readOnlyFail {
+			return fmt.Errorf("%s directory is not writable: %v (set READ_ONLY_UPLOADS=transform to serve /api/segment only)", dir, err)
+		}
+		fmt.Printf("Warning: %s directory is not writable (%s); only /api/segment is available\n", dir, err)
+		transformOnly = true
+		return nil
+	}
+	return nil
+}
+
+// writesStorage rejects requests to endpoints that store files while the
+// server is in transform-only mode
+func writesStorage(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if transformOnly {
+			writeError(w, r, codeReadOnlyStorage, errReadOnlyStorage.Error())
+			return
+		}
+		next(w, r)
+	}
+}
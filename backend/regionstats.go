@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+// regionOutline is the color region bounding boxes are drawn in
+var regionOutline = color.RGBA{255, 0, 0, 255}
+
+// Centroid is the mean position of the pixels of a region
+type Centroid struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Region describes one connected foreground region
+type Region struct {
+	ID          int         `json:"id"`
+	Area        int         `json:"area"`
+	Centroid    Centroid    `json:"centroid"`
+	BoundingBox BoundingBox `json:"bounding_box"`
+	MeanColor   string      `json:"mean_color"`
+}
+
+func init() {
+	registerMode(modeRegionStats, "Area, centroid, bounding box and mean color of each foreground region", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		mask, err := foregroundMask(ctx, img, params)
+		if err != nil {
+			return nil, err
+		}
+		regions, err := measureRegions(ctx, img, mask, params.Connectivity, params.MinArea)
+		if err != nil {
+			return nil, err
+		}
+		result.Regions = regions
+		if !params.Annotate {
+			return nil, nil
+		}
+		return annotateRegions(img, regions), nil
+	}))
+}
+
+// measureRegions labels the connected regions of mask and describes those
+// of at least minArea pixels, numbered from 1 in raster order of their
+// first pixel. Mean colors are taken from img.
+func measureRegions(ctx context.Context, img image.Image, mask []bool, connectivity int, minArea int) ([]Region, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	labels := make([]int, len(mask))
+
+	count := 0
+	for i, fg := range mask {
+		if fg && labels[i] == 0 {
+			if count%1024 == 0 {
+				if err := canceled(ctx); err != nil {
+					return nil, err
+				}
+			}
+			count++
+			fillRegion(mask, labels, width, height, i, count, connectivity)
+		}
+	}
+
+	// Accumulate every region in one pass; index 0 is the background
+	type accumulator struct {
+		area                   int
+		sumX, sumY             float64
+		sumR, sumG, sumB       float64
+		minX, minY, maxX, maxY int
+	}
+	acc := make([]accumulator, count+1)
+	for i := range acc {
+		acc[i].minX, acc[i].minY = width, height
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			label := labels[y*width+x]
+			if label == 0 {
+				continue
+			}
+			a := &acc[label]
+			c := color.RGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.RGBA)
+			a.area++
+			a.sumX += float64(x)
+			a.sumY += float64(y)
+			a.sumR += float64(c.R)
+			a.sumG += float64(c.G)
+			a.sumB += float64(c.B)
+			a.minX, a.minY = min(a.minX, x), min(a.minY, y)
+			a.maxX, a.maxY = max(a.maxX, x), max(a.maxY, y)
+		}
+	}
+
+	round2 := func(v float64) float64 { return math.Round(100*v) / 100 }
+	regions := []Region{}
+	for _, a := range acc[1:] {
+		if a.area < minArea {
+			continue
+		}
+		n := float64(a.area)
+		regions = append(regions, Region{
+			ID:   len(regions) + 1,
+			Area: a.area,
+			Centroid: Centroid{
+				X: round2(a.sumX/n) + float64(bounds.Min.X),
+				Y: round2(a.sumY/n) + float64(bounds.Min.Y),
+			},
+			BoundingBox: BoundingBox{
+				X:      a.minX + bounds.Min.X,
+				Y:      a.minY + bounds.Min.Y,
+				Width:  a.maxX - a.minX + 1,
+				Height: a.maxY - a.minY + 1,
+			},
+			MeanColor: fmt.Sprintf("#%02x%02x%02x",
+				uint8(math.Round(a.sumR/n)), uint8(math.Round(a.sumG/n)), uint8(math.Round(a.sumB/n))),
+		})
+	}
+	return regions, nil
+}
+
+// annotateRegions draws the bounding box of each region on a copy of img
+// with its ID at the top-left corner
+func annotateRegions(img image.Image, regions []Region) *image.RGBA {
+	bounds := img.Bounds()
+	annotated := image.NewRGBA(bounds)
+	draw.Draw(annotated, bounds, img, bounds.Min, draw.Src)
+
+	for _, r := range regions {
+		box := image.Rect(r.BoundingBox.X, r.BoundingBox.Y, r.BoundingBox.X+r.BoundingBox.Width, r.BoundingBox.Y+r.BoundingBox.Height)
+		for x := box.Min.X; x < box.Max.X; x++ {
+			annotated.SetRGBA(x, box.Min.Y, regionOutline)
+			annotated.SetRGBA(x, box.Max.Y-1, regionOutline)
+		}
+		for y := box.Min.Y; y < box.Max.Y; y++ {
+			annotated.SetRGBA(box.Min.X, y, regionOutline)
+			annotated.SetRGBA(box.Max.X-1, y, regionOutline)
+		}
+		drawLabel(annotated, box.Min, strconv.Itoa(r.ID), 1)
+	}
+	return annotated
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Batch states reported by the reprocess endpoint
+const (
+	batchRunning  = "running"
+	batchDone     = "done"
+	batchCanceled = "canceled"
+	batchFailed   = "failed"
+)
+
+// maxBatchErrors caps the per-image errors kept in a batch status
+const maxBatchErrors = 100
+
+// batchStatus is the progress of a reprocessing batch and the JSON body of
+// the reprocess endpoint
+type batchStatus struct {
+	State     string     `json:"state"`
+	Mode      string     `json:"mode"`
+	Total     int        `json:"total"`
+	Processed int        `json:"processed"`
+	Failed    int        `json:"failed"`
+	Current   string     `json:"current,omitempty"`
+	Errors    []string   `json:"errors,omitempty"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+}
+
+// reprocessBatch re-segments every stored original in the background
+type reprocessBatch struct {
+	mu     sync.Mutex
+	status batchStatus
+	cancel context.CancelFunc
+}
+
+// snapshot returns a copy of the status that is safe to encode
+func (b *reprocessBatch) snapshot() batchStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := b.status
+	status.Errors = append([]string(nil), b.status.Errors...)
+	return status
+}
+
+// update changes the status under the batch lock
+func (b *reprocessBatch) update(f func(status *batchStatus)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f(&b.status)
+}
+
+// running reports whether the batch has not finished yet
+func (b *reprocessBatch) running() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status.State == batchRunning
+}
+
+// batches holds the latest reprocessing batch. Only one runs at a time.
+var batches struct {
+	mu     sync.Mutex
+	latest *reprocessBatch
+}
+
+// authorizeAdmin checks the bearer token of an admin request. Admin
+// endpoints are disabled unless ADMIN_TOKEN is set.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if config.AdminToken == "" {
+		writeError(w, r, codeForbidden, "Admin endpoints are disabled; set ADMIN_TOKEN to enable them")
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, r, codeUnauthorized, "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// reprocessHandler starts (POST), reports (GET) and cancels (DELETE) the
+// re-segmentation of every stored original with new parameters
+func reprocessHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		startReprocess(w, r)
+	case http.MethodGet, http.MethodDelete:
+		batches.mu.Lock()
+		batch := batches.latest
+		batches.mu.Unlock()
+		if batch == nil {
+			writeError(w, r, codeNotFound, "No reprocessing batch has been started")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			batch.cancel()
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, r, batch.snapshot())
+	default:
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// startReprocess validates the batch parameters and starts the batch
+func startReprocess(w http.ResponseWriter, r *http.Request) {
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+	if params.StatsOnly {
+		writeError(w, r, codeInvalidParameters, "Invalid parameters: stats_only stores nothing and cannot be reprocessed")
+		return
+	}
+	opts, err := parseUploadOptions(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+	if opts.CallbackURL != "" {
+		writeError(w, r, codeInvalidParameters, "Invalid parameters: callback_url is not supported by batches, whose status is polled")
+		return
+	}
+
+	paths, err := filepath.Glob(filepath.Join(uploadsDir, "original_*"))
+	if err != nil {
+		writeError(w, r, codeInternal, "Error listing originals: "+err.Error())
+		return
+	}
+	sort.Strings(paths)
+
+	batches.mu.Lock()
+	defer batches.mu.Unlock()
+	if batches.latest != nil && batches.latest.running() {
+		writeError(w, r, codeConflict, "A reprocessing batch is already running")
+		return
+	}
+
+	// The batch outlives the request, so it is not tied to its context
+	ctx, cancel := context.WithCancel(context.Background())
+	batch := &reprocessBatch{
+		status: batchStatus{State: batchRunning, Mode: params.Mode, Total: len(paths), StartedAt: time.Now()},
+		cancel: cancel,
+	}
+	batches.latest = batch
+	go batch.run(ctx, paths, params, opts.Policy)
+
+	writeJSONStatus(w, r, http.StatusAccepted, batch.snapshot())
+}
+
+// run segments the originals one at a time, each with a worker of
+// segmentQueue, waiting REPROCESS_INTERVAL between images so that a batch
+// does not starve regular requests
+func (b *reprocessBatch) run(ctx context.Context, paths []string, params SegmentParams, policy string) {
+	defer b.cancel()
+
+	finish := func(state string) {
+		now := time.Now()
+		b.update(func(s *batchStatus) {
+			s.State, s.Current, s.EndedAt = state, "", &now
+		})
+	}
+
+	for i, path := range paths {
+		if i > 0 && config.ReprocessInterval > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(config.ReprocessInterval):
+			}
+		}
+		if ctx.Err() != nil {
+			finish(batchCanceled)
+			return
+		}
+
+		// Every image takes a worker like a request does, so that a batch
+		// does not push the server past SEGMENT_WORKERS. The batch waits for
+		// as long as it takes rather than QUEUE_TIMEOUT.
+		release, err := segmentQueue.acquire(ctx, config.QueueTimeout)
+		for errors.Is(err, errQueueTimeout) {
+			release, err = segmentQueue.acquire(ctx, config.QueueTimeout)
+		}
+		if err != nil {
+			finish(batchCanceled)
+			return
+		}
+
+		// The original is stored already, only its new output is written
+		var size int64
+		if info, err := os.Stat(path); err == nil {
+			size = info.Size()
+		}
+		reservation, err := uploadsQuota.reserve(uploadReservation(size, params) - size)
+		if err != nil {
+			release()
+			b.update(func(s *batchStatus) { s.Errors = append(s.Errors, err.Error()) })
+			finish(batchFailed)
+			return
+		}
+
+		filename := strings.TrimPrefix(filepath.Base(path), "original_")
+		b.update(func(s *batchStatus) { s.Current = filename })
+		var outputs []string
+		outputs, err = reprocessOriginal(ctx, path, filename, params, policy)
+		release()
+		reservation.wrote(outputs...)
+		reservation.release()
+		if ctx.Err() != nil {
+			finish(batchCanceled)
+			return
+		}
+		b.update(func(s *batchStatus) {
+			s.Processed, s.Current = s.Processed+1, ""
+			if err != nil {
+				s.Failed++
+				if len(s.Errors) < maxBatchErrors {
+					s.Errors = append(s.Errors, fmt.Sprintf("%s: %v", filename, err))
+				}
+			}
+		})
+	}
+
+	finish(batchDone)
+}
+
+// reprocessOriginal segments one stored original into the output name an
+// upload of it would get now, and returns the paths of the files written
+func reprocessOriginal(ctx context.Context, path string, filename string, params SegmentParams, policy string) ([]string, error) {
+	if err := resolveInputFormatOf(path, &params); err != nil {
+		return nil, err
+	}
+	requestedName, err := outputName(config.OutputTemplate, filename, params)
+	if err != nil {
+		return nil, err
+	}
+	requestedName = forceOutputExt(requestedName, config.ForceOutputFormat)
+	segmentedName, err := checkOutputFormat(requestedName, config.UnsupportedOutputPolicy)
+	if err != nil {
+		return nil, err
+	}
+	segmentedPath, err := resolveOutputPath(filepath.Join(uploadsDir, segmentedName), policy)
+	if err != nil {
+		return nil, err
+	}
+
+	var result Result
+	if err := performImageSegmentation(ctx, path, segmentedPath, params, &result); err != nil {
+		return nil, err
+	}
+	// Modes without a raster output have nothing to store
+	if result.SegmentedImage == "" {
+		return nil, fmt.Errorf("%s mode produces no image to store", params.Mode)
+	}
+	return resultOutputs(&storedResult{Result: result}), nil
+}
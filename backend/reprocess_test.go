@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storedOriginals moves the test into a temporary directory whose uploads
+// hold n originals, and returns their paths
+func storedOriginals(t *testing.T, n int) []string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	if err := os.Mkdir(uploadsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for i := 0; i < n; i++ {
+		path := filepath.Join(uploadsDir, "original_"+string(rune('a'+i))+".png")
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := png.Encode(f, redRamp()); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// newTestBatch returns a running batch over paths, as startReprocess does
+func newTestBatch(paths []string) (*reprocessBatch, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	batch := &reprocessBatch{
+		status: batchStatus{State: batchRunning, Total: len(paths), StartedAt: time.Now()},
+		cancel: cancel,
+	}
+	return batch, ctx
+}
+
+// awaitBatch waits for a batch to finish and returns its status
+func awaitBatch(t *testing.T, batch *reprocessBatch) batchStatus {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for batch.running() {
+		if time.Now().After(deadline) {
+			t.Fatalf("batch still running: %+v", batch.snapshot())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return batch.snapshot()
+}
+
+func TestReprocessBatchRun(t *testing.T) {
+	paths := storedOriginals(t, 3)
+	defer func(interval time.Duration) { config.ReprocessInterval = interval }(config.ReprocessInterval)
+	config.ReprocessInterval = 0
+
+	batch, ctx := newTestBatch(paths)
+	batch.run(ctx, paths, defaultSegmentParams(), "overwrite")
+
+	status := batch.snapshot()
+	if status.State != batchDone || status.Processed != 3 || status.Failed != 0 || status.EndedAt == nil {
+		t.Fatalf("status = %+v", status)
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		matches, _ := filepath.Glob(filepath.Join(uploadsDir, "segmented_"+name+"*"))
+		if len(matches) == 0 {
+			t.Errorf("no output for original_%s.png", name)
+		}
+	}
+}
+
+func TestReprocessBatchTakesWorker(t *testing.T) {
+	paths := storedOriginals(t, 2)
+	defer func(q *workQueue) { segmentQueue = q }(segmentQueue)
+	segmentQueue = newWorkQueue(1)
+	defer func(interval time.Duration) { config.ReprocessInterval = interval }(config.ReprocessInterval)
+	config.ReprocessInterval = 0
+
+	// With the only worker busy the batch waits for it
+	release, err := segmentQueue.acquire(context.Background(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, ctx := newTestBatch(paths)
+	go batch.run(ctx, paths, defaultSegmentParams(), "overwrite")
+
+	time.Sleep(100 * time.Millisecond)
+	if status := batch.snapshot(); status.Processed != 0 || status.State != batchRunning {
+		t.Fatalf("batch ran without a worker: %+v", status)
+	}
+	if segmentQueue.depth() != 1 {
+		t.Errorf("queue depth = %d, want the batch waiting", segmentQueue.depth())
+	}
+	release()
+
+	if status := awaitBatch(t, batch); status.State != batchDone || status.Processed != 2 {
+		t.Fatalf("status = %+v", status)
+	}
+	// Every worker is handed back
+	release, err = segmentQueue.acquire(context.Background(), time.Second)
+	if err != nil {
+		t.Fatalf("worker not released: %v", err)
+	}
+
+	// Canceling a batch waiting for a worker stops it
+	batch, ctx = newTestBatch(paths)
+	go batch.run(ctx, paths, defaultSegmentParams(), "overwrite")
+	batch.cancel()
+	if status := awaitBatch(t, batch); status.State != batchCanceled || status.Processed != 0 {
+		t.Errorf("canceled status = %+v", status)
+	}
+	release()
+}
+
+func TestReprocessHandler(t *testing.T) {
+	storedOriginals(t, 1)
+	defer func(token string) { config.AdminToken = token }(config.AdminToken)
+	defer func() { batches.latest = nil }()
+
+	tests := []struct {
+		name   string
+		token  string
+		auth   string
+		method string
+		status int
+		code   string
+	}{
+		{"disabled", "", "Bearer secret", http.MethodPost, http.StatusForbidden, codeForbidden.name},
+		{"missing token", "secret", "", http.MethodPost, http.StatusUnauthorized, codeUnauthorized.name},
+		{"wrong token", "secret", "Bearer nope", http.MethodPost, http.StatusUnauthorized, codeUnauthorized.name},
+		{"no batch yet", "secret", "Bearer secret", http.MethodGet, http.StatusNotFound, codeNotFound.name},
+		{"method", "secret", "Bearer secret", http.MethodPut, http.StatusMethodNotAllowed, codeMethodNotAllowed.name},
+	}
+	for _, tt := range tests {
+		config.AdminToken = tt.token
+		r := httptest.NewRequest(tt.method, "/api/reprocess", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		reprocessHandler(rec, r)
+		var body struct {
+			Code string `json:"code"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		if rec.Code != tt.status || body.Code != tt.code {
+			t.Errorf("%s: %d %q, want %d %q", tt.name, rec.Code, body.Code, tt.status, tt.code)
+		}
+	}
+
+	config.AdminToken = "secret"
+	r := httptest.NewRequest(http.MethodPost, "/api/reprocess?mode=binary", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	reprocessHandler(rec, r)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var status batchStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatalf("body %q: %v", rec.Body, err)
+	}
+	if status.Mode != modeBinary || status.Total != 1 {
+		t.Errorf("status = %+v", status)
+	}
+
+	batches.mu.Lock()
+	batch := batches.latest
+	batches.mu.Unlock()
+	if status := awaitBatch(t, batch); status.State != batchDone || status.Processed != 1 {
+		t.Errorf("batch = %+v", status)
+	}
+}
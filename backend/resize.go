@@ -0,0 +1,166 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// Interpolation methods of resized outputs. interpolationAuto picks nearest
+// for outputs made of a few exact colors and bilinear for the others.
+const (
+	interpolationAuto     = "auto"
+	interpolationNearest  = "nearest"
+	interpolationBilinear = "bilinear"
+	interpolationBicubic  = "bicubic"
+)
+
+// nearestModes are the modes whose output is a mask or a label image, which
+// interpolation would fill with colors that are neither foreground nor any
+// label. They are always resized with nearest-neighbour sampling.
+var nearestModes = map[string]bool{
+	modeBinary:     true,
+	modeSauvola:    true,
+	modeBgSubtract: true,
+	modeBands:      true,
+	modeKMeans:     true,
+}
+
+// resizeInterpolation resolves the interpolation of params for an output
+// of its mode
+func resizeInterpolation(params SegmentParams) string {
+	switch {
+	case nearestModes[params.Mode]:
+		return interpolationNearest
+	case params.Interpolation != interpolationAuto:
+		return params.Interpolation
+	case params.Mode == modeSideBySide:
+		// Half of the composite is a mask
+		return interpolationNearest
+	}
+	return interpolationBilinear
+}
+
+// maxOutputDimension bounds out_width and out_height
+const maxOutputDimension = 8192
+
+// outputSize returns the size a segmented image of the given bounds is
+// resized to. A zero width or height is derived from the other one so the
+// aspect ratio is preserved; if both are zero the size is unchanged.
+func outputSize(bounds image.Rectangle, width int, height int) (int, int) {
+	dx, dy := bounds.Dx(), bounds.Dy()
+	switch {
+	case width == 0 && height == 0:
+		return dx, dy
+	case height == 0:
+		height = (dy*width + dx/2) / dx
+	case width == 0:
+		width = (dx*height + dy/2) / dy
+	}
+	return max(width, 1), max(height, 1)
+}
+
+// resizeImage scales img to the output size requested in params with the
+// interpolation resolved by resizeInterpolation. Nearest-neighbour sampling
+// keeps masks and label colors free of interpolated in-between values. The
+// image is returned unchanged when no resize is requested.
+func resizeImage(img image.Image, params SegmentParams) image.Image {
+	bounds := img.Bounds()
+	width, height := outputSize(bounds, params.OutWidth, params.OutHeight)
+	if width == bounds.Dx() && height == bounds.Dy() {
+		return img
+	}
+	if _, paletted := img.(*image.Paletted); !paletted {
+		switch resizeInterpolation(params) {
+		case interpolationBilinear:
+			return interpolateImage(img, width, height, 1, bilinearWeight)
+		case interpolationBicubic:
+			return interpolateImage(img, width, height, 2, bicubicWeight)
+		}
+	}
+
+	// Source pixel of output pixel (x, y)
+	source := func(x int, y int) (int, int) {
+		return bounds.Min.X + (2*x+1)*bounds.Dx()/(2*width), bounds.Min.Y + (2*y+1)*bounds.Dy()/(2*height)
+	}
+
+	// Label images keep their palette and indices
+	if src, ok := img.(*image.Paletted); ok {
+		resized := image.NewPaletted(image.Rect(0, 0, width, height), src.Palette)
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				resized.SetColorIndex(x, y, src.ColorIndexAt(source(x, y)))
+			}
+		}
+		return resized
+	}
+
+	resized := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			resized.Set(x, y, img.At(source(x, y)))
+		}
+	}
+
+	return resized
+}
+
+// bilinearWeight is the triangle filter of bilinear interpolation
+func bilinearWeight(d float64) float64 {
+	return max(0, 1-math.Abs(d))
+}
+
+// bicubicWeight is the Catmull-Rom cubic filter, which is sharper than
+// bilinear but may overshoot around hard edges
+func bicubicWeight(d float64) float64 {
+	d = math.Abs(d)
+	switch {
+	case d < 1:
+		return (3*d*d*d - 5*d*d + 2) / 2
+	case d < 2:
+		return (-d*d*d + 5*d*d - 8*d + 4) / 2
+	}
+	return 0
+}
+
+// interpolateImage resamples img to width by height pixels, weighting the
+// source pixels within radius of the center of each output pixel with
+// weight. Edge pixels are repeated beyond the borders. Colors are averaged
+// premultiplied so that transparent pixels do not darken their neighbours.
+func interpolateImage(img image.Image, width int, height int, radius int, weight func(float64) float64) image.Image {
+	bounds := img.Bounds()
+	dx, dy := bounds.Dx(), bounds.Dy()
+	out := newImageLike(img, image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		sy := (float64(y)+0.5)*float64(dy)/float64(height) - 0.5
+		y0 := int(math.Floor(sy))
+		for x := 0; x < width; x++ {
+			sx := (float64(x)+0.5)*float64(dx)/float64(width) - 0.5
+			x0 := int(math.Floor(sx))
+
+			var sum [4]float64
+			for j := y0 - radius + 1; j <= y0+radius; j++ {
+				wy := weight(sy - float64(j))
+				row := bounds.Min.Y + min(max(j, 0), dy-1)
+				for i := x0 - radius + 1; i <= x0+radius; i++ {
+					w := wy * weight(sx-float64(i))
+					r, g, b, a := img.At(bounds.Min.X+min(max(i, 0), dx-1), row).RGBA()
+					sum[0] += w * float64(r)
+					sum[1] += w * float64(g)
+					sum[2] += w * float64(b)
+					sum[3] += w * float64(a)
+				}
+			}
+
+			a := clamp16(sum[3])
+			out.Set(x, y, color.RGBA64{min(clamp16(sum[0]), a), min(clamp16(sum[1]), a), min(clamp16(sum[2]), a), a})
+		}
+	}
+	return out
+}
+
+// clamp16 rounds v into the range of a 16-bit color channel
+func clamp16(v float64) uint16 {
+	return uint16(math.Round(min(max(v, 0), 0xffff)))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// resultsDir holds one JSON sidecar per stored result, outside the
+// publicly served uploads directory
+const resultsDir = "results"
+
+// resultIDBytes is the number of random bytes in a result ID
+const resultIDBytes = 16
+
+// storedResult is the sidecar of a result: the response the upload got,
+// with the parameters it was segmented with
+type storedResult struct {
+	Result
+	Parameters map[string]interface{} `json:"parameters"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// usedParameters returns the segmentation fields of the selected mode with
+// the value the request was processed with: its default when the request
+// left it out, or the value as sent for fields without a default
+func usedParameters(params SegmentParams) map[string]interface{} {
+	used := map[string]interface{}{}
+	for _, spec := range segmentParamSchema() {
+		if !usesMode(spec.Modes, params.Mode) {
+			continue
+		}
+		switch v, given := params.fields[spec.Name]; {
+		case spec.def != nil:
+			used[spec.Name] = spec.def(params)
+		case given:
+			used[spec.Name] = v
+		}
+	}
+	return used
+}
+
+// validResultID reports whether id has the form of a generated result ID
+func validResultID(id string) bool {
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 2*resultIDBytes && strings.ToLower(id) == id
+}
+
+// saveResult gives result a new ID and writes its sidecar
+func saveResult(result *Result, params SegmentParams) error {
+	var id [resultIDBytes]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	result.ID = hex.EncodeToString(id[:])
+
+	data, err := json.Marshal(storedResult{Result: *result, Parameters: usedParameters(params), CreatedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(resultsDir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(resultsDir, result.ID+".json"), data, 0o644)
+}
+
+// loadResult reads the sidecar of the result with the given ID
+func loadResult(id string) (*storedResult, error) {
+	if !validResultID(id) {
+		return nil, fmt.Errorf("%w: %q", errResultNotFound, id)
+	}
+	data, err := os.ReadFile(filepath.Join(resultsDir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %q", errResultNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored storedResult
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("corrupt result %s: %v", id, err)
+	}
+	return &stored, nil
+}
+
+// listResults reads every stored sidecar, by result ID. Unreadable
+// sidecars are skipped.
+func listResults() (map[string]*storedResult, error) {
+	entries, err := os.ReadDir(resultsDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]*storedResult, len(entries))
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !validResultID(id) {
+			continue
+		}
+		if stored, err := loadResult(id); err == nil {
+			results[id] = stored
+		}
+	}
+	return results, nil
+}
+
+// resultHandler returns a stored result by ID, from GET /api/result/{id}
+func resultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	stored, err := loadResult(strings.TrimPrefix(r.URL.Path, "/api/result/"))
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInternal), err.Error())
+		return
+	}
+	writeJSON(w, r, stored)
+}
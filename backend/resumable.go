@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxResumableSize caps the declared length of a resumable upload
+const maxResumableSize = 256 << 20
+
+// resumableTTL is how long an unfinished resumable upload is kept after its
+// last chunk
+const resumableTTL = 24 * time.Hour
+
+// resumableSweepInterval is how often expired resumable uploads are removed
+const resumableSweepInterval = 10 * time.Minute
+
+// errTooManyResumable is returned when the server or the client already
+// has as many unfinished resumable uploads as allowed
+var errTooManyResumable = errors.New("too many resumable uploads")
+
+// resumableUpload is an upload assembled from chunks appended in order.
+// mu guards the file and the offset while a chunk is received; it is never
+// taken while holding resumableStore.mu.
+type resumableUpload struct {
+	mu       sync.Mutex
+	path     string // chunks received so far, in the uploads directory
+	filename string
+	length   int64
+	offset   int64
+	params   SegmentParams
+	opts     uploadOptions
+	client   string
+
+	// received mirrors offset for the free disk space check, which reads
+	// it without u.mu
+	received atomic.Int64
+
+	// quota holds the space reserved for length
+	quota *quotaReservation
+
+	// completed is set by the request receiving the last chunk, which
+	// then owns the file
+	completed bool
+
+	// touched is guarded by resumableStore.mu
+	touched time.Time
+}
+
+// resumableStore holds the unfinished resumable uploads by id
+type resumableStore struct {
+	mu      sync.Mutex
+	uploads map[string]*resumableUpload
+}
+
+var resumables = &resumableStore{uploads: make(map[string]*resumableUpload)}
+
+// create starts a new upload and returns its id. Uploads abandoned by
+// their client are dropped first, so that they do not count against the
+// limits of RESUMABLE_MAX_UPLOADS and RESUMABLE_MAX_PER_CLIENT.
+func (s *resumableStore) create(u *resumableUpload) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b[:])
+
+	s.sweep()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	perClient := 0
+	for _, other := range s.uploads {
+		if other.client == u.client {
+			perClient++
+		}
+	}
+	switch {
+	case len(s.uploads) >= config.ResumableMaxUploads:
+		return "", fmt.Errorf("%w: %d are in progress", errTooManyResumable, len(s.uploads))
+	case perClient >= config.ResumableMaxPerClient:
+		return "", fmt.Errorf("%w: this client has %d in progress", errTooManyResumable, perClient)
+	}
+	u.touched = time.Now()
+	s.uploads[id] = u
+	return id, nil
+}
+
+// sweep drops the uploads that were not touched for resumableTTL
+func (s *resumableStore) sweep() {
+	now := time.Now()
+	var expired []*resumableUpload
+	s.mu.Lock()
+	for k, old := range s.uploads {
+		if now.Sub(old.touched) > resumableTTL {
+			expired = append(expired, old)
+			delete(s.uploads, k)
+		}
+	}
+	s.mu.Unlock()
+
+	// A chunk still being received finishes before its file goes away
+	for _, old := range expired {
+		old.mu.Lock()
+		if !old.completed {
+			old.discard()
+		}
+		old.mu.Unlock()
+	}
+}
+
+// sweepEvery sweeps the store every interval, for uploads to expire while
+// no new ones are created
+func (s *resumableStore) sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.sweep()
+	}
+}
+
+// outstanding returns the bytes the unfinished uploads are still to write
+// to the uploads directory
+func (s *resumableStore) outstanding() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for _, u := range s.uploads {
+		n += u.length - u.received.Load()
+	}
+	return n
+}
+
+// touch records activity on an upload so that it does not expire
+func (s *resumableStore) touch(u *resumableUpload) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u.touched = time.Now()
+}
+
+// get returns the upload with the given id, or nil
+func (s *resumableStore) get(id string) *resumableUpload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.uploads[id]
+}
+
+// remove forgets the upload with the given id
+func (s *resumableStore) remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.uploads, id)
+}
+
+// discard deletes the chunks received so far and gives back their space
+func (u *resumableUpload) discard() {
+	os.Remove(u.path)
+	u.quota.release()
+}
+
+// resumableClient identifies the client of a request for
+// RESUMABLE_MAX_PER_CLIENT by its IP address
+func resumableClient(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// resumableResponse is the JSON body returned when an upload is created
+type resumableResponse struct {
+	UploadID string `json:"upload_id"`
+	Offset   int64  `json:"offset"`
+}
+
+// resumableHandler implements a chunk-append upload protocol modelled on
+// tus. POST creates an upload, HEAD reports its offset, and PATCH appends
+// a chunk at the current offset. The completed upload is segmented like a
+// regular upload.
+func resumableHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		createResumable(w, r)
+	case http.MethodHead:
+		u := resumables.get(r.URL.Query().Get("id"))
+		if u == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+	case http.MethodPatch:
+		appendResumable(w, r)
+	default:
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// createResumable starts an upload of Upload-Length bytes. The filename and
+// segmentation options are sent as form fields of this request.
+func createResumable(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		writeError(w, r, codeMalformedRequest, "Invalid or missing Upload-Length header")
+		return
+	}
+	if length > maxResumableSize {
+		writeError(w, r, codePayloadTooLarge, fmt.Sprintf("Upload too large (max %d bytes)", maxResumableSize))
+		return
+	}
+
+	filename := filepath.Base(r.FormValue("filename"))
+	if filename == "." || filename == string(filepath.Separator) {
+		writeError(w, r, codeInvalidParameters, "Invalid parameters: filename is required")
+		return
+	}
+
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+	opts, err := parseUploadOptions(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+
+	// The declared length is set aside up front, so that the chunks cannot
+	// outgrow the uploads cap or the disk
+	reservation, err := uploadsQuota.reserve(length)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInternal), err.Error())
+		return
+	}
+	if err := checkFreeSpace(uploadsDir, length); err != nil {
+		reservation.release()
+		writeError(w, r, errorCodeOf(err, codeInternal), err.Error())
+		return
+	}
+	file, err := os.CreateTemp(uploadsDir, uploadTempPrefix+"resumable-*")
+	if err != nil {
+		reservation.release()
+		writeError(w, r, codeInternal, "Error creating upload")
+		return
+	}
+	file.Close()
+
+	u := &resumableUpload{
+		path:     file.Name(),
+		filename: filename,
+		length:   length,
+		params:   params,
+		opts:     opts,
+		client:   resumableClient(r),
+		quota:    reservation,
+	}
+	id, err := resumables.create(u)
+	if err != nil {
+		u.discard()
+		writeError(w, r, errorCodeOf(err, codeInternal), "Error creating upload: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Location", "/api/resumable?id="+id)
+	w.Header().Set("Upload-Offset", "0")
+	writeJSONStatus(w, r, http.StatusCreated, resumableResponse{UploadID: id})
+}
+
+// appendResumable appends the request body at Upload-Offset. Bytes received
+// before a disconnect are kept so the client can resume from the new
+// offset. The request that completes the upload gets the segmentation result.
+func appendResumable(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	u := resumables.get(id)
+	if u == nil {
+		writeError(w, r, codeNotFound, "Unknown upload")
+		return
+	}
+	// Touched before the chunk too, so a slow one does not expire midway
+	resumables.touch(u)
+	complete := u.receive(w, r)
+	resumables.touch(u)
+	if !complete {
+		return
+	}
+
+	// The upload is complete and no other request uses it any more:
+	// segment it and forget the chunks
+	resumables.remove(id)
+	defer u.discard()
+
+	file, err := os.Open(u.path)
+	if err != nil {
+		writeError(w, r, codeInternal, "Error reading upload")
+		return
+	}
+	defer file.Close()
+
+	// A background job reads the upload now and waits for a worker of its
+	// own
+	if u.opts.CallbackURL != "" {
+		submitCallbackJob(w, r, file, u.filename, u.params, u.opts)
+		return
+	}
+
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	result, ok := storeAndSegment(w, r, file, u.length, u.filename, u.params, u.opts)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+// receive appends one chunk under u.mu and reports whether it completed
+// the upload, having answered the request otherwise
+func (u *resumableUpload) receive(w http.ResponseWriter, r *http.Request) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.completed {
+		writeError(w, r, codeNotFound, "Unknown upload")
+		return false
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Invalid or missing Upload-Offset header")
+		return false
+	}
+	if offset != u.offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+		writeError(w, r, codeConflict, fmt.Sprintf("Upload-Offset %d does not match the current offset %d", offset, u.offset))
+		return false
+	}
+
+	// The file is only open while a chunk is received, so that pending
+	// uploads hold no descriptors
+	file, err := os.OpenFile(u.path, os.O_WRONLY, 0)
+	if err != nil {
+		writeError(w, r, codeInternal, "Error receiving chunk: "+err.Error())
+		return false
+	}
+	defer file.Close()
+	if _, err := file.Seek(u.offset, io.SeekStart); err != nil {
+		writeError(w, r, codeInternal, "Error receiving chunk: "+err.Error())
+		return false
+	}
+
+	// Read one byte past the declared length to detect oversized chunks
+	remaining := u.length - u.offset
+	n, err := io.Copy(file, io.LimitReader(r.Body, remaining+1))
+	if n > remaining {
+		file.Truncate(u.length)
+		n = remaining
+		err = errors.New("chunk exceeds Upload-Length")
+	}
+	u.offset += n
+	u.received.Store(u.offset)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Error receiving chunk: "+err.Error())
+		return false
+	}
+
+	if u.offset < u.length {
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	u.completed = true
+	return true
+}
@@ -0,0 +1,45 @@
+package main
+
+import "image"
+
+// outputRLE is the output format returning the mask run-length encoded in
+// the JSON response instead of as an image
+const outputRLE = "rle"
+
+// rleModes are the modes whose output is a black and white mask
+var rleModes = map[string]bool{
+	modeBinary:     true,
+	modeSauvola:    true,
+	modeBgSubtract: true,
+}
+
+// MaskRLE is a mask run-length encoded as in COCO: Counts alternate
+// between background and foreground runs, starting with a possibly empty
+// background run, over the pixels in column-major order. Size is the
+// height and the width of the mask.
+type MaskRLE struct {
+	Size   [2]int `json:"size"`
+	Counts []int  `json:"counts"`
+}
+
+// encodeRLE run-length encodes a mask image, pixels brighter than
+// mid-gray being foreground
+func encodeRLE(img image.Image) *MaskRLE {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	bits := maskBits(img)
+
+	rle := &MaskRLE{Size: [2]int{height, width}, Counts: []int{}}
+	run, current := 0, false
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			if bits[y*width+x] != current {
+				rle.Counts = append(rle.Counts, run)
+				run, current = 0, !current
+			}
+			run++
+		}
+	}
+	rle.Counts = append(rle.Counts, run)
+	return rle
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// What is returned for a region of interest
+const (
+	roiOutputFull = "full"
+	roiOutputCrop = "crop"
+)
+
+// What surrounds a region of interest in full output
+const (
+	roiFillOriginal    = "original"
+	roiFillBlack       = "black"
+	roiFillWhite       = "white"
+	roiFillTransparent = "transparent"
+)
+
+// roiFillColors are the colors of the fills other than roiFillOriginal
+var roiFillColors = map[string]color.Color{
+	roiFillBlack:       color.Black,
+	roiFillWhite:       color.White,
+	roiFillTransparent: color.Transparent,
+}
+
+// roiModes are the modes that can be limited to a region of interest: the
+// ones whose output is an image of the same size as their input
+var roiModes = map[string]bool{
+	modeBinary:          true,
+	modeSauvola:         true,
+	modeBgSubtract:      true,
+	modeBands:           true,
+	modeKMeans:          true,
+	modeMeanShift:       true,
+	modeDoG:             true,
+	modeGradientHeatmap: true,
+	modeSoftMask:        true,
+}
+
+// cropROI returns the region of interest of a preprocessed image, so that
+// the segmentation loops only visit its pixels
+func cropROI(img image.Image, roi image.Rectangle) (image.Image, error) {
+	cropped, err := cropImage(img, roi)
+	if err != nil {
+		return nil, fmt.Errorf("roi: %w", err)
+	}
+	return cropped, nil
+}
+
+// pasteROI returns an image of the size of img with the segmented region
+// of interest drawn at roi, surrounded by the pixels of img or by the
+// color of fill
+func pasteROI(img image.Image, segmented image.Image, roi image.Rectangle, fill string) *image.RGBA {
+	bounds := img.Bounds()
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	if c, ok := roiFillColors[fill]; ok {
+		draw.Draw(out, out.Bounds(), &image.Uniform{c}, image.Point{}, draw.Src)
+	} else {
+		draw.Draw(out, out.Bounds(), img, bounds.Min, draw.Src)
+	}
+	draw.Draw(out, roi, segmented, segmented.Bounds().Min, draw.Src)
+	return out
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Diagnostic outputs selectable with the debug field
+const (
+	debugNone      = ""
+	debugThreshMap = "threshmap"
+)
+
+func init() {
+	registerMode(modeSauvola, "Black and white mask using Sauvola's local threshold", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		params.Window = fitSauvolaWindow(params.Window, img.Bounds(), result)
+		if params.Debug == debugThreshMap {
+			_, thresholds, err := sauvolaThresholds(ctx, img, params.Channel, params.Window, params.SauvolaK, params.SauvolaR)
+			if err != nil {
+				return nil, err
+			}
+			return thresholdMapImage(img.Bounds(), thresholds, params.BitDepth), nil
+		}
+
+		mask, err := sauvolaMask(ctx, img, params.Channel, params.Window, params.SauvolaK, params.SauvolaR)
+		if err != nil {
+			return nil, err
+		}
+		despeckle(mask, img.Bounds().Dx(), img.Bounds().Dy(), params.Despeckle, params.Connectivity)
+		return maskImage(img.Bounds(), mask), nil
+	}))
+}
+
+// fitSauvolaWindow returns the window fitted to bounds by fitWindow,
+// warning in result when it had to shrink
+func fitSauvolaWindow(window int, bounds image.Rectangle, result *Result) int {
+	fitted := fitWindow(window, bounds)
+	if fitted != window {
+		result.warn("window %d does not fit the %dx%d image; %d was used", window, bounds.Dx(), bounds.Dy(), fitted)
+	}
+	return fitted
+}
+
+// sauvolaMask binarizes an image with Sauvola's local threshold. Pixels
+// above the threshold computed by sauvolaThresholds are foreground.
+func sauvolaMask(ctx context.Context, img image.Image, channel string, window int, k float64, r float64) ([]bool, error) {
+	levels, thresholds, err := sauvolaThresholds(ctx, img, channel, window, k, r)
+	if err != nil {
+		return nil, err
+	}
+
+	mask := make([]bool, len(levels))
+	for i, v := range levels {
+		mask[i] = float64(v) > thresholds[i]
+	}
+	return mask, nil
+}
+
+// sauvolaThresholds returns the gray levels of the selected channel and
+// Sauvola's local threshold at every pixel
+//
+//	T = m * (1 + k*(s/r - 1))
+//
+// where m and s are the mean and standard deviation of the selected channel
+// in a window x window neighbourhood, clipped at the image border. The
+// window statistics come from integral images of the values and their
+// squares.
+func sauvolaThresholds(ctx context.Context, img image.Image, channel string, window int, k float64, r float64) ([]uint8, []float64, error) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	levels := grayLevels(img, channel)
+
+	sum := newIntegralImage(levels, width, height, nil)
+	sumSq := newIntegralImage(levels, width, height, func(v float64) float64 { return v * v })
+
+	half := window / 2
+	thresholds := make([]float64, len(levels))
+	for y := 0; y < height; y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, nil, err
+		}
+		for x := 0; x < width; x++ {
+			x0, y0, x1, y1, count := sum.window(x, y, half)
+			n := float64(count)
+
+			mean := sum.sum(x0, y0, x1, y1) / n
+			variance := sumSq.sum(x0, y0, x1, y1)/n - mean*mean
+			stddev := math.Sqrt(math.Max(variance, 0))
+
+			thresholds[y*width+x] = mean * (1 + k*(stddev/r-1))
+		}
+	}
+
+	return levels, thresholds, nil
+}
+
+// thresholdMapImage renders a threshold surface as a grayscale image, each
+// pixel the threshold at that position clamped to 0-255 and rounded to the
+// precision of bitDepth, 8 or 16
+func thresholdMapImage(bounds image.Rectangle, thresholds []float64, bitDepth int) image.Image {
+	width := bounds.Dx()
+	if bitDepth == 16 {
+		out := image.NewGray16(bounds)
+		for i, t := range thresholds {
+			v := math.Round(math.Min(math.Max(t, 0), 255) * 257)
+			out.SetGray16(bounds.Min.X+i%width, bounds.Min.Y+i/width, color.Gray16{uint16(v)})
+		}
+		return out
+	}
+
+	out := image.NewGray(bounds)
+	for i, t := range thresholds {
+		v := math.Round(math.Min(math.Max(t, 0), 255))
+		out.SetGray(bounds.Min.X+i%width, bounds.Min.Y+i/width, color.Gray{uint8(v)})
+	}
+	return out
+}
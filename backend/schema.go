@@ -0,0 +1,533 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// paramSpec describes one segmentation form field. The schema endpoint
+// publishes it and parseSegmentParams validates the field with it, so the
+// documented ranges are the enforced ones.
+type paramSpec struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Description string      `json:"description"`
+	Minimum     *float64    `json:"minimum,omitempty"`
+	Maximum     *float64    `json:"maximum,omitempty"`
+	Values      []string    `json:"values,omitempty"`
+	Default     interface{} `json:"default"`
+
+	// Modes lists the modes that use the field, or is empty when all do
+	Modes []string `json:"modes,omitempty"`
+
+	// parse validates a non-empty form value and stores it in params, or
+	// is nil for fields read elsewhere such as files
+	parse func(params *SegmentParams, v string) error
+
+	// def reads the field's default from the default params, or is nil
+	// when the field is unset by default
+	def func(params SegmentParams) interface{}
+}
+
+// modeSpec describes a mode and the fields it uses
+type modeSpec struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Parameters  []string `json:"parameters"`
+
+	// Defaults lists the fields whose default in this mode differs from
+	// the one given with the field
+	Defaults map[string]interface{} `json:"defaults,omitempty"`
+}
+
+// schemaResponse is the JSON body of the schema endpoint
+type schemaResponse struct {
+	Modes      []modeSpec  `json:"modes"`
+	Parameters []paramSpec `json:"parameters"`
+}
+
+// paramErrors collects every invalid field of a request so that they are
+// reported together
+type paramErrors []string
+
+func (e paramErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// schemaRange returns pointers to lo and hi for the schema, leaving out
+// infinite bounds which JSON cannot represent
+func schemaRange(lo float64, hi float64) (*float64, *float64) {
+	var minimum, maximum *float64
+	if !math.IsInf(lo, 0) {
+		minimum = &lo
+	}
+	if !math.IsInf(hi, 0) {
+		maximum = &hi
+	}
+	return minimum, maximum
+}
+
+func intParam(name string, lo int, hi int, description string, modes []string, field func(*SegmentParams) *int) paramSpec {
+	minimum, maximum := schemaRange(float64(lo), float64(hi))
+	return paramSpec{
+		Name: name, Type: "integer", Description: description, Minimum: minimum, Maximum: maximum, Modes: modes,
+		parse: func(params *SegmentParams, v string) error {
+			n, err := parseIntField(name, v, lo, hi)
+			*field(params) = n
+			return err
+		},
+		def: func(params SegmentParams) interface{} { return *field(&params) },
+	}
+}
+
+func floatParam(name string, lo float64, hi float64, description string, modes []string, field func(*SegmentParams) *float64) paramSpec {
+	minimum, maximum := schemaRange(lo, hi)
+	return paramSpec{
+		Name: name, Type: "number", Description: description, Minimum: minimum, Maximum: maximum, Modes: modes,
+		parse: func(params *SegmentParams, v string) error {
+			f, err := parseFloatField(name, v, lo, hi)
+			*field(params) = f
+			return err
+		},
+		def: func(params SegmentParams) interface{} { return *field(&params) },
+	}
+}
+
+// levelParam is a 0-255 gray level
+func levelParam(name string, description string, modes []string, field func(*SegmentParams) *uint8) paramSpec {
+	minimum, maximum := schemaRange(0, 255)
+	return paramSpec{
+		Name: name, Type: "integer", Description: description, Minimum: minimum, Maximum: maximum, Modes: modes,
+		parse: func(params *SegmentParams, v string) error {
+			n, err := parseIntensity(name, v)
+			*field(params) = n
+			return err
+		},
+		def: func(params SegmentParams) interface{} { return *field(&params) },
+	}
+}
+
+func boolParam(name string, description string, modes []string, field func(*SegmentParams) *bool) paramSpec {
+	return paramSpec{
+		Name: name, Type: "boolean", Description: description, Modes: modes,
+		parse: func(params *SegmentParams, v string) error {
+			b, err := parseBoolField(name, v)
+			*field(params) = b
+			return err
+		},
+		def: func(params SegmentParams) interface{} { return *field(&params) },
+	}
+}
+
+// enumParam is a case-insensitive choice between values
+func enumParam(name string, values []string, description string, modes []string, field func(*SegmentParams) *string) paramSpec {
+	return paramSpec{
+		Name: name, Type: "string", Description: description, Values: values, Modes: modes,
+		parse: func(params *SegmentParams, v string) error {
+			v = strings.ToLower(v)
+			for _, allowed := range values {
+				if v == allowed {
+					*field(params) = v
+					return nil
+				}
+			}
+			return fieldError(name, v, "expected "+strings.Join(values, ", "))
+		},
+		def: func(params SegmentParams) interface{} { return *field(&params) },
+	}
+}
+
+// unsetByDefault drops the default of a field whose zero value means unset
+func unsetByDefault(spec paramSpec) paramSpec {
+	spec.def = nil
+	return spec
+}
+
+// segmentParamSchema returns the description of every segmentation field.
+// It is built on demand because the mode list comes from the registry,
+// which is filled by init functions.
+func segmentParamSchema() []paramSpec {
+	thresholdModes := []string{modeBinary, modeContours, modeSideBySide, modeRegionStats}
+	denoiseModes := []string{modeBinary, modeContours, modeSauvola}
+	maskModes := []string{modeBinary, modeContours, modeSideBySide, modeRegionStats, modeSauvola, modeBgSubtract}
+
+	window := intParam("window", 3, 255, "Side in pixels of the Sauvola neighbourhood, odd", []string{modeSauvola},
+		func(p *SegmentParams) *int { return &p.Window })
+	parseWindow := window.parse
+	window.parse = func(params *SegmentParams, v string) error {
+		if err := parseWindow(params, v); err != nil {
+			return err
+		}
+		if params.Window%2 == 0 {
+			return fieldError("window", v, "expected an odd size")
+		}
+		return nil
+	}
+
+	return []paramSpec{
+		enumParam("mode", modeNames(), "Segmentation mode", nil,
+			func(p *SegmentParams) *string { return &p.Mode }),
+		levelParam("threshold", "Gray level above which pixels are foreground", []string{modeBinary, modeContours, modeSideBySide, modeRegionStats, modeSoftMask},
+			func(p *SegmentParams) *uint8 { return &p.Threshold }),
+		unsetByDefault(levelParam("low", "Lower hysteresis threshold, given together with high", thresholdModes,
+			func(p *SegmentParams) *uint8 { return &p.Low })),
+		unsetByDefault(levelParam("high", "Upper hysteresis threshold, given together with low", thresholdModes,
+			func(p *SegmentParams) *uint8 { return &p.High })),
+		{
+			Name: "connectivity", Type: "integer", Description: "Whether pixels touching only at a corner are connected (8) or not (4)",
+			Values: []string{"4", "8"}, Modes: maskModes,
+			parse: func(params *SegmentParams, v string) error {
+				if v != "4" && v != "8" {
+					return fieldError("connectivity", v, "expected 4 or 8")
+				}
+				params.Connectivity, _ = strconv.Atoi(v)
+				return nil
+			},
+			def: func(params SegmentParams) interface{} { return params.Connectivity },
+		},
+		intParam("despeckle", 0, math.MaxInt32, "Remove foreground specks and fill background holes smaller than this many pixels", maskModes,
+			func(p *SegmentParams) *int { return &p.Despeckle }),
+		enumParam("channel", []string{channelLuma, channelRed, channelGreen, channelBlue}, "Channel compared against the threshold", nil,
+			func(p *SegmentParams) *string { return &p.Channel }),
+		{
+			Name: "cutoffs", Type: "string", Description: "Comma-separated, strictly ascending gray levels delimiting the bands",
+			Modes: []string{modeBands},
+			parse: func(params *SegmentParams, v string) error {
+				for _, part := range strings.Split(v, ",") {
+					cutoff, err := parseIntensity("cutoffs", strings.TrimSpace(part))
+					if err != nil {
+						return err
+					}
+					if n := len(params.Cutoffs); n > 0 && cutoff <= params.Cutoffs[n-1] {
+						return fmt.Errorf("cutoffs must be strictly ascending, got %q", v)
+					}
+					params.Cutoffs = append(params.Cutoffs, cutoff)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "thresholds", Type: "string", Description: fmt.Sprintf("Comma-separated gray levels, at most %d, to return an overlay of the foreground at", maxThresholdOverlays),
+			Modes: []string{modeBinary},
+			parse: func(params *SegmentParams, v string) error {
+				params.Thresholds = nil
+				for _, part := range strings.Split(v, ",") {
+					threshold, err := parseIntensity("thresholds", strings.TrimSpace(part))
+					if err != nil {
+						return err
+					}
+					params.Thresholds = append(params.Thresholds, threshold)
+				}
+				if len(params.Thresholds) > maxThresholdOverlays {
+					return fmt.Errorf("thresholds accepts at most %d values, got %d", maxThresholdOverlays, len(params.Thresholds))
+				}
+				return nil
+			},
+		},
+		floatParam("simplify", 0, math.Inf(1), "Douglas-Peucker tolerance in pixels, 0 for none", []string{modeContours},
+			func(p *SegmentParams) *float64 { return &p.Simplify }),
+		intParam("k", 2, 64, "Number of color clusters", []string{modeKMeans},
+			func(p *SegmentParams) *int { return &p.K }),
+		{
+			Name: "seed", Type: "integer", Description: "Seed of the random choices, generated when omitted",
+			Modes: []string{modeKMeans},
+			parse: func(params *SegmentParams, v string) error {
+				seed, err := strconv.ParseInt(v, 10, 64)
+				if err != nil {
+					return fieldError("seed", v, "expected a 64-bit integer")
+				}
+				params.Seed = &seed
+				return nil
+			},
+		},
+		window,
+		floatParam("sauvola_k", 0, 1, "Sauvola sensitivity", []string{modeSauvola},
+			func(p *SegmentParams) *float64 { return &p.SauvolaK }),
+		floatParam("sauvola_r", 1, 255, "Dynamic range of the standard deviation in the Sauvola threshold", []string{modeSauvola},
+			func(p *SegmentParams) *float64 { return &p.SauvolaR }),
+		{
+			Name: "background", Type: "file", Description: "Reference background image, required", Modes: []string{modeBgSubtract},
+		},
+		levelParam("diff_threshold", "Difference from the background above which pixels are foreground", []string{modeBgSubtract},
+			func(p *SegmentParams) *uint8 { return &p.DiffThreshold }),
+		floatParam("sigma", 0.5, 16, "Blob detection scale in pixels", []string{modeBlobs},
+			func(p *SegmentParams) *float64 { return &p.Sigma }),
+		floatParam("blob_threshold", 0, 255, "Minimum scale-normalized LoG response of a blob", []string{modeBlobs},
+			func(p *SegmentParams) *float64 { return &p.BlobThreshold }),
+		floatParam("dog_sigma1", 0.5, 16, "Scale in pixels of the finer Gaussian blur", []string{modeDoG},
+			func(p *SegmentParams) *float64 { return &p.DoGSigma1 }),
+		floatParam("dog_sigma2", 0.5, 32, "Scale in pixels of the coarser Gaussian blur, subtracted from the finer one", []string{modeDoG},
+			func(p *SegmentParams) *float64 { return &p.DoGSigma2 }),
+		floatParam("softness", 0.1, 64, "Width in gray levels of the ramp through the threshold", []string{modeSoftMask},
+			func(p *SegmentParams) *float64 { return &p.Softness }),
+		{
+			Name: "key_color", Type: "string", Description: "Color (#rrggbb) made transparent", Modes: []string{modeChromaKey},
+			parse: func(params *SegmentParams, v string) error {
+				c, err := parseHexColor(v)
+				if err != nil {
+					return fieldError("key_color", v, "expected #rrggbb")
+				}
+				params.KeyColor = c
+				return nil
+			},
+			def: func(params SegmentParams) interface{} {
+				c := params.KeyColor
+				return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+			},
+		},
+		floatParam("key_tolerance", 0, 442, "Largest 8-bit RGB distance from key_color of the pixels made transparent", []string{modeChromaKey},
+			func(p *SegmentParams) *float64 { return &p.KeyTolerance }),
+		boolParam("spill_suppression", "Remove the key color tint from the edges of the kept pixels", []string{modeChromaKey},
+			func(p *SegmentParams) *bool { return &p.SpillSuppression }),
+		enumParam("heatmap_ramp", []string{heatmapRampRainbow, heatmapRampHot, heatmapRampGray}, "Colors of the gradient magnitude, from weak to strong: rainbow runs from blue to red, hot from black through red and yellow to white", []string{modeGradientHeatmap},
+			func(p *SegmentParams) *string { return &p.HeatmapRamp }),
+		intParam("spatial_radius", 1, 32, "Mean-shift window radius in pixels", []string{modeMeanShift},
+			func(p *SegmentParams) *int { return &p.SpatialRadius }),
+		floatParam("color_radius", 1, 442, "Mean-shift color distance in 8-bit RGB units", []string{modeMeanShift},
+			func(p *SegmentParams) *float64 { return &p.ColorRadius }),
+		intParam("min_area", 1, math.MaxInt32, "Smallest region in pixels that is reported", []string{modeRegionStats},
+			func(p *SegmentParams) *int { return &p.MinArea }),
+		boolParam("annotate", "Return an image with each region's bounding box and number", []string{modeRegionStats},
+			func(p *SegmentParams) *bool { return &p.Annotate }),
+		boolParam("labels", "Label the two panels", []string{modeSideBySide},
+			func(p *SegmentParams) *bool { return &p.Labels }),
+		unsetByDefault(enumParam("denoise", []string{denoiseNLM}, "Denoise filter applied before thresholding", denoiseModes,
+			func(p *SegmentParams) *string { return &p.Denoise })),
+		floatParam("denoise_strength", 1, 100, "Non-local means filtering parameter h in gray levels", denoiseModes,
+			func(p *SegmentParams) *float64 { return &p.DenoiseStrength }),
+		unsetByDefault(enumParam("debug", []string{debugThreshMap}, "Diagnostic image returned instead of the mask, threshmap being the local threshold surface", []string{modeSauvola},
+			func(p *SegmentParams) *string { return &p.Debug })),
+		{
+			Name: "bit_depth", Type: "integer", Description: "Bits per sample of grayscale outputs such as threshmap, 16 kept in png and pgm output",
+			Values: []string{"8", "16"}, Modes: []string{modeSauvola},
+			parse: func(params *SegmentParams, v string) error {
+				switch v {
+				case "8", "16":
+					params.BitDepth, _ = strconv.Atoi(v)
+					return nil
+				}
+				return fieldError("bit_depth", v, "expected 8 or 16")
+			},
+			def: func(params SegmentParams) interface{} { return params.BitDepth },
+		},
+		{
+			Name: "output_format", Type: "string", Description: "Format of the segmented image, the upload's by default, input meaning the format detected from its content",
+			Values: []string{"png", "jpg", "jpeg", "gif", "pbm", "pgm", "ppm", outputSVG, outputRLE, outputInput},
+			parse: func(params *SegmentParams, v string) error {
+				switch v = strings.ToLower(v); v {
+				case "png", "gif", "pbm", "pgm", "ppm", outputSVG, outputRLE, outputInput:
+					params.OutputFormat = v
+				case "jpg", "jpeg":
+					params.OutputFormat = "jpg"
+				default:
+					return fieldError("output_format", v, "expected png, jpg, jpeg, gif, pbm, pgm, ppm, svg, rle or input")
+				}
+				return nil
+			},
+		},
+		enumParam("jpeg_subsampling", []string{jpegSubsampling420, jpegSubsampling444}, "Chroma subsampling of JPEG output, 444 keeping full color resolution", nil,
+			func(p *SegmentParams) *string { return &p.JPEGSubsampling }),
+		boolParam("all_frames", "Segment every frame of an animated GIF", []string{modeBinary},
+			func(p *SegmentParams) *bool { return &p.AllFrames }),
+		boolParam("stats_only", "Return mask statistics instead of an image", statsModeNames(),
+			func(p *SegmentParams) *bool { return &p.StatsOnly }),
+		boolParam("preview", "Segment a quick preview taken every preview_step pixels instead of the full image", nil,
+			func(p *SegmentParams) *bool { return &p.Preview }),
+		intParam("preview_step", 2, 64, "Distance in pixels between the samples of a preview", nil,
+			func(p *SegmentParams) *int { return &p.PreviewStep }),
+		boolParam("autocrop", "Trim the transparent or background-colored borders of the segmented image", nil,
+			func(p *SegmentParams) *bool { return &p.AutoCrop }),
+		{
+			Name: "flatten_color", Type: "string", Description: "Color (#rrggbb) transparent pixels are composited over",
+			parse: func(params *SegmentParams, v string) error {
+				c, err := parseHexColor(v)
+				if err != nil {
+					return fieldError("flatten_color", v, "expected #rrggbb")
+				}
+				params.Background = c
+				return nil
+			},
+			def: func(params SegmentParams) interface{} {
+				c := params.Background
+				return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+			},
+		},
+		enumParam("alpha", []string{alphaStraight, alphaPremultiplied}, "How semi-transparent color values are read", nil,
+			func(p *SegmentParams) *string { return &p.Alpha }),
+		{
+			Name: "whitebalance", Type: "string", Description: "Color cast correction applied before segmentation, true meaning grayworld",
+			Values: []string{"true", "false", whiteBalanceGrayWorld, whiteBalanceWhitePatch},
+			parse: func(params *SegmentParams, v string) error {
+				switch v = strings.ToLower(v); v {
+				case whiteBalanceGrayWorld, whiteBalanceWhitePatch:
+					params.WhiteBalance = v
+					return nil
+				}
+				on, err := strconv.ParseBool(v)
+				if err != nil {
+					return fieldError("whitebalance", v, "expected true, false, grayworld or whitepatch")
+				}
+				params.WhiteBalance = whiteBalanceNone
+				if on {
+					params.WhiteBalance = whiteBalanceGrayWorld
+				}
+				return nil
+			},
+		},
+		boolParam("best_effort", "Decode a truncated JPEG as far as its data goes, filling the missing rows with flatten_color", nil,
+			func(p *SegmentParams) *bool { return &p.BestEffort }),
+		{
+			Name: "orientation", Type: "integer", Description: "How the stored pixels are turned upright before rotate: an EXIF orientation 1-8, or a clockwise rotation in degrees",
+			Values: []string{"1", "2", "3", "4", "5", "6", "7", "8", "0", "90", "180", "270"},
+			parse: func(params *SegmentParams, v string) error {
+				n, err := parseIntField("orientation", v, 0, 270)
+				if err != nil {
+					return err
+				}
+				if o, ok := degreeOrientations[n]; ok {
+					n = o
+				} else if n < 1 || n > 8 {
+					return fieldError("orientation", v, "expected an EXIF orientation 1-8 or 0, 90, 180 or 270 degrees")
+				}
+				params.Orientation = n
+				return nil
+			},
+			def: func(params SegmentParams) interface{} { return params.Orientation },
+		},
+		{
+			Name: "rotate", Type: "integer", Description: "Clockwise rotation in degrees",
+			Values: []string{"0", "90", "180", "270"},
+			parse: func(params *SegmentParams, v string) error {
+				n, err := parseIntField("rotate", v, 0, 270)
+				if err != nil {
+					return err
+				}
+				if n%90 != 0 {
+					return fieldError("rotate", v, "expected 90, 180 or 270")
+				}
+				params.Rotate = n
+				return nil
+			},
+			def: func(params SegmentParams) interface{} { return params.Rotate },
+		},
+		{
+			Name: "crop", Type: "string", Description: "Region x,y,w,h to keep after rotation",
+			parse: func(params *SegmentParams, v string) error {
+				crop, err := parseRect(v)
+				if err != nil {
+					return fieldError("crop", v, "expected x,y,w,h: "+err.Error())
+				}
+				params.Crop = &crop
+				return nil
+			},
+		},
+		roiParam("roi_x", 0, "Left edge in pixels of the region of interest, after rotation and crop"),
+		roiParam("roi_y", 0, "Top edge in pixels of the region of interest"),
+		roiParam("roi_w", 1, "Width in pixels of the region of interest"),
+		roiParam("roi_h", 1, "Height in pixels of the region of interest"),
+		enumParam("roi_output", []string{roiOutputFull, roiOutputCrop}, "Whether the region of interest is returned within the full image or alone", roiModeNames(),
+			func(p *SegmentParams) *string { return &p.ROIOutput }),
+		enumParam("roi_fill", []string{roiFillOriginal, roiFillBlack, roiFillWhite, roiFillTransparent}, "What surrounds the region of interest, or the faces, in full output", roiModeNames(),
+			func(p *SegmentParams) *string { return &p.ROIFill }),
+		boolParam("faces", "Segment only the face regions tagged in the image's XMP metadata, or the whole image without any", roiModeNames(),
+			func(p *SegmentParams) *bool { return &p.Faces }),
+		unsetByDefault(intParam("out_width", 1, maxOutputDimension, "Width in pixels the output is resized to", nil,
+			func(p *SegmentParams) *int { return &p.OutWidth })),
+		unsetByDefault(intParam("out_height", 1, maxOutputDimension, "Height in pixels the output is resized to", nil,
+			func(p *SegmentParams) *int { return &p.OutHeight })),
+		enumParam("interpolation", []string{interpolationAuto, interpolationNearest, interpolationBilinear, interpolationBicubic}, "Resampling of the resize; auto is nearest for masks and labels and bilinear otherwise", nil,
+			func(p *SegmentParams) *string { return &p.Interpolation }),
+	}
+}
+
+// statsModeNames returns the modes supporting stats_only in alphabetical order
+func statsModeNames() []string {
+	var names []string
+	for _, name := range modeNames() {
+		if statsModes[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// roiModeNames returns the modes supporting roi in alphabetical order
+func roiModeNames() []string {
+	var names []string
+	for _, name := range modeNames() {
+		if roiModes[name] {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// roiParam is one of the coordinates of the region of interest. They are
+// only put together once all four are known, in parseSegmentParams.
+func roiParam(name string, lo int, description string) paramSpec {
+	minimum, maximum := schemaRange(float64(lo), math.MaxInt32)
+	return paramSpec{
+		Name: name, Type: "integer", Description: description, Minimum: minimum, Maximum: maximum, Modes: roiModeNames(),
+		parse: func(params *SegmentParams, v string) error {
+			_, err := parseIntField(name, v, lo, math.MaxInt32)
+			return err
+		},
+	}
+}
+
+// schemaHandler describes every mode and segmentation field with its type,
+// range and default
+func schemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	defaults := defaultSegmentParams()
+	params := segmentParamSchema()
+	for i := range params {
+		if params[i].def != nil {
+			params[i].Default = params[i].def(defaults)
+		}
+	}
+
+	var modes []modeSpec
+	for _, name := range modeNames() {
+		mode := modeSpec{Name: name, Description: modeDescription(name), Parameters: []string{}}
+		own := modeDefaultParams(name)
+		for _, p := range params {
+			if !usesMode(p.Modes, name) {
+				continue
+			}
+			mode.Parameters = append(mode.Parameters, p.Name)
+			if p.def == nil || p.Name == "mode" {
+				continue
+			}
+			if def := p.def(own); def != p.Default {
+				if mode.Defaults == nil {
+					mode.Defaults = map[string]interface{}{}
+				}
+				mode.Defaults[p.Name] = def
+			}
+		}
+		modes = append(modes, mode)
+	}
+
+	writeJSON(w, r, schemaResponse{Modes: modes, Parameters: params})
+}
+
+// usesMode reports whether a field restricted to modes applies to mode
+func usesMode(modes []string, mode string) bool {
+	if len(modes) == 0 {
+		return true
+	}
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sort"
+)
+
+// Segmenter is a segmentation algorithm selected with the mode field. It
+// receives the preprocessed image and returns its output raster, or nil
+// for modes reporting vectors only, recording any other outputs such as
+// contours or a generated seed in result.
+type Segmenter interface {
+	Segment(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error)
+}
+
+// SegmenterFunc adapts a function to the Segmenter interface
+type SegmenterFunc func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error)
+
+// Segment calls f
+func (f SegmenterFunc) Segment(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+	return f(ctx, img, params, result)
+}
+
+// registeredMode is a segmentation algorithm with its one-line description
+type registeredMode struct {
+	description string
+	segmenter   Segmenter
+}
+
+// segmenters maps mode names to their algorithms. Each mode registers
+// itself from an init function in the file implementing it.
+var segmenters = map[string]registeredMode{}
+
+// registerMode makes a segmentation algorithm available under name
+func registerMode(name string, description string, s Segmenter) {
+	if _, ok := segmenters[name]; ok {
+		panic(fmt.Sprintf("mode %q registered twice", name))
+	}
+	segmenters[name] = registeredMode{description: description, segmenter: s}
+}
+
+// lookupMode returns the algorithm registered under name
+func lookupMode(name string) (Segmenter, bool) {
+	m, ok := segmenters[name]
+	return m.segmenter, ok
+}
+
+// modeDescription returns the description a mode was registered with
+func modeDescription(name string) string {
+	return segmenters[name].description
+}
+
+// modeNames returns the registered mode names in alphabetical order
+func modeNames() []string {
+	names := make([]string, 0, len(segmenters))
+	for name := range segmenters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
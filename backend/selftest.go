@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"time"
+)
+
+// selfTestImage is a 32x32 gray PNG with a bright disc on a dark gradient
+//
+//go:embed selftest/disc.png
+var selfTestImage []byte
+
+// selfTestForeground is the number of disc pixels in selfTestImage, which
+// the default binary threshold must select exactly
+const selfTestForeground = 197
+
+// selfTestResponse is the JSON body of the self-test endpoint
+type selfTestResponse struct {
+	OK       bool               `json:"ok"`
+	Error    string             `json:"error,omitempty"`
+	TimingMS map[string]float64 `json:"timing_ms"`
+}
+
+// runSelfTest decodes, segments and re-encodes the embedded image with the
+// default parameters and checks the resulting mask
+func runSelfTest(r *http.Request, timer *stageTimer) error {
+	var result Result
+	img, err := decodeInput(bytes.NewReader(selfTestImage), "selftest.png", decodeOptions{}, &result)
+	if err != nil {
+		return fmt.Errorf("error decoding image: %v", err)
+	}
+	timer.mark("decode")
+
+	// The expected mask is a binary one, whatever DEFAULT_MODE is
+	params := defaultSegmentParams()
+	params.Mode = modeBinary
+	segmented, err := segmentDecodedImage(r.Context(), img, params, &result, timer)
+	if err != nil {
+		return fmt.Errorf("error performing segmentation: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, segmented, "selftest.png", encodeOptions{}); err != nil {
+		return fmt.Errorf("error encoding output image: %v", err)
+	}
+	timer.mark("encode")
+
+	// Round-trip the output to check the encoder produced a valid mask
+	decoded, err := png.Decode(&buf)
+	if err != nil {
+		return fmt.Errorf("error decoding output image: %v", err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		return fmt.Errorf("output is %v, want %v", decoded.Bounds(), img.Bounds())
+	}
+	if n := countForeground(decoded); n != selfTestForeground {
+		return fmt.Errorf("mask has %d foreground pixels, want %d", n, selfTestForeground)
+	}
+	timer.mark("verify")
+
+	if len(result.Warnings) > 0 {
+		return fmt.Errorf("unexpected warning: %s", result.Warnings[0])
+	}
+	return nil
+}
+
+// countForeground counts the white pixels of a mask
+func countForeground(img image.Image) int {
+	n := 0
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if intensity(img.At(x, y), channelLuma) > 0x8000 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// selfTestHandler runs the whole pipeline on a built-in image so that a
+// deployment can be verified without uploading anything
+func selfTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	start := time.Now()
+	timer := newStageTimer()
+	err := runSelfTest(r, timer)
+
+	resp := selfTestResponse{OK: err == nil, TimingMS: make(map[string]float64)}
+	for i, stage := range timer.stages {
+		resp.TimingMS[stage] = float64(timer.durations[i]) / float64(time.Millisecond)
+	}
+	resp.TimingMS["total"] = float64(time.Since(start)) / float64(time.Millisecond)
+
+	w.Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		fmt.Printf("Self-test failed: %s\n", err)
+		resp.Error = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	writeJSON(w, r, resp)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// dividerColor separates the panels of the side-by-side composite
+var dividerColor = color.RGBA{128, 128, 128, 255}
+
+func init() {
+	registerMode(modeSideBySide, "The input and its binary mask side by side", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		mask, err := thresholdImage(ctx, img, params)
+		if err != nil {
+			return nil, err
+		}
+		return sideBySide(img, mask, params.Labels), nil
+	}))
+}
+
+// sideBySide composes the original on the left and the mask on the right,
+// separated by a thin divider, optionally labelling both panels
+func sideBySide(original image.Image, mask image.Image, labels bool) *image.RGBA {
+	bounds := original.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	divider := max(2, width/200)
+
+	composite := image.NewRGBA(image.Rect(0, 0, 2*width+divider, height))
+	draw.Draw(composite, image.Rect(0, 0, width, height), original, bounds.Min, draw.Src)
+	draw.Draw(composite, image.Rect(width, 0, width+divider, height), image.NewUniform(dividerColor), image.Point{}, draw.Src)
+	draw.Draw(composite, image.Rect(width+divider, 0, 2*width+divider, height), mask, mask.Bounds().Min, draw.Src)
+
+	if labels {
+		scale := max(1, height/150)
+		drawLabel(composite, image.Pt(2*scale, 2*scale), "ORIGINAL", scale)
+		drawLabel(composite, image.Pt(width+divider+2*scale, 2*scale), "MASK", scale)
+	}
+
+	return composite
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+)
+
+// outputInput is the output format repeating the format of the upload's
+// content, whatever its file name says
+const outputInput = "input"
+
+// sniffLen is the number of leading bytes sniffFormat looks at
+const sniffLen = 8
+
+// sniffFormat returns the output format of content starting with head, or
+// "" when it is in none of the formats the server decodes
+func sniffFormat(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(head, []byte("\xff\xd8\xff")):
+		return "jpg"
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return "gif"
+	case len(head) >= 2 && head[0] == 'P':
+		switch head[1] {
+		case '1', '4':
+			return "pbm"
+		case '2', '5':
+			return "pgm"
+		case '3', '6':
+			return "ppm"
+		}
+	}
+	return ""
+}
+
+// resolveInputFormat replaces output_format=input with the format sniffed
+// from the upload, or with the upload name's format when the content is
+// not recognized. It returns a reader yielding the whole upload again.
+func resolveInputFormat(r io.Reader, params *SegmentParams) io.Reader {
+	if params.OutputFormat != outputInput {
+		return r
+	}
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(sniffLen)
+	params.OutputFormat = sniffFormat(head)
+	return br
+}
+
+// resolveInputFormatOf is resolveInputFormat for a stored file
+func resolveInputFormatOf(path string, params *SegmentParams) error {
+	if params.OutputFormat != outputInput {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	resolveInputFormat(f, params)
+	return nil
+}
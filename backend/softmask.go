@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"image"
+	"math"
+)
+
+func init() {
+	registerMode(modeSoftMask, "Grayscale mask ramping smoothly from black to white through the threshold, for alpha blending", SegmenterFunc(func(ctx context.Context, img image.Image, params SegmentParams, result *Result) (image.Image, error) {
+		return softMask(ctx, img, params.Channel, params.Threshold, params.Softness)
+	}))
+}
+
+// softMask maps the selected channel of every pixel through a sigmoid
+// centered between threshold and the level above it, so that the mask is
+// mid-gray where binary mode switches from background to foreground.
+// softness is the scale of the ramp in gray levels: levels within about
+// four times softness of the threshold get intermediate values.
+func softMask(ctx context.Context, img image.Image, channel string, threshold uint8, softness float64) (*image.Gray, error) {
+	var ramp [256]uint8
+	center := float64(threshold) + 0.5
+	for level := range ramp {
+		ramp[level] = uint8(math.Round(255 / (1 + math.Exp(-(float64(level)-center)/softness))))
+	}
+
+	levels := grayLevels(img, channel)
+	if err := canceled(ctx); err != nil {
+		return nil, err
+	}
+	out := image.NewGray(img.Bounds())
+	for i, level := range levels {
+		out.Pix[i] = ramp[level]
+	}
+	return out, nil
+}
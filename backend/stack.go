@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Ways of combining the images of a stack into one
+const (
+	compositeMedian = "median"
+	compositeMean   = "mean"
+)
+
+// maxStackImages is the most images one stack may hold
+const maxStackImages = 64
+
+// maxStackPixels caps the pixels of all images of a stack together, since
+// they are all decoded into memory before being composited
+const maxStackPixels = 1 << 26
+
+// stackImageConfig reads the dimensions of a stack image without decoding
+// it, the format being detected from the content like decodeInput does
+func stackImageConfig(header *multipart.FileHeader) (image.Config, error) {
+	file, err := header.Open()
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	name := header.Filename
+	head, _ := br.Peek(sniffLen)
+	if format := sniffFormat(head); format != "" {
+		name = strings.TrimSuffix(name, filepath.Ext(name)) + "." + format
+	}
+	return decodeImageConfig(br, name)
+}
+
+// compositeStack combines images of the same size pixel by pixel, taking
+// the median or the mean of each 8-bit channel. The median of an even
+// number of values is the mean of the two middle ones.
+func compositeStack(ctx context.Context, images []image.Image, method string) (*image.RGBA, error) {
+	bounds := images[0].Bounds()
+	for i, img := range images[1:] {
+		if b := img.Bounds(); b.Size() != bounds.Size() {
+			return nil, fmt.Errorf("%w: image %d is %dx%d, image 1 is %dx%d",
+				errSizeMismatch, i+2, b.Dx(), b.Dy(), bounds.Dx(), bounds.Dy())
+		}
+	}
+
+	n := len(images)
+	out := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	samples := make([][4]int, n)
+	values := make([]int, n)
+	for y := 0; y < bounds.Dy(); y++ {
+		if err := canceled(ctx); err != nil {
+			return nil, err
+		}
+		for x := 0; x < bounds.Dx(); x++ {
+			for i, img := range images {
+				b := img.Bounds()
+				c := color.RGBAModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.RGBA)
+				samples[i] = [4]int{int(c.R), int(c.G), int(c.B), int(c.A)}
+			}
+
+			var px [4]uint8
+			for ch := range px {
+				sum := 0
+				for i := range samples {
+					values[i] = samples[i][ch]
+					sum += values[i]
+				}
+				if method == compositeMean {
+					px[ch] = uint8((sum + n/2) / n)
+					continue
+				}
+
+				// Insertion sort, stacks being small
+				for i := 1; i < n; i++ {
+					for j := i; j > 0 && values[j] < values[j-1]; j-- {
+						values[j], values[j-1] = values[j-1], values[j]
+					}
+				}
+				px[ch] = uint8((values[(n-1)/2] + values[n/2] + 1) / 2)
+			}
+			out.SetRGBA(x, y, color.RGBA{px[0], px[1], px[2], px[3]})
+		}
+	}
+	return out, nil
+}
+
+// stackHandler composites the images uploaded as repeated image fields
+// into one and segments it like an upload, the composite being stored as
+// the original
+func stackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse multipart form with 10MB max memory
+	err := parseLimitedMultipartForm(r, 10<<20)
+	if errors.Is(err, errFormLimit) {
+		writeError(w, r, codeFormLimit, "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Unable to parse form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// The body has been read: only the processing holds a worker
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	headers := r.MultipartForm.File["image"]
+	switch {
+	case len(headers) < 2:
+		writeError(w, r, codeMissingImage, "Invalid request: a stack needs at least 2 image fields")
+		return
+	case len(headers) > maxStackImages:
+		writeError(w, r, codeInvalidParameters, fmt.Sprintf("Invalid parameters: a stack holds at most %d images", maxStackImages))
+		return
+	}
+
+	method := strings.ToLower(r.FormValue("composite"))
+	switch method {
+	case "":
+		method = compositeMedian
+	case compositeMedian, compositeMean:
+	default:
+		writeError(w, r, codeInvalidParameters, fmt.Sprintf("Invalid parameters: invalid composite value %q (expected median or mean)", method))
+		return
+	}
+
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+	opts, err := parseUploadOptions(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+
+	// Sizes are checked on the headers first, so that a mismatched or
+	// oversized stack is rejected before any image is decoded
+	var size image.Config
+	for i, header := range headers {
+		cfg, err := stackImageConfig(header)
+		if err != nil {
+			writeError(w, r, codeDecodeFailed, fmt.Sprintf("Invalid request: error decoding image %d (%s): %v", i+1, header.Filename, err))
+			return
+		}
+		if i == 0 {
+			size = cfg
+			continue
+		}
+		if cfg.Width != size.Width || cfg.Height != size.Height {
+			writeError(w, r, codeSizeMismatch, fmt.Sprintf("Invalid request: %v: image %d is %dx%d, image 1 is %dx%d",
+				errSizeMismatch, i+1, cfg.Width, cfg.Height, size.Width, size.Height))
+			return
+		}
+	}
+	if pixels := int64(size.Width) * int64(size.Height) * int64(len(headers)); pixels > maxStackPixels {
+		writeError(w, r, codeImageTooLarge, fmt.Sprintf("Invalid request: %v: the stack holds %d pixels together (max %d)",
+			errImageTooLarge, pixels, maxStackPixels))
+		return
+	}
+
+	images := make([]image.Image, len(headers))
+	for i, header := range headers {
+		file, err := header.Open()
+		if err != nil {
+			writeError(w, r, codeInternal, "Error reading image: "+err.Error())
+			return
+		}
+		var scratch Result
+		images[i], err = decodeInput(file, header.Filename, params.decodeOptions(), &scratch)
+		file.Close()
+		if err != nil {
+			writeError(w, r, codeDecodeFailed, fmt.Sprintf("Invalid request: error decoding image %d (%s): %v", i+1, header.Filename, err))
+			return
+		}
+	}
+
+	composite, err := compositeStack(r.Context(), images, method)
+	if err != nil {
+		writeSegmentError(w, r, err)
+		return
+	}
+
+	// The composite goes through the upload pipeline as a PNG named after
+	// the first image
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, composite); err != nil {
+		writeError(w, r, codeInternal, "Error encoding composite: "+err.Error())
+		return
+	}
+	first := filepath.Base(headers[0].Filename)
+	filename := "stack_" + strings.TrimSuffix(first, filepath.Ext(first)) + ".png"
+
+	// With a callback URL only the segmentation runs in the background
+	if opts.CallbackURL != "" {
+		submitCallbackJob(w, r, &buf, filename, params, opts)
+		return
+	}
+	result, ok := storeAndSegment(w, r, bytes.NewReader(buf.Bytes()), int64(buf.Len()), filename, params, opts)
+	if !ok {
+		return
+	}
+	writeJSON(w, r, result)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"io"
+	"math"
+	"net/http"
+)
+
+// BoundingBox is the smallest rectangle containing every foreground pixel
+type BoundingBox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// MaskStats summarizes a segmentation mask for clients that only need
+// numbers
+type MaskStats struct {
+	Width             int          `json:"width"`
+	Height            int          `json:"height"`
+	ForegroundPixels  int          `json:"foreground_pixels"`
+	ForegroundPercent float64      `json:"foreground_percent"`
+	Components        int          `json:"components"`
+	LargestComponent  int          `json:"largest_component"`
+	BoundingBox       *BoundingBox `json:"bounding_box,omitempty"`
+}
+
+// statsModes are the modes producing a foreground mask that stats can be
+// computed from
+var statsModes = map[string]bool{
+	modeBinary:     true,
+	modeSauvola:    true,
+	modeBgSubtract: true,
+}
+
+// maskStats computes the foreground statistics of a mask image, counting
+// components with the given 4- or 8-connectivity
+func maskStats(img image.Image, connectivity int) *MaskStats {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	mask := maskBits(img)
+	labels := make([]int, len(mask))
+
+	stats := &MaskStats{Width: width, Height: height}
+	minX, minY, maxX, maxY := width, height, -1, -1
+	for i, fg := range mask {
+		if !fg {
+			continue
+		}
+		stats.ForegroundPixels++
+		x, y := i%width, i/width
+		minX, minY = min(minX, x), min(minY, y)
+		maxX, maxY = max(maxX, x), max(maxY, y)
+
+		if labels[i] == 0 {
+			stats.Components++
+			size := fillRegion(mask, labels, width, height, i, stats.Components, connectivity)
+			stats.LargestComponent = max(stats.LargestComponent, size)
+		}
+	}
+
+	if len(mask) > 0 {
+		stats.ForegroundPercent = math.Round(10000*float64(stats.ForegroundPixels)/float64(len(mask))) / 100
+	}
+	if maxX >= 0 {
+		stats.BoundingBox = &BoundingBox{
+			X:      minX + bounds.Min.X,
+			Y:      minY + bounds.Min.Y,
+			Width:  maxX - minX + 1,
+			Height: maxY - minY + 1,
+		}
+	}
+	return stats
+}
+
+// segmentStatsOnly segments an upload in memory and returns its statistics
+// without storing the upload or encoding an output image. Errors are
+// written to w.
+func segmentStatsOnly(w http.ResponseWriter, r *http.Request, file io.Reader, filename string, params SegmentParams) (Result, bool) {
+	timer := newStageTimer()
+	defer func() { debugf("%s: %s", filename, timer) }()
+
+	var result Result
+	img, err := decodeInput(file, filename, params.decodeOptions(), &result)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeDecodeFailed), "Error decoding image: "+err.Error())
+		return Result{}, false
+	}
+	timer.mark("decode")
+
+	segmented, err := segmentDecodedImage(r.Context(), img, params, &result, timer)
+	if err != nil {
+		writeSegmentError(w, r, err)
+		return Result{}, false
+	}
+
+	result.Stats = maskStats(segmented, params.Connectivity)
+	timer.mark("stats")
+	result.Message = "Image statistics computed successfully"
+	return result, true
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// originalStore deduplicates stored originals by the hash of their content.
+// It counts how many results link to each original so that cleanup only
+// removes an original once nothing references it any more.
+type originalStore struct {
+	mu     sync.Mutex
+	byHash map[string]string // content hash -> original path
+	refs   map[string]int    // original path -> number of results using it
+}
+
+var originals = &originalStore{
+	byHash: make(map[string]string),
+	refs:   make(map[string]int),
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// index hashes the originals already present in dir so that uploads made
+// before a restart are still deduplicated, and counts a reference for every
+// stored result linking to one. The temporary files of saves interrupted by
+// a crash are removed.
+func (s *originalStore) index(dir string) error {
+	leftovers, err := filepath.Glob(filepath.Join(dir, uploadTempPrefix+"*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range leftovers {
+		os.Remove(path)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "original_*"))
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, path := range paths {
+		sum, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("error hashing %s: %v", path, err)
+		}
+		s.byHash[sum] = path
+	}
+
+	results, err := listResults()
+	if err != nil {
+		return fmt.Errorf("error reading results: %v", err)
+	}
+	for _, stored := range results {
+		if path := uploadPath(stored.OriginalImage); path != "" {
+			s.refs[path]++
+		}
+	}
+
+	return nil
+}
+
+// uploadTempPrefix starts the names of originals being written
+const uploadTempPrefix = ".upload-"
+
+// contextReader fails reads once its context is done, stopping a copy when
+// the request it serves is canceled
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := canceled(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// save stores the upload as dir/original_<filename>, or returns the path of
+// an existing original with identical content instead of writing a new copy,
+// and reports whether it wrote a file.
+// A different original already stored under the same name is handled
+// according to policy, except that one results still link to is never
+// overwritten but versioned. The upload is written to a temporary file renamed
+// into place once complete, so that an error or the cancellation of ctx
+// part way through leaves no truncated original behind.
+func (s *originalStore) save(ctx context.Context, src io.Reader, dir string, filename string, policy string) (string, bool, error) {
+	tmp, err := os.CreateTemp(dir, uploadTempPrefix+"*")
+	if err != nil {
+		return "", false, fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), contextReader{ctx, src})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = canceled(ctx)
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error saving file: %w", err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.byHash[sum]; ok {
+		if _, err := os.Stat(existing); err == nil {
+			s.refs[existing]++
+			return existing, false, nil
+		}
+		delete(s.byHash, sum)
+	}
+
+	name := filepath.Join(dir, "original_"+filename)
+	path, err := resolveOutputPath(name, policy)
+	if err != nil {
+		return "", false, err
+	}
+	// Results still link to the original under this name, so overwriting it
+	// would change their input: a new version is written instead
+	if s.refs[path] > 0 {
+		if path, err = resolveOutputPath(name, policyVersion); err != nil {
+			return "", false, err
+		}
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", false, fmt.Errorf("error saving file: %v", err)
+	}
+
+	// The previous content at this path (if any) has been replaced, and
+	// nothing referenced it
+	for otherSum, otherPath := range s.byHash {
+		if otherPath == path {
+			delete(s.byHash, otherSum)
+		}
+	}
+	s.byHash[sum] = path
+	s.refs[path] = 1
+
+	return path, true, nil
+}
+
+// release drops one reference to an original and deletes the file once no
+// result links to it any more
+func (s *originalStore) release(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs[path] > 1 {
+		s.refs[path]--
+		return nil
+	}
+
+	delete(s.refs, path)
+	for sum, p := range s.byHash {
+		if p == path {
+			delete(s.byHash, sum)
+		}
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeUnreferenced deletes an original that no result or upload in
+// progress links to, and reports whether it did
+func (s *originalStore) removeUnreferenced(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.refs[path] > 0 {
+		return false
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	for sum, p := range s.byHash {
+		if p == path {
+			delete(s.byHash, sum)
+		}
+	}
+	return true
+}
+
+// uploadURL returns the URL under which a file in the uploads directory is served
+func uploadURL(path string) string {
+	return "/uploads/" + strings.TrimPrefix(filepath.ToSlash(path), uploadsDir+"/")
+}
+
+// uploadPath returns the path of the file in the uploads directory served
+// under url, or "" when url is not one
+func uploadPath(url string) string {
+	name, ok := strings.CutPrefix(url, "/uploads/")
+	if !ok || name == "" || path.Base(name) != name || strings.HasPrefix(name, ".") {
+		return ""
+	}
+	return filepath.Join(uploadsDir, name)
+}
+
+// storeGeneratedPNG writes an image computed by the server, such as a diff,
+// to the uploads directory under prefix and a random identifier and returns
+// its path
+func storeGeneratedPNG(prefix string, img image.Image) (string, error) {
+	// Encoded first so that exactly its size is reserved
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", fmt.Errorf("error encoding output image: %v", err)
+	}
+	reservation, err := uploadsQuota.reserve(int64(buf.Len()))
+	if err != nil {
+		return "", err
+	}
+	defer reservation.release()
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("error creating output file: %v", err)
+	}
+	path := filepath.Join(uploadsDir, prefix+hex.EncodeToString(id[:])+".png")
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("error writing output file: %v", err)
+	}
+	reservation.wrote(path)
+	return path, nil
+}
+
+// Policies for writing an output file whose name is already taken
+const (
+	policyOverwrite = "overwrite"
+	policyError     = "error"
+	policyVersion   = "version"
+)
+
+// errOutputExists is returned under policyError when the output name is taken
+var errOutputExists = errors.New("output already exists")
+
+func validOutputPolicy(policy string) bool {
+	return policy == policyOverwrite || policy == policyError || policy == policyVersion
+}
+
+// resolveOutputPath returns the path to write an output to under the given
+// policy. With policyVersion an existing name.png becomes name_v2.png,
+// name_v3.png and so on.
+func resolveOutputPath(path string, policy string) (string, error) {
+	if policy == policyOverwrite {
+		return path, nil
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return path, nil
+	}
+	if policy == policyError {
+		return "", fmt.Errorf("%w: %s", errOutputExists, filepath.Base(path))
+	}
+
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for version := 2; ; version++ {
+		candidate := fmt.Sprintf("%s_v%d%s", base, version, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+}
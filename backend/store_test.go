@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOriginalStoreSave(t *testing.T) {
+	dir := t.TempDir()
+	s := &originalStore{byHash: make(map[string]string), refs: make(map[string]int)}
+	save := func(content, filename string) (string, bool) {
+		t.Helper()
+		path, created, err := s.save(context.Background(), strings.NewReader(content), dir, filename, policyOverwrite)
+		if err != nil {
+			t.Fatalf("save %s: %v", filename, err)
+		}
+		return path, created
+	}
+	content := func(path string) string {
+		t.Helper()
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	original := func(name string) string { return filepath.Join(dir, "original_"+name) }
+
+	// The same content under another name is deduplicated
+	a, created := save("first", "a.png")
+	if a != original("a.png") || !created || s.refs[a] != 1 {
+		t.Fatalf("first save: %s %v refs %d", a, created, s.refs[a])
+	}
+	if path, created := save("first", "b.png"); path != a || created || s.refs[a] != 2 {
+		t.Fatalf("dedup hit: %s %v refs %d", path, created, s.refs[a])
+	}
+
+	// Other content under a name results link to is versioned, not
+	// overwritten
+	v2, created := save("second", "a.png")
+	if v2 != original("a_v2.png") || !created || s.refs[v2] != 1 {
+		t.Fatalf("overwrite of a referenced original: %s %v refs %d", v2, created, s.refs[v2])
+	}
+	if content(a) != "first" || content(v2) != "second" {
+		t.Errorf("contents = %q, %q", content(a), content(v2))
+	}
+	if path, _ := save("second", "c.png"); path != v2 || s.refs[v2] != 2 {
+		t.Errorf("dedup of the version: %s refs %d", path, s.refs[v2])
+	}
+
+	// An original is deleted with its last reference
+	for i, wantExists := range []bool{true, false} {
+		if err := s.release(a); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(a); (err == nil) != wantExists {
+			t.Errorf("release %d: exists = %v, want %v", i+1, err == nil, wantExists)
+		}
+	}
+	if path, created := save("first", "d.png"); path != original("d.png") || !created {
+		t.Errorf("save after release: %s %v, want a new file", path, created)
+	}
+
+	// An original no result links to is overwritten and starts over at a
+	// single reference
+	stale := original("e.png")
+	if err := os.WriteFile(stale, []byte("stale"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if path, created := save("third", "e.png"); path != stale || !created || s.refs[stale] != 1 || content(stale) != "third" {
+		t.Fatalf("overwrite of an unreferenced original: %s %v refs %d", path, created, s.refs[stale])
+	}
+	if err := s.release(stale); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("overwritten original not deleted with its only reference: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+)
+
+// outputSVG is the output format writing contours as a vector document
+const outputSVG = "svg"
+
+// svgCoord formats a contour coordinate as the centre of its pixel
+func svgCoord(v int) string {
+	return strconv.FormatFloat(float64(v)+0.5, 'f', -1, 64)
+}
+
+// writeContoursSVG writes contours as an SVG document covering bounds, with
+// one filled path per region. Paths run through pixel centres and are
+// stroked one pixel wide so that they cover the pixels of their region,
+// including regions only one pixel thick.
+func writeContoursSVG(w io.Writer, contours [][]Point, bounds image.Rectangle) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="%d %d %d %d">`+"\n",
+		bounds.Dx(), bounds.Dy(), bounds.Min.X, bounds.Min.Y, bounds.Dx(), bounds.Dy())
+	fmt.Fprintf(bw, `<g fill="black" stroke="black" stroke-width="1" stroke-linejoin="round" stroke-linecap="round">`+"\n")
+
+	for i, contour := range contours {
+		if len(contour) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, `<path id="region-%d" d="`, i+1)
+		for j, p := range contour {
+			cmd := "L"
+			if j == 0 {
+				cmd = "M"
+			}
+			fmt.Fprintf(bw, "%s%s %s", cmd, svgCoord(p.X), svgCoord(p.Y))
+		}
+		fmt.Fprintf(bw, "Z\"/>\n")
+	}
+
+	fmt.Fprintf(bw, "</g>\n</svg>\n")
+	return bw.Flush()
+}
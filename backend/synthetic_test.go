@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+var (
+	synthBlack = color.RGBA{0, 0, 0, 255}
+	synthWhite = color.RGBA{255, 255, 255, 255}
+)
+
+// synthGradient returns a width x height gray image rising from 0 in the
+// first column to 255 in the last
+func synthGradient(width int, height int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetGray(x, y, color.Gray{uint8(x * 255 / max(1, width-1))})
+		}
+	}
+	return img
+}
+
+// synthCheckerboard returns a width x height checkerboard of cell x cell
+// squares, starting with dark in the top left corner
+func synthCheckerboard(width int, height int, cell int, dark color.RGBA, light color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := dark
+			if (x/cell+y/cell)%2 == 1 {
+				c = light
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// synthNoise returns a width x height gray image of values drawn uniformly
+// from mean-spread to mean+spread, clamped to 0-255, the same for a seed
+func synthNoise(width int, height int, mean int, spread int, seed int64) *image.Gray {
+	rng := rand.New(rand.NewSource(seed))
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(min(255, max(0, mean-spread+rng.Intn(2*spread+1))))
+	}
+	return img
+}
+
+// synthCircle is a disk drawn by synthCircles
+type synthCircle struct {
+	X, Y   int
+	Radius float64
+}
+
+// synthCircles returns a width x height image of fg disks on a bg
+// background. A pixel belongs to a disk when its center is within the
+// radius, so a disk covers about pi*r*r pixels.
+func synthCircles(width int, height int, bg color.RGBA, fg color.RGBA, circles ...synthCircle) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := bg
+			for _, circle := range circles {
+				if math.Hypot(float64(x-circle.X), float64(y-circle.Y)) <= circle.Radius {
+					c = fg
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// runSynthetic runs mode on img with the defaults of the mode changed by
+// adjust, failing the test on error
+func runSynthetic(t *testing.T, img image.Image, mode string, adjust func(params *SegmentParams)) (image.Image, Result) {
+	t.Helper()
+	params := modeDefaultParams(mode)
+	if adjust != nil {
+		adjust(&params)
+	}
+	var result Result
+	out, err := runMode(context.Background(), img, params, &result)
+	if err != nil {
+		t.Fatalf("%s: %v", mode, err)
+	}
+	return out, result
+}
+
+// isWhite reports whether the pixel of img at (x, y) is white
+func isWhite(img image.Image, x int, y int) bool {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return r == 0xffff && g == 0xffff && b == 0xffff
+}
+
+// distinctColors returns the number of different colors in img
+func distinctColors(img image.Image) int {
+	seen := map[color.RGBA64]bool{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			seen[color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}] = true
+		}
+	}
+	return len(seen)
+}
+
+func TestSyntheticBinaryCheckerboard(t *testing.T) {
+	img := synthCheckerboard(32, 32, 8, synthBlack, synthWhite)
+	out, _ := runSynthetic(t, img, modeBinary, nil)
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if want := img.RGBAAt(x, y) == synthWhite; isWhite(out, x, y) != want {
+				t.Fatalf("pixel (%d, %d): foreground %v, want %v", x, y, !want, want)
+			}
+		}
+	}
+}
+
+func TestSyntheticBinaryGradient(t *testing.T) {
+	img := synthGradient(256, 4)
+	for _, level := range []uint8{32, 128, 224} {
+		out, _ := runSynthetic(t, img, modeBinary, func(params *SegmentParams) { params.Threshold = level })
+		for x := 0; x < 256; x++ {
+			if want := x >= int(level); isWhite(out, x, 2) != want {
+				t.Errorf("threshold %d, column %d: foreground %v, want %v", level, x, !want, want)
+			}
+		}
+	}
+}
+
+func TestSyntheticKMeansCheckerboard(t *testing.T) {
+	img := synthCheckerboard(32, 32, 4, color.RGBA{40, 80, 20, 255}, color.RGBA{200, 180, 160, 255})
+	out, _ := runSynthetic(t, img, modeKMeans, func(params *SegmentParams) {
+		seed := int64(1)
+		params.K, params.Seed = 2, &seed
+	})
+	if n := distinctColors(out); n != 2 {
+		t.Fatalf("got %d colors, want 2", n)
+	}
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			same := img.RGBAAt(x, y) == img.RGBAAt(0, 0)
+			if (out.At(x, y) == out.At(0, 0)) != same {
+				t.Fatalf("pixel (%d, %d) clustered apart from its input color", x, y)
+			}
+		}
+	}
+}
+
+func TestSyntheticBandsGradient(t *testing.T) {
+	img := synthGradient(256, 2)
+	out, _ := runSynthetic(t, img, modeBands, func(params *SegmentParams) { params.Cutoffs = []uint8{64, 128, 192} })
+	if n := distinctColors(out); n != 4 {
+		t.Fatalf("got %d bands, want 4", n)
+	}
+	for _, x := range []int{0, 64, 128, 192} {
+		if out.At(x, 0) != out.At(x+63, 1) {
+			t.Errorf("columns %d and %d are in different bands", x, x+63)
+		}
+	}
+}
+
+func TestSyntheticRegionStatsCircles(t *testing.T) {
+	circles := []synthCircle{{16, 16, 6}, {48, 20, 8}, {28, 46, 10}}
+	img := synthCircles(64, 64, synthBlack, synthWhite, circles...)
+	_, result := runSynthetic(t, img, modeRegionStats, nil)
+	if len(result.Regions) != len(circles) {
+		t.Fatalf("got %d regions, want %d", len(result.Regions), len(circles))
+	}
+	for _, circle := range circles {
+		found := false
+		for _, region := range result.Regions {
+			if math.Abs(region.Centroid.X-float64(circle.X)) > 0.5 || math.Abs(region.Centroid.Y-float64(circle.Y)) > 0.5 {
+				continue
+			}
+			found = true
+			if want := math.Pi * circle.Radius * circle.Radius; math.Abs(float64(region.Area)-want) > 0.1*want {
+				t.Errorf("circle at (%d, %d): area %d, want about %.0f", circle.X, circle.Y, region.Area, want)
+			}
+		}
+		if !found {
+			t.Errorf("no region centered on the circle at (%d, %d)", circle.X, circle.Y)
+		}
+	}
+}
+
+func TestSyntheticContoursCircles(t *testing.T) {
+	circles := []synthCircle{{12, 12, 5}, {40, 14, 7}, {24, 40, 9}}
+	img := synthCircles(56, 56, synthBlack, synthWhite, circles...)
+	_, result := runSynthetic(t, img, modeContours, nil)
+	if len(result.Contours) != len(circles) {
+		t.Fatalf("got %d contours, want %d", len(result.Contours), len(circles))
+	}
+	for i, contour := range result.Contours {
+		for _, p := range contour {
+			if img.RGBAAt(p.X, p.Y) != synthWhite {
+				t.Fatalf("contour %d passes through background pixel (%d, %d)", i, p.X, p.Y)
+			}
+		}
+	}
+}
+
+func TestSyntheticSauvolaUnevenLighting(t *testing.T) {
+	// Dark disks on a background brightening from left to right, the right
+	// disk brighter than the left background, so no global threshold
+	// separates both disks from the background
+	disks := synthCircles(96, 32, synthBlack, synthWhite, synthCircle{16, 16, 5}, synthCircle{80, 16, 5})
+	img := image.NewGray(disks.Bounds())
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 96; x++ {
+			v := uint8(60 + x*2)
+			if disks.RGBAAt(x, y) == synthWhite {
+				v /= 3
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+
+	out, _ := runSynthetic(t, img, modeSauvola, nil)
+	for _, p := range []image.Point{{16, 16}, {80, 16}} {
+		if isWhite(out, p.X, p.Y) {
+			t.Errorf("disk at %v was not told apart from its background", p)
+		}
+	}
+	for _, p := range []image.Point{{40, 4}, {90, 28}} {
+		if !isWhite(out, p.X, p.Y) {
+			t.Errorf("background at %v was taken for a disk", p)
+		}
+	}
+}
+
+func TestSyntheticBlobsCircles(t *testing.T) {
+	circles := []synthCircle{{16, 16, 3}, {48, 16, 3}, {32, 44, 3}}
+	img := synthCircles(64, 64, synthBlack, synthWhite, circles...)
+	_, result := runSynthetic(t, img, modeBlobs, nil)
+	if len(result.Blobs) != len(circles) {
+		t.Fatalf("got %d blobs, want %d: %v", len(result.Blobs), len(circles), result.Blobs)
+	}
+	for _, circle := range circles {
+		found := false
+		for _, blob := range result.Blobs {
+			found = found || math.Hypot(float64(blob.X-circle.X), float64(blob.Y-circle.Y)) <= 1
+		}
+		if !found {
+			t.Errorf("no blob at the circle at (%d, %d)", circle.X, circle.Y)
+		}
+	}
+}
+
+func TestSyntheticMeanShiftNoise(t *testing.T) {
+	img := synthNoise(32, 32, 128, 12, 7)
+	out, _ := runSynthetic(t, img, modeMeanShift, nil)
+
+	spread := func(img image.Image) float64 {
+		var sum, sumSq float64
+		n := 0
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				v := float64(color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+				sum, sumSq, n = sum+v, sumSq+v*v, n+1
+			}
+		}
+		mean := sum / float64(n)
+		return math.Sqrt(sumSq/float64(n) - mean*mean)
+	}
+	if before, after := spread(img), spread(out); after > before/2 {
+		t.Errorf("standard deviation went from %.1f to %.1f, want it at least halved", before, after)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxThresholdOverlays bounds the thresholds parameter, every overlay
+// being a full image stored next to the output
+const maxThresholdOverlays = 16
+
+// overlayColor tints the foreground of threshold overlays
+var overlayColor = color.RGBA{255, 0, 0, 255}
+
+// ThresholdOverlay is the input with the foreground at one threshold
+// tinted, stored as a PNG
+type ThresholdOverlay struct {
+	Threshold         uint8   `json:"threshold"`
+	ForegroundPercent float64 `json:"foreground_percent"`
+	Image             string  `json:"image,omitempty"`
+}
+
+// thresholdOverlays segments img at every threshold of params.Thresholds,
+// with the same channel, denoising and despeckling as the main mask, and
+// records the overlays in result until storeThresholdOverlays writes them
+func thresholdOverlays(ctx context.Context, img image.Image, params SegmentParams, result *Result) error {
+	denoised, err := denoiseImage(ctx, img, params)
+	if err != nil {
+		return err
+	}
+
+	for _, threshold := range params.Thresholds {
+		p := params
+		p.Threshold = threshold
+		mask, err := foregroundMask(ctx, denoised, p)
+		if err != nil {
+			return err
+		}
+
+		foreground := 0
+		for _, fg := range mask {
+			if fg {
+				foreground++
+			}
+		}
+		result.ThresholdOverlays = append(result.ThresholdOverlays, ThresholdOverlay{
+			Threshold:         threshold,
+			ForegroundPercent: 100 * float64(foreground) / float64(len(mask)),
+		})
+		result.overlays = append(result.overlays, overlayMask(img, mask))
+	}
+	return nil
+}
+
+// storeThresholdOverlays writes the overlays of result next to the output
+// at outputPath, named after it and their threshold, and records their URLs
+func storeThresholdOverlays(outputPath string, result *Result) error {
+	base := strings.TrimSuffix(outputPath, filepath.Ext(outputPath))
+	for i, overlay := range result.overlays {
+		path := fmt.Sprintf("%s_threshold_%d.png", base, result.ThresholdOverlays[i].Threshold)
+		out, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("error creating overlay file: %v", err)
+		}
+		err = png.Encode(out, overlay)
+		out.Close()
+		if err != nil {
+			os.Remove(path)
+			return fmt.Errorf("error encoding overlay image: %v", err)
+		}
+		result.ThresholdOverlays[i].Image = uploadURL(path)
+	}
+	result.overlays = nil
+	return nil
+}
+
+// overlayMask blends overlayColor half and half into the foreground
+// pixels of img
+func overlayMask(img image.Image, mask []bool) *image.RGBA {
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	out := image.NewRGBA(image.Rect(0, 0, width, bounds.Dy()))
+	for i, fg := range mask {
+		x, y := i%width, i/width
+		c := color.RGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.RGBA)
+		if fg {
+			c.R = uint8((uint16(c.R) + uint16(overlayColor.R)) / 2)
+			c.G = uint8((uint16(c.G) + uint16(overlayColor.G)) / 2)
+			c.B = uint8((uint16(c.B) + uint16(overlayColor.B)) / 2)
+		}
+		c.A = 255
+		out.SetRGBA(x, y, c)
+	}
+	return out
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// transformFormats maps the media types the transform endpoint can produce
+// to the file extension used to pick an encoder
+var transformFormats = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+}
+
+// negotiateFormat picks the output media type from an Accept header,
+// preferring PNG when the client accepts anything. It returns false when
+// none of the acceptable types can be produced.
+func negotiateFormat(accept string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return "image/png", true
+	}
+
+	type candidate struct {
+		mediaType string
+		q         float64
+		order     int
+	}
+	var candidates []candidate
+
+	for i, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			candidates = append(candidates, candidate{mediaType, q, i})
+		}
+	}
+
+	// Highest quality first, then the order the client listed them in
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	for _, c := range candidates {
+		switch {
+		case c.mediaType == "*/*" || c.mediaType == "image/*":
+			return "image/png", true
+		case transformFormats[c.mediaType] != "":
+			return c.mediaType, true
+		}
+	}
+
+	return "", false
+}
+
+// transformHandler segments an uploaded image and returns the result in the
+// response body without storing anything on disk. The output format is
+// chosen from the Accept header.
+func transformHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, codeMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	// Parse multipart form with 10MB max memory
+	err := parseLimitedMultipartForm(r, 10<<20)
+	if errors.Is(err, errFormLimit) {
+		writeError(w, r, codeFormLimit, "Invalid request: "+err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, codeMalformedRequest, "Unable to parse form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// The body has been read: only the processing holds a worker
+	release, ok := awaitWorker(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	file, handler, err := r.FormFile("image")
+	if err != nil {
+		writeError(w, r, codeMissingImage, "Error retrieving file")
+		return
+	}
+	defer file.Close()
+
+	params, err := parseSegmentParams(r)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeInvalidParameters), "Invalid parameters: "+err.Error())
+		return
+	}
+
+	if len(params.Thresholds) > 0 {
+		writeError(w, r, codeInvalidParameters, "Invalid parameters: thresholds overlays are only returned in JSON, by /api/upload")
+		return
+	}
+
+	// Statistics are always returned as JSON whatever the client accepts,
+	// and SVG and RLE output are asked for explicitly. A forced output
+	// format is sent whatever the client accepts.
+	mediaType, ok := negotiateFormat(r.Header.Get("Accept"))
+	ext := transformFormats[mediaType]
+	if config.ForceOutputFormat != "" {
+		mediaType, ext, ok = forcedOutputFormats[config.ForceOutputFormat], "."+config.ForceOutputFormat, true
+	}
+	if !ok && !params.StatsOnly && params.OutputFormat != outputSVG && params.OutputFormat != outputRLE {
+		writeError(w, r, codeNotAcceptable, "Not acceptable: supported formats are image/png, image/jpeg and image/gif")
+		return
+	}
+
+	timer := newStageTimer()
+	defer func() { debugf("%s: %s", handler.Filename, timer) }()
+
+	var result Result
+	img, err := decodeInput(file, handler.Filename, params.decodeOptions(), &result)
+	if err != nil {
+		writeError(w, r, errorCodeOf(err, codeDecodeFailed), "Error decoding image: "+err.Error())
+		return
+	}
+	timer.mark("decode")
+
+	segmented, err := segmentDecodedImage(r.Context(), img, params, &result, timer)
+	if err != nil {
+		writeSegmentError(w, r, err)
+		return
+	}
+
+	if params.StatsOnly {
+		result.Stats = maskStats(segmented, params.Connectivity)
+		result.Message = "Image statistics computed successfully"
+		writeJSON(w, r, result)
+		return
+	}
+
+	if result.svg != nil {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(result.svg)
+		timer.mark("encode")
+		return
+	}
+
+	// Modes without a raster output answer with their JSON result
+	if params.OutputFormat == outputRLE && segmented != nil {
+		result.RLE = encodeRLE(segmented)
+		segmented = nil
+	}
+	if segmented == nil {
+		result.Message = "Image segmentation completed successfully"
+		writeJSON(w, r, result)
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Vary", "Accept")
+	if result.Seed != nil {
+		w.Header().Set("Segmentation-Seed", strconv.FormatInt(*result.Seed, 10))
+	}
+	if result.BlobCount != nil {
+		w.Header().Set("Blob-Count", strconv.Itoa(*result.BlobCount))
+	}
+	if result.Preview {
+		w.Header().Set("Preview-Step", strconv.Itoa(result.PreviewStep))
+	}
+	if c := result.AutoCrop; c != nil {
+		w.Header().Set("Autocrop", fmt.Sprintf("%d,%d,%d,%d", c.X, c.Y, c.Width, c.Height))
+	}
+	for _, warning := range result.Warnings {
+		w.Header().Add("Warning", `199 - "`+strings.ReplaceAll(warning, `"`, `'`)+`"`)
+	}
+
+	// The image is streamed as it is encoded, so once the first bytes are out
+	// the status can no longer change. A failure after that point aborts the
+	// connection, leaving the client with a truncated chunked response rather
+	// than an image that looks complete.
+	stream := &flushWriter{w: w, rc: http.NewResponseController(w)}
+	if err := encodeImage(stream, segmented, ext, params.encodeOptions(&result)); err != nil {
+		if stream.written == 0 {
+			writeError(w, r, codeInternal, "Error encoding output image: "+err.Error())
+			return
+		}
+		fmt.Printf("Error streaming %s after %d bytes: %s\n", handler.Filename, stream.written, err)
+		panic(http.ErrAbortHandler)
+	}
+	timer.mark("encode")
+}
+
+// flushWriter flushes every write to the client so encoded bytes are sent as
+// soon as the encoder produces them
+type flushWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	written int64
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	// Writers that cannot flush still receive the whole image, just buffered
+	if err := f.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// errSegmentTimeout is returned when segmentation runs past its deadline
+var errSegmentTimeout = errors.New("segmentation timed out")
+
+// runWithWatchdog runs fn with a context that is cancelled once timeout
+// elapses. If fn has not returned by then, the watchdog logs a stack dump
+// for diagnostics and returns errSegmentTimeout without waiting further;
+// the segmentation loops check the context and exit on their own. A panic
+// in fn is returned as an error, since net/http only recovers the panics of
+// the handler's own goroutine.
+func runWithWatchdog(ctx context.Context, name string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- fmt.Errorf("%s panicked: %v", name, p)
+			}
+		}()
+		done <- fn(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return ctx.Err()
+		}
+
+		buf := make([]byte, 1<<20)
+		buf = buf[:runtime.Stack(buf, true)]
+		fmt.Printf("Watchdog: %s exceeded %s, goroutine dump:\n%s\n", name, timeout, buf)
+		return fmt.Errorf("%w after %s", errSegmentTimeout, timeout)
+	}
+}
+
+// canceled returns the context error once ctx is done, for polling inside
+// pixel loops
+func canceled(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunWithWatchdogRecoversPanic(t *testing.T) {
+	err := runWithWatchdog(context.Background(), "binary segmentation", time.Second, func(ctx context.Context) error {
+		var pixels []uint8
+		_ = pixels[3]
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "binary segmentation panicked") {
+		t.Errorf("err = %v, want the panic as an error", err)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// White balance methods
+const (
+	whiteBalanceNone       = ""
+	whiteBalanceGrayWorld  = "grayworld"
+	whiteBalanceWhitePatch = "whitepatch"
+)
+
+// whitePatchPercentile is the share of pixels below the level taken as
+// white in white-patch balancing, so a few clipped highlights do not
+// decide the gains
+const whitePatchPercentile = 0.99
+
+// whiteBalance removes a color cast by scaling each channel with a gain.
+// Gray-world assumes the average color of the scene is gray and scales the
+// channel means to their common mean. White-patch assumes the brightest
+// pixels are white and scales each channel's 99th percentile to full
+// intensity. Grayscale images have no cast and are returned unchanged.
+func whiteBalance(img image.Image, method string) image.Image {
+	if method == whiteBalanceNone {
+		return img
+	}
+	switch img.(type) {
+	case *image.Gray, *image.Gray16:
+		return img
+	}
+
+	bounds := img.Bounds()
+	width := bounds.Dx()
+	pixels := make([]color.RGBA, width*bounds.Dy())
+	var hist [3][256]int
+	var sum [3]float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			pixels[(y-bounds.Min.Y)*width+x-bounds.Min.X] = c
+			for i, v := range [3]uint8{c.R, c.G, c.B} {
+				hist[i][v]++
+				sum[i] += float64(v)
+			}
+		}
+	}
+
+	var gains [3]float64
+	switch method {
+	case whiteBalanceWhitePatch:
+		for i := range gains {
+			white := percentileLevel(hist[i], len(pixels), whitePatchPercentile)
+			gains[i] = 255 / float64(max(white, 1))
+		}
+	default:
+		gray := (sum[0] + sum[1] + sum[2]) / 3
+		for i := range gains {
+			gains[i] = gray / max(sum[i], 1)
+		}
+	}
+
+	balanced := image.NewRGBA(bounds)
+	for i, c := range pixels {
+		var out [3]uint8
+		for ch, v := range [3]uint8{c.R, c.G, c.B} {
+			out[ch] = uint8(min(float64(v)*gains[ch]+0.5, 255))
+		}
+		balanced.SetRGBA(bounds.Min.X+i%width, bounds.Min.Y+i/width, color.RGBA{out[0], out[1], out[2], c.A})
+	}
+	return balanced
+}
+
+// percentileLevel returns the lowest level at or below which the share p of
+// the total pixels lie
+func percentileLevel(hist [256]int, total int, p float64) int {
+	seen := 0
+	for level, count := range hist {
+		seen += count
+		if float64(seen) >= p*float64(total) {
+			return level
+		}
+	}
+	return 255
+}
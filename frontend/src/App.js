@@ -50,7 +50,7 @@ function App() {
       // In a real implementation, you would receive the segmented image URL from the backend
       setSegmentedImage(response.data.segmented_image);
     } catch (err) {
-      setError('Error processing image: ' + err.message);
+      setError('Error processing image: ' + (err.response?.data?.error || err.message));
     } finally {
       setLoading(false);
     }